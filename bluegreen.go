@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// colorLabel tells the pods of the blue and green Deployments apart, the Services select one color
+	colorLabel = annotationPrefix + "color"
+
+	colorBlue  = "blue"
+	colorGreen = "green"
+)
+
+// blueGreenDeployment deploys a Deployment as <name>-blue and <name>-green in turn, switching its Services
+// to the color deployed once it rolled out
+type blueGreenDeployment struct {
+	name      string
+	namespace string
+	// deployment is the rendered Deployment, renamed to its color
+	deployment *manifestObject
+	services   []*manifestObject
+	// active is the color the Services selected before the deploy, empty if none
+	active string
+	// color is the color deployed
+	color string
+}
+
+// otherColor returns the color which is not color, blue if none
+func otherColor(color string) string {
+	if color == colorBlue {
+		return colorGreen
+	}
+	return colorBlue
+}
+
+// colorName names the Deployment of a color, e.g. app-blue
+func colorName(name, color string) string {
+	return name + "-" + color
+}
+
+// objectReference returns an object referring to a live object, which may not be in the manifests
+func objectReference(apiVersion, kind, name, namespace string) *manifestObject {
+	metadata := map[string]interface{}{"name": name}
+	if namespace != "" {
+		metadata["namespace"] = namespace
+	}
+
+	return &manifestObject{object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       kind,
+		"metadata":   metadata,
+	}}
+}
+
+// blueGreenNamespace returns the namespace of the blue-green Deployment, as rendered if it is in the manifests
+func blueGreenNamespace(c *cli.Context, objects []*manifestObject) string {
+	if deployment := findDeployment(objects, c.String("blue-green")); deployment != nil && deployment.namespace() != "" {
+		return deployment.namespace()
+	}
+	return c.String("namespace")
+}
+
+// blueGreenServices returns the Services listed in blue-green-services, or named as the Deployment,
+// as rendered if they are in the manifests
+func blueGreenServices(c *cli.Context, objects []*manifestObject) []*manifestObject {
+	namespace := blueGreenNamespace(c, objects)
+	names := c.StringSlice("blue-green-services")
+	if len(names) == 0 {
+		names = []string{c.String("blue-green")}
+	}
+
+	services := []*manifestObject{}
+	for _, name := range names {
+		var service *manifestObject
+		for _, o := range objects {
+			if o.kind() == "Service" && o.name() == name {
+				service = o
+				break
+			}
+		}
+		if service == nil {
+			service = objectReference("v1", "Service", name, namespace)
+		}
+		services = append(services, service)
+	}
+
+	return services
+}
+
+// activeColor returns the color selected by the live Services, empty if they select none
+func activeColor(services []*manifestObject, client clusterClient) (string, error) {
+	active := ""
+	for i, service := range services {
+		live, found, err := client.get(service)
+		if err != nil {
+			return "", fmt.Errorf("Error getting %s: %s\n", service, err)
+		}
+
+		color := ""
+		if found {
+			if v, ok := nestedField(live, "spec", "selector", colorLabel); ok {
+				color, _ = v.(string)
+			}
+		}
+
+		// The Services are all switched by the next flip
+		if i > 0 && color != active {
+			log("Warning: %s selects color %q, %s selects %q\n", service, color, services[0], active)
+			continue
+		}
+		active = color
+	}
+
+	return active, nil
+}
+
+// newBlueGreen renames the Deployment named by the blue-green param, if set, to the color its Services
+// do not select, and keeps the rendered Services on the active color until the flip
+func newBlueGreen(c *cli.Context, objects []*manifestObject, client clusterClient) (*blueGreenDeployment, error) {
+	name := c.String("blue-green")
+	if name == "" {
+		return nil, nil
+	}
+
+	deployment := findDeployment(objects, name)
+	if deployment == nil {
+		return nil, fmt.Errorf("Error: blue-green: Deployment %s not found in the manifests\n", name)
+	}
+
+	bg := &blueGreenDeployment{
+		name:       name,
+		namespace:  blueGreenNamespace(c, objects),
+		deployment: deployment,
+		services:   blueGreenServices(c, objects),
+	}
+
+	var err error
+	if bg.active, err = activeColor(bg.services, client); err != nil {
+		return nil, err
+	}
+	bg.color = otherColor(bg.active)
+
+	// The Deployment deployed before it was blue-green is not scaled down, the Services not switched
+	// between the colors still select its pods
+	if bg.active == "" {
+		legacy := objectReference("apps/v1", "Deployment", name, bg.namespace)
+		if _, found, err := client.get(legacy); err != nil {
+			return nil, fmt.Errorf("Error getting %s: %s\n", legacy, err)
+		} else if found {
+			log("Warning: %s still runs, the Services which do not select a color still send traffic to its pods; delete it once %s rolled out\n", legacy, colorName(name, bg.color))
+		}
+	}
+
+	metadata, _ := ensureNestedMap(deployment.object, "metadata")
+	metadata["name"] = colorName(name, bg.color)
+	for _, fields := range [][]string{{"metadata", "labels"}, {"spec", "selector", "matchLabels"}, {"spec", "template", "metadata", "labels"}} {
+		labels, ok := ensureNestedMap(deployment.object, fields...)
+		if !ok {
+			return nil, fmt.Errorf("Error: %s: %s is not a map\n", deployment.location(), strings.Join(fields, "."))
+		}
+		labels[colorLabel] = bg.color
+	}
+
+	// Applying the Services must not switch them before the rollout
+	if bg.active != "" {
+		for _, service := range bg.services {
+			if service.file == "" {
+				continue
+			}
+			selector, ok := ensureNestedMap(service.object, "spec", "selector")
+			if !ok {
+				return nil, fmt.Errorf("Error: %s: spec.selector is not a map\n", service.location())
+			}
+			selector[colorLabel] = bg.active
+		}
+	}
+
+	if bg.active == "" {
+		log("Deploying %s as %s, no Service selects a color yet\n", name, deployment.name())
+	} else {
+		log("Deploying %s as %s, replacing %s\n", name, deployment.name(), colorName(name, bg.active))
+	}
+
+	return bg, nil
+}
+
+// rolloutWaits replaces the wait for the rollout of the Deployment, if listed in wait-deployments,
+// with the wait for its color
+func (bg *blueGreenDeployment) rolloutWaits(c *cli.Context, waits []resourceWait) []resourceWait {
+	result := []resourceWait{{
+		resource:  "deployment/" + bg.deployment.name(),
+		namespace: bg.namespace,
+		timeout:   time.Duration(c.Int("wait-seconds")) * time.Second,
+	}}
+	for _, w := range waits {
+		if w.resource == "deployment/"+bg.name || w.resource == result[0].resource {
+			continue
+		}
+		result = append(result, w)
+	}
+
+	return result
+}
+
+// flip switches the Services to the pods of a color, or to the pods of any color if empty
+func flip(services []*manifestObject, color string, client clusterClient) error {
+	var selected interface{}
+	if color != "" {
+		selected = color
+	}
+
+	for _, service := range services {
+		if color == "" {
+			log("Switching %s back to the pods of any color\n", service)
+		} else {
+			log("Switching %s to the %s pods\n", service, color)
+		}
+
+		patch := map[string]interface{}{"spec": map[string]interface{}{"selector": map[string]interface{}{colorLabel: selected}}}
+		if err := client.patch(service, patch); err != nil {
+			return fmt.Errorf("Error switching %s: %s\n", service, err)
+		}
+	}
+
+	return nil
+}
+
+// promote switches the Services to the color deployed
+func (bg *blueGreenDeployment) promote(client clusterClient) error {
+	return flip(bg.services, bg.color, client)
+}
+
+// revert switches the Services back to the color they selected before the deploy
+func (bg *blueGreenDeployment) revert(client clusterClient) error {
+	return flip(bg.services, bg.active, client)
+}
+
+// retire scales the Deployment of the previous color to zero once blue-green-grace-seconds elapsed,
+// keeping it scaled if negative or if the build is cancelled during the grace period
+func (bg *blueGreenDeployment) retire(c *cli.Context, client clusterClient) error {
+	if bg.active == "" {
+		return nil
+	}
+
+	previous := objectReference("apps/v1", "Deployment", colorName(bg.name, bg.active), bg.namespace)
+
+	grace := c.Int("blue-green-grace-seconds")
+	if grace < 0 {
+		log("Keeping %s scaled, to flip back to\n", previous)
+		return nil
+	}
+	if grace > 0 {
+		log("Keeping %s scaled for %d seconds before scaling it to zero\n", previous, grace)
+		if err := sleepContext(c.Context, time.Duration(grace)*time.Second); err != nil {
+			log("Warning: keeping %s scaled, the build was cancelled\n", previous)
+			return nil
+		}
+	}
+
+	log("Scaling %s to zero\n", previous)
+	if err := client.patch(previous, map[string]interface{}{"spec": map[string]interface{}{"replicas": 0}}); err != nil {
+		return fmt.Errorf("Error scaling %s: %s\n", previous, err)
+	}
+
+	return nil
+}
+
+// flipBack is the flip-back command. It switches the Services of the blue-green Deployment back to
+// the color they do not select, scaling it up first if it was scaled to zero.
+func flipBack(c *cli.Context) error {
+	if err := checkParams(c); err != nil {
+		return err
+	}
+
+	name := c.String("blue-green")
+	if name == "" {
+		return fmt.Errorf("Missing required param: blue-green")
+	}
+
+	defer removeCredentials()
+	client, err := connectCluster(c)
+	if err != nil {
+		return err
+	}
+
+	// Release the lock even once the build is cancelled
+	cleanupClient := client.withContext(context.WithoutCancel(c.Context))
+
+	if lock := newDeployLock(c); lock != nil {
+		if err := lock.acquire(c.Context, client); err != nil {
+			return err
+		}
+		defer func() {
+			if err := lock.release(cleanupClient); err != nil {
+				log("Warning: %s\n", err)
+			}
+		}()
+	}
+
+	return flipBackWith(c, client)
+}
+
+// flipBackWith flips the Services back through client
+func flipBackWith(c *cli.Context, client clusterClient) error {
+	name := c.String("blue-green")
+	namespace := blueGreenNamespace(c, nil)
+	services := blueGreenServices(c, nil)
+
+	active, err := activeColor(services, client)
+	if err != nil {
+		return err
+	}
+	if active == "" {
+		return fmt.Errorf("Error: %s selects no color, there is nothing to flip back to\n", services[0])
+	}
+
+	current := objectReference("apps/v1", "Deployment", colorName(name, active), namespace)
+	previous := objectReference("apps/v1", "Deployment", colorName(name, otherColor(active)), namespace)
+
+	live, found, err := client.get(previous)
+	if err != nil {
+		return fmt.Errorf("Error getting %s: %s\n", previous, err)
+	}
+	if !found {
+		return fmt.Errorf("Error: %s not found, there is nothing to flip back to\n", previous)
+	}
+
+	// Scale the previous color as the current one
+	if replicas(live) == 0 {
+		live, found, err := client.get(current)
+		if err != nil {
+			return fmt.Errorf("Error getting %s: %s\n", current, err)
+		}
+		scale := int64(1)
+		if found && replicas(live) > 0 {
+			scale = replicas(live)
+		}
+
+		log("Scaling %s to %d replicas\n", previous, scale)
+		if err := client.patch(previous, map[string]interface{}{"spec": map[string]interface{}{"replicas": scale}}); err != nil {
+			return fmt.Errorf("Error scaling %s: %s\n", previous, err)
+		}
+	}
+
+	log("Waiting for %s to roll out\n", previous)
+	timeout := time.Duration(c.Int("wait-seconds")) * time.Second
+	if err := client.waitForRollout(objectRef(previous), namespace, timeout); err != nil {
+		return fmt.Errorf("Error: %s\n", err)
+	}
+
+	return flip(services, otherColor(active), client)
+}
+
+// replicas returns spec.replicas of a live object, 1 if not set
+func replicas(live map[string]interface{}) int64 {
+	if n, ok := nestedInt(live, "spec", "replicas"); ok {
+		return n
+	}
+	return 1
+}
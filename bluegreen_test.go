@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func testBlueGreenObjects() []*manifestObject {
+	return []*manifestObject{
+		{file: "/path/to/kube-template", index: 1, object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Service",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": "test-ns"},
+			"spec":       map[string]interface{}{"selector": map[string]interface{}{"app": "app"}},
+		}},
+		{file: "/path/to/kube-template", index: 2, object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": "test-ns"},
+			"spec": map[string]interface{}{
+				"replicas": 3,
+				"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "app"}},
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "app"}},
+				},
+			},
+		}},
+	}
+}
+
+func TestNewBlueGreen(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("namespace", "test-ns", "")
+	set.String("blue-green", "app", "")
+	set.Int("wait-seconds", 60, "")
+	(&cli.StringSliceFlag{Name: "wait-deployments", Value: cli.NewStringSlice("app", "worker")}).Apply(set)
+	c := cli.NewContext(nil, set, nil)
+
+	// The Service selects the blue pods
+	objects := testBlueGreenObjects()
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "service/app", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return(`{"spec": {"selector": {"app": "app", "drone-gke.nytimes.com/color": "blue"}}}`, nil)
+	bg, err := newBlueGreen(c, objects, &kubectlClient{runner: testRunner})
+	assert.NoError(t, err)
+	assert.Equal(t, colorBlue, bg.active)
+	assert.Equal(t, colorGreen, bg.color)
+
+	assert.Equal(t, "app-green", objects[1].name())
+	for _, fields := range [][]string{{"metadata", "labels"}, {"spec", "selector", "matchLabels"}, {"spec", "template", "metadata", "labels"}} {
+		labels, _ := nestedField(objects[1].object, fields...)
+		assert.Equal(t, colorGreen, labels.(map[string]interface{})[colorLabel], fields)
+	}
+	selector, _ := nestedField(objects[0].object, "spec", "selector")
+	assert.Equal(t, map[string]interface{}{"app": "app", colorLabel: colorBlue}, selector)
+
+	assert.Equal(t, []resourceWait{
+		{resource: "deployment/app-green", namespace: "test-ns", timeout: 60 * time.Second},
+		{resource: "deployment/worker", namespace: "test-ns", timeout: 60 * time.Second},
+	}, bg.rolloutWaits(c, rolloutWaits(c)))
+
+	// No Service selects a color yet
+	objects = testBlueGreenObjects()
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "service/app", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return("", nil)
+	testRunner.On("Output", []string{"kubectl", "get", "deployment/app", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return(`{"metadata": {"name": "app"}}`, nil).Once()
+	bg, err = newBlueGreen(c, objects, &kubectlClient{runner: testRunner})
+	assert.NoError(t, err)
+	testRunner.AssertExpectations(t)
+	assert.Equal(t, "", bg.active)
+	assert.Equal(t, "app-blue", objects[1].name())
+	selector, _ = nestedField(objects[0].object, "spec", "selector")
+	assert.Equal(t, map[string]interface{}{"app": "app"}, selector)
+
+	set.Set("blue-green", "web")
+	_, err = newBlueGreen(c, objects, &kubectlClient{runner: testRunner})
+	assert.EqualError(t, err, "Error: blue-green: Deployment web not found in the manifests\n")
+}
+
+func TestBlueGreenNamespace(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("namespace", "", "")
+	set.String("blue-green", "app", "")
+	c := cli.NewContext(nil, set, nil)
+
+	// The namespace of the rendered Deployment, for its Services and its colors alike
+	assert.Equal(t, "test-ns", blueGreenNamespace(c, testBlueGreenObjects()))
+	assert.Equal(t, "test-ns", blueGreenServices(c, testBlueGreenObjects()[1:])[0].namespace())
+
+	set.Set("namespace", "other-ns")
+	assert.Equal(t, "other-ns", blueGreenNamespace(c, nil))
+}
+
+func TestBlueGreenPromote(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.Int("blue-green-grace-seconds", 0, "")
+	c := cli.NewContext(nil, set, nil)
+
+	objects := testBlueGreenObjects()
+	bg := &blueGreenDeployment{name: "app", namespace: "test-ns", deployment: objects[1], services: objects[:1], active: colorBlue, color: colorGreen}
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "patch", "service/app", "--type=merge", `--patch={"spec":{"selector":{"drone-gke.nytimes.com/color":"green"}}}`, "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "patch", "service/app", "--type=merge", `--patch={"spec":{"selector":{"drone-gke.nytimes.com/color":"blue"}}}`, "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "patch", "deployment/app-blue", "--type=merge", `--patch={"spec":{"replicas":0}}`, "--namespace", "test-ns"}).Return(nil).Once()
+	client := &kubectlClient{runner: testRunner}
+	assert.NoError(t, bg.promote(client))
+	assert.NoError(t, bg.revert(client))
+	assert.NoError(t, bg.retire(c, client))
+
+	// Kept scaled
+	set.Set("blue-green-grace-seconds", "-1")
+	assert.NoError(t, bg.retire(c, client))
+	testRunner.AssertExpectations(t)
+
+	// Kept scaled once cancelled during the grace period
+	set.Set("blue-green-grace-seconds", "3600")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, bg.retire(cli.NewContext(nil, set, &cli.Context{Context: ctx}), client))
+	testRunner.AssertExpectations(t)
+
+	// Switched back to the pods of any color
+	bg.active = ""
+	testRunner = new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "patch", "service/app", "--type=merge", `--patch={"spec":{"selector":{"drone-gke.nytimes.com/color":null}}}`, "--namespace", "test-ns"}).Return(nil).Once()
+	assert.NoError(t, bg.revert(&kubectlClient{runner: testRunner}))
+	testRunner.AssertExpectations(t)
+}
+
+func TestFlipBack(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("namespace", "test-ns", "")
+	set.String("blue-green", "app", "")
+	set.Int("wait-seconds", 60, "")
+	(&cli.StringSliceFlag{Name: "blue-green-services", Value: cli.NewStringSlice("app", "app-internal")}).Apply(set)
+	c := cli.NewContext(nil, set, nil)
+
+	testRunner := new(MockedRunner)
+	for _, service := range []string{"service/app", "service/app-internal"} {
+		testRunner.On("Output", []string{"kubectl", "get", service, "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return(`{"spec": {"selector": {"app": "app", "drone-gke.nytimes.com/color": "green"}}}`, nil).Once()
+	}
+	testRunner.On("Output", []string{"kubectl", "get", "deployment/app-blue", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return(`{"spec": {"replicas": 0}}`, nil).Once()
+	testRunner.On("Output", []string{"kubectl", "get", "deployment/app-green", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return(`{"spec": {"replicas": 4}}`, nil).Once()
+	testRunner.On("Run", []string{"kubectl", "patch", "deployment/app-blue", "--type=merge", `--patch={"spec":{"replicas":4}}`, "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "rollout", "status", "deployment/app-blue", "--namespace", "test-ns"}).Return(nil).Once()
+	for _, service := range []string{"service/app", "service/app-internal"} {
+		testRunner.On("Run", []string{"kubectl", "patch", service, "--type=merge", `--patch={"spec":{"selector":{"drone-gke.nytimes.com/color":"blue"}}}`, "--namespace", "test-ns"}).Return(nil).Once()
+	}
+
+	assert.NoError(t, flipBackWith(c, &kubectlClient{runner: testRunner}))
+	testRunner.AssertExpectations(t)
+
+	// Nothing to flip back to
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "service/app", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return("", nil)
+	testRunner.On("Output", []string{"kubectl", "get", "service/app-internal", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}).Return("", nil)
+	err := flipBackWith(c, &kubectlClient{runner: testRunner})
+	assert.EqualError(t, err, "Error: Service/app selects no color, there is nothing to flip back to\n")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// canaryLabel tells the canary pods from the pods of the Deployment they are a canary of
+	canaryLabel = annotationPrefix + "canary"
+
+	canarySuffix = "-canary"
+)
+
+// canaryDeployment is the canary of a Deployment, applied and checked before the Deployment itself
+type canaryDeployment struct {
+	deployment *manifestObject
+	object     *manifestObject
+	tests      []*smokeTest
+	testData   map[string]interface{}
+	// applied tells whether the canary may exist in the cluster
+	applied bool
+}
+
+// parseCanaryReplicas parses the canary-replicas param, either a number of replicas, e.g. 2,
+// or a percentage of the replicas of the Deployment, e.g. 10%
+func parseCanaryReplicas(c *cli.Context, replicas int) (int, error) {
+	value := strings.TrimSpace(c.String("canary-replicas"))
+	if value == "" {
+		return 1, nil
+	}
+
+	if strings.HasSuffix(value, "%") {
+		percentage, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || percentage <= 0 || percentage > 100 {
+			return 0, fmt.Errorf("Invalid param canary-replicas: %q must be a percentage between 0 and 100%%", value)
+		}
+		// Round up, a canary has at least one replica
+		return int(math.Max(1, math.Ceil(float64(replicas)*percentage/100))), nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("Invalid param canary-replicas: %q must be a positive number of replicas or a percentage", value)
+	}
+	return n, nil
+}
+
+// newCanary creates the canary of the Deployment named by the canary param, if set
+func newCanary(c *cli.Context, objects []*manifestObject, testData map[string]interface{}) (*canaryDeployment, error) {
+	name := c.String("canary")
+	if name == "" {
+		return nil, nil
+	}
+
+	deployment := findDeployment(objects, name)
+	if deployment == nil {
+		return nil, fmt.Errorf("Error: canary: Deployment %s not found in the manifests\n", name)
+	}
+
+	// Copy the Deployment
+	blob, err := encodeObjects([]*manifestObject{deployment})
+	if err != nil {
+		return nil, err
+	}
+	object := make(map[string]interface{})
+	if err := yaml.Unmarshal(blob, &object); err != nil {
+		return nil, err
+	}
+	cd := &canaryDeployment{
+		deployment: deployment,
+		object:     &manifestObject{file: deployment.file, index: deployment.index, object: object},
+	}
+
+	replicas := 1
+	if r, ok := nestedField(object, "spec", "replicas"); ok {
+		if r, ok := r.(int); ok {
+			replicas = r
+		}
+	}
+	if replicas, err = parseCanaryReplicas(c, replicas); err != nil {
+		return nil, err
+	}
+
+	metadata, _ := ensureNestedMap(object, "metadata")
+	metadata["name"] = name + canarySuffix
+	spec, ok := ensureNestedMap(object, "spec")
+	if !ok {
+		return nil, fmt.Errorf("Error: %s: spec is not a map\n", deployment.location())
+	}
+	spec["replicas"] = replicas
+
+	// The canary also selects its pods by the canary label, so that it does not count the pods of the Deployment.
+	// Its pods keep every label of the Deployment: the selector of the Deployment, which is immutable, still
+	// matches them, and so do its Services, which send them a share of the traffic. The ReplicaSets of the
+	// Deployment do not adopt them, they are owned by the ReplicaSet of the canary.
+	for _, fields := range [][]string{{"metadata", "labels"}, {"spec", "selector", "matchLabels"}, {"spec", "template", "metadata", "labels"}} {
+		labels, ok := ensureNestedMap(object, fields...)
+		if !ok {
+			return nil, fmt.Errorf("Error: %s: %s is not a map\n", deployment.location(), strings.Join(fields, "."))
+		}
+		labels[canaryLabel] = "true"
+	}
+
+	if cd.tests, err = parseSmokeTests(c, "canary-smoke-tests"); err != nil {
+		return nil, err
+	}
+	cd.testData = testData
+
+	return cd, nil
+}
+
+// findDeployment returns the Deployment of the manifests with a name, if any
+func findDeployment(objects []*manifestObject, name string) *manifestObject {
+	for _, o := range objects {
+		if o.kind() == "Deployment" && o.name() == name && o.hook() == "" {
+			return o
+		}
+	}
+	return nil
+}
+
+// deploy applies the canary and waits for its rollout, then runs its smoke tests.
+// The canary is removed if any of it fails.
+func (cd *canaryDeployment) deploy(c *cli.Context, client clusterClient) error {
+	log("Deploying canary %s of %s\n", cd.object, cd.deployment)
+
+	err := cd.apply(c, client)
+	if err == nil {
+		err = runSmokeTests(c.Context, cd.tests, cd.testData)
+	}
+
+	if err != nil {
+		log("Canary %s failed, aborting the deploy\n", cd.object)
+		if removeErr := cd.remove(client); removeErr != nil {
+			return fmt.Errorf("%s%s", err, removeErr)
+		}
+		return err
+	}
+
+	log("Canary %s succeeded, promoting %s\n", cd.object, cd.deployment)
+	return nil
+}
+
+func (cd *canaryDeployment) apply(c *cli.Context, client clusterClient) error {
+	m := phaseManifest{phase: workloadsPhase, objects: []*manifestObject{cd.object}}
+	if cd.object.file == c.String("secret-template") {
+		m.secret = true
+	}
+
+	blob, err := encodeObjects(m.objects)
+	if err != nil {
+		return err
+	}
+
+	m.path = path.Join(templateBasePath, "canary.yml")
+	if m.secret {
+		m.path = path.Join(templateBasePath, "canary.sec.yml")
+	}
+	if err := ioutil.WriteFile(m.path, blob, 0600); err != nil {
+		return fmt.Errorf("Error writing manifest: %s\n", err)
+	}
+
+	cd.applied = true
+	if err := client.apply(m, false); err != nil {
+		return fmt.Errorf("Error: %s\n", err)
+	}
+
+	timeout := time.Duration(c.Int("wait-seconds")) * time.Second
+	if err := client.waitForRollout(objectRef(cd.object), cd.object.namespace(), timeout); err != nil {
+		return fmt.Errorf("Error: canary %s: %s\n", cd.object, err)
+	}
+
+	return nil
+}
+
+// remove deletes the canary if it was applied
+func (cd *canaryDeployment) remove(client clusterClient) error {
+	if !cd.applied {
+		return nil
+	}
+
+	log("Deleting canary %s\n", cd.object)
+
+	if err := client.delete(cd.object); err != nil {
+		return fmt.Errorf("Error deleting canary %s: %s\n", cd.object, err)
+	}
+
+	cd.applied = false
+	return nil
+}
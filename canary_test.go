@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseCanaryReplicas(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("canary-replicas", "", "")
+	c := cli.NewContext(nil, set, nil)
+
+	for _, test := range []struct {
+		value    string
+		replicas int
+		expected int
+	}{
+		{"", 10, 1},
+		{"3", 10, 3},
+		{"10%", 10, 1},
+		{"25%", 10, 3},
+		{"1%", 3, 1},
+		{"100%", 4, 4},
+	} {
+		set.Set("canary-replicas", test.value)
+		replicas, err := parseCanaryReplicas(c, test.replicas)
+		assert.NoError(t, err, test.value)
+		assert.Equal(t, test.expected, replicas, test.value)
+	}
+
+	for _, invalid := range []string{"0", "-1", "two", "0%", "150%", "%"} {
+		set.Set("canary-replicas", invalid)
+		_, err := parseCanaryReplicas(c, 10)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestNewCanary(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("canary", "", "")
+	set.String("canary-replicas", "20%", "")
+	set.String("canary-smoke-tests", `[{"url": "http://app-canary/healthz"}]`, "")
+	c := cli.NewContext(nil, set, nil)
+
+	objects := []*manifestObject{
+		{file: "/path/to/kube-template", index: 1, object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": "test-ns"},
+			"spec": map[string]interface{}{
+				"replicas": 10,
+				"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "app"}},
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "app"}},
+				},
+			},
+		}},
+	}
+
+	// Disabled
+	cd, err := newCanary(c, objects, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, cd)
+
+	set.Set("canary", "app")
+	cd, err = newCanary(c, objects, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, objects[0], cd.deployment)
+	assert.Len(t, cd.tests, 1)
+
+	assert.Equal(t, "app-canary", cd.object.name())
+	assert.Equal(t, "test-ns", cd.object.namespace())
+	replicas, _ := nestedField(cd.object.object, "spec", "replicas")
+	assert.Equal(t, 2, replicas)
+	for _, fields := range [][]string{{"metadata", "labels"}, {"spec", "selector", "matchLabels"}, {"spec", "template", "metadata", "labels"}} {
+		labels, _ := nestedField(cd.object.object, fields...)
+		assert.Equal(t, "true", labels.(map[string]interface{})[canaryLabel], fields)
+	}
+	templateLabels, _ := nestedField(cd.object.object, "spec", "template", "metadata", "labels")
+	assert.Equal(t, "app", templateLabels.(map[string]interface{})["app"])
+
+	// The Deployment itself is left untouched
+	assert.Equal(t, "app", objects[0].name())
+	selector, _ := nestedField(objects[0].object, "spec", "selector", "matchLabels")
+	assert.Equal(t, map[string]interface{}{"app": "app"}, selector)
+
+	set.Set("canary", "web")
+	_, err = newCanary(c, objects, nil)
+	assert.EqualError(t, err, "Error: canary: Deployment web not found in the manifests\n")
+}
+
+func TestCanaryDeploy(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("canary", "app", "")
+	set.Int("wait-seconds", 60, "")
+	c := cli.NewContext(nil, set, nil)
+
+	objects := []*manifestObject{
+		{file: "/path/to/kube-template", index: 1, object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       "Deployment",
+			"metadata":   map[string]interface{}{"name": "app", "namespace": "test-ns"},
+			"spec":       map[string]interface{}{"replicas": 4},
+		}},
+	}
+
+	// Rolled out
+	cd, err := newCanary(c, objects, nil)
+	assert.NoError(t, err)
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/canary.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "rollout", "status", "deployment/app-canary", "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "delete", "deployment/app-canary", "--ignore-not-found", "--wait=true", "--namespace", "test-ns"}).Return(nil).Once()
+	client := &kubectlClient{runner: testRunner, runnerSecret: testRunner}
+	assert.NoError(t, cd.deploy(c, client))
+	assert.NoError(t, cd.remove(client))
+	assert.NoError(t, cd.remove(client))
+	testRunner.AssertExpectations(t)
+
+	// Failed to roll out, removed right away
+	cd, err = newCanary(c, objects, nil)
+	assert.NoError(t, err)
+	testRunner = new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/canary.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "rollout", "status", "deployment/app-canary", "--namespace", "test-ns"}).Return(errors.New("kubectl timed out")).Once()
+	testRunner.On("Run", []string{"kubectl", "delete", "deployment/app-canary", "--ignore-not-found", "--wait=true", "--namespace", "test-ns"}).Return(nil).Once()
+	client = &kubectlClient{runner: testRunner, runnerSecret: testRunner}
+	assert.EqualError(t, cd.deploy(c, client), "Error: canary Deployment/app-canary: kubectl timed out\n")
+	assert.NoError(t, cd.remove(client))
+	testRunner.AssertExpectations(t)
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	backendKubectl  = "kubectl"
+	backendClientGo = "client-go"
+
+	// crdEstablishedTimeout bounds the wait for applied CustomResourceDefinitions to be served
+	crdEstablishedTimeout = 60 * time.Second
+	// defaultWaitTimeout is the timeout of kubectl wait, used when waiting for jobs or conditions without a timeout
+	defaultWaitTimeout = 30 * time.Second
+	// kubectlPollInterval is the interval between the kubectl get of a polled resource
+	kubectlPollInterval = 5 * time.Second
+)
+
+// clusterClient applies objects to the cluster and waits for them
+type clusterClient interface {
+	// apply applies the objects of a manifest, only validating them if dryRun is set
+	apply(m phaseManifest, dryRun bool) error
+	// get fetches the live object of an object, if it exists
+	get(o *manifestObject) (map[string]interface{}, bool, error)
+	// delete deletes the live object of an object, if it exists, and waits until it is gone
+	delete(o *manifestObject) error
+	// patch merges patch into the live object of an object, as a JSON merge patch
+	patch(o *manifestObject, patch map[string]interface{}) error
+	// list fetches the live objects of a kind in a namespace matching a label selector
+	list(apiVersion, kind, namespace, selector string) ([]map[string]interface{}, error)
+	// create creates an object, failing if it exists
+	create(o *manifestObject) error
+	// update replaces the live object of an object, failing if it changed since its metadata.resourceVersion
+	update(o *manifestObject) error
+	// waitForCRDs waits until CustomResourceDefinitions are established
+	waitForCRDs(crds []*manifestObject) error
+	// waitForRollout waits until the rollout of a workload, e.g. deployment/app, completes.
+	// A zero timeout waits forever.
+	waitForRollout(resource, namespace string, timeout time.Duration) error
+	// waitForJob waits until a job, e.g. job/migrate, completes.
+	// A zero timeout waits for defaultWaitTimeout.
+	waitForJob(job, namespace string, timeout time.Duration) error
+	// waitForCondition waits until a condition is met by a resource, e.g. certificate/app.
+	// A zero timeout waits for defaultWaitTimeout.
+	waitForCondition(resource, namespace string, condition waitCondition, timeout time.Duration) error
+	// waitForAddress waits until the load balancer of a Service or Ingress, e.g. service/app, has an address
+	// and returns its IPs and hostnames. A zero timeout waits for defaultWaitTimeout.
+	waitForAddress(resource, namespace string, timeout time.Duration) ([]string, error)
+	// rollback rolls back a workload, e.g. deployment/app, to its previous revision
+	rollback(resource, namespace string) error
+	// withOutput returns a client writing the progress of its waits to w
+	withOutput(w io.Writer) clusterClient
+	// quiet returns a client printing neither its commands nor the progress of its waits
+	quiet() clusterClient
+	// withContext returns a client whose commands and requests are cancelled once ctx is done
+	withContext(ctx context.Context) clusterClient
+}
+
+// outputRedirector is implemented by the runners whose output can be redirected
+type outputRedirector interface {
+	WithOutput(stdout, stderr io.Writer) Runner
+}
+
+// quietRunner is implemented by the runners which can stop printing the programs they run
+type quietRunner interface {
+	Quiet() Runner
+}
+
+// kubectlClient is the clusterClient running kubectl
+type kubectlClient struct {
+	runner Runner
+	// runner for the secret manifests, its output is redacted
+	runnerSecret Runner
+	serverSide   bool
+	// out receives the progress of the waits
+	out      io.Writer
+	interval time.Duration
+	// ctx cancels the commands, the background context if nil
+	ctx context.Context
+}
+
+// newClusterClient creates the clusterClient of the configured backend
+func newClusterClient(c *cli.Context, runner, runnerSecret Runner) (clusterClient, error) {
+	if c.String("backend") == backendClientGo {
+		client, err := newNativeClientFromKubeconfig()
+		if err != nil {
+			return nil, err
+		}
+		client.ctx = c.Context
+		return client, nil
+	}
+
+	return &kubectlClient{
+		runner:       runner,
+		runnerSecret: runnerSecret,
+		serverSide:   c.Bool("server-side"),
+		out:          logStdout(),
+		interval:     kubectlPollInterval,
+		ctx:          c.Context,
+	}, nil
+}
+
+// validateBackend validates the backend param
+func validateBackend(c *cli.Context) error {
+	switch c.String("backend") {
+	case "", backendKubectl, backendClientGo:
+		return nil
+	}
+	return fmt.Errorf("Invalid param backend: must be one of %s, %s", backendKubectl, backendClientGo)
+}
+
+func (k *kubectlClient) apply(m phaseManifest, dryRun bool) error {
+	args := applyArgs(dryRun, k.serverSide, m.path)
+	if m.secret {
+		return k.runnerSecret.Run(k.context(), kubectlCmd, args...)
+	}
+	return k.runner.Run(k.context(), kubectlCmd, args...)
+}
+
+func (k *kubectlClient) get(o *manifestObject) (map[string]interface{}, bool, error) {
+	var live map[string]interface{}
+	args := append([]string{"get", objectRef(o), "--ignore-not-found", "-o=json"}, namespaceArgs(o)...)
+
+	found, err := k.getJSON(args, &live)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return live, found, nil
+}
+
+// getJSON runs kubectl get with args and decodes its output into v, if any
+func (k *kubectlClient) getJSON(args []string, v interface{}) (bool, error) {
+	result, err := k.runner.Output(k.context(), kubectlCmd, args...)
+	if err != nil {
+		return false, err
+	}
+
+	data := result.Stdout
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (k *kubectlClient) list(apiVersion, kind, namespace, selector string) ([]map[string]interface{}, error) {
+	resource := strings.ToLower(kind)
+	if gv := strings.SplitN(apiVersion, "/", 2); len(gv) == 2 {
+		// e.g. leases.v1.coordination.k8s.io
+		resource = fmt.Sprintf("%s.%s.%s", resource, gv[1], gv[0])
+	}
+
+	var list struct {
+		Items []map[string]interface{} `json:"items"`
+	}
+	args := append([]string{"get", resource, "--selector=" + selector, "-o=json"}, namespaceFlag(namespace)...)
+	if _, err := k.getJSON(args, &list); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+func (k *kubectlClient) delete(o *manifestObject) error {
+	args := append([]string{"delete", objectRef(o), "--ignore-not-found", "--wait=true"}, namespaceArgs(o)...)
+	return k.runner.Run(k.context(), kubectlCmd, args...)
+}
+
+func (k *kubectlClient) patch(o *manifestObject, patch map[string]interface{}) error {
+	blob, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"patch", objectRef(o), "--type=merge", "--patch=" + string(blob)}, namespaceArgs(o)...)
+	return k.runner.Run(k.context(), kubectlCmd, args...)
+}
+
+func (k *kubectlClient) create(o *manifestObject) error {
+	return k.write("create", o)
+}
+
+func (k *kubectlClient) update(o *manifestObject) error {
+	return k.write("replace", o)
+}
+
+// write writes an object to a manifest and runs kubectl create or replace with it
+func (k *kubectlClient) write(verb string, o *manifestObject) error {
+	blob, err := encodeObjects([]*manifestObject{o})
+	if err != nil {
+		return err
+	}
+
+	manifestPath := path.Join(templateBasePath, fmt.Sprintf("%s-%s.yml", strings.ToLower(o.kind()), o.name()))
+	if err := ioutil.WriteFile(manifestPath, blob, 0600); err != nil {
+		return fmt.Errorf("writing manifest: %s", err)
+	}
+
+	return k.runner.Run(k.context(), kubectlCmd, verb, "--filename", manifestPath)
+}
+
+func (k *kubectlClient) waitForCRDs(crds []*manifestObject) error {
+	args := []string{"wait", "--for=condition=Established", fmt.Sprintf("--timeout=%ds", int(crdEstablishedTimeout.Seconds()))}
+	for _, o := range crds {
+		args = append(args, objectRef(o))
+	}
+	return k.runner.Run(k.context(), kubectlCmd, args...)
+}
+
+func (k *kubectlClient) waitForRollout(resource, namespace string, timeout time.Duration) error {
+	command := []string{"rollout", "status", resource}
+
+	if namespace != "" {
+		command = append(command, "--namespace", namespace)
+	}
+
+	ctx := k.context()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	return k.runner.Run(ctx, kubectlCmd, command...)
+}
+
+// waitForJob polls the job rather than running kubectl wait, which cannot tell a failed job from one still running
+func (k *kubectlClient) waitForJob(job, namespace string, timeout time.Duration) error {
+	args := append([]string{"get", job, "-o=json"}, namespaceFlag(namespace)...)
+
+	return k.poll(job, timeout, func() (bool, error) {
+		var j batchv1.Job
+		if _, err := k.getJSON(args, &j); err != nil {
+			return false, err
+		}
+
+		complete, failure := jobStatus(&j)
+		if complete {
+			fmt.Fprintf(k.stdout(), "%s condition met\n", job)
+			return true, nil
+		}
+
+		if failure != "" {
+			k.printJobFailure(j.Name, namespace)
+			return false, fmt.Errorf("%s failed: %s", job, failure)
+		}
+
+		return false, nil
+	})
+}
+
+func (k *kubectlClient) waitForAddress(resource, namespace string, timeout time.Duration) ([]string, error) {
+	args := append([]string{"get", resource, "-o=json"}, namespaceFlag(namespace)...)
+
+	var addresses []string
+	err := k.poll(resource, timeout, func() (bool, error) {
+		var live map[string]interface{}
+		if _, err := k.getJSON(args, &live); err != nil {
+			return false, err
+		}
+
+		addresses = loadBalancerAddresses(live)
+		return len(addresses) > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(k.stdout(), "%s has address %s\n", resource, strings.Join(addresses, ", "))
+	return addresses, nil
+}
+
+func (k *kubectlClient) rollback(resource, namespace string) error {
+	args := append([]string{"rollout", "undo", resource}, namespaceFlag(namespace)...)
+	return k.runner.Run(k.context(), kubectlCmd, args...)
+}
+
+// poll calls condition every interval until it is done or fails, for at most timeout,
+// or defaultWaitTimeout if zero
+func (k *kubectlClient) poll(resource string, timeout time.Duration, condition func() (bool, error)) error {
+	if timeout == 0 {
+		timeout = defaultWaitTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		done, err := condition()
+		if done || err != nil {
+			return err
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out waiting for %s", resource)
+		}
+
+		if err := sleepContext(k.context(), k.interval); err != nil {
+			return fmt.Errorf("cancelled waiting for %s", resource)
+		}
+	}
+}
+
+// printJobFailure prints the exit codes and logs of the failed pods of a job
+func (k *kubectlClient) printJobFailure(job, namespace string) {
+	var pods corev1.PodList
+	args := append([]string{"get", "pods", "--selector=" + jobPodSelector(job), "-o=json"}, namespaceFlag(namespace)...)
+	if _, err := k.getJSON(args, &pods); err != nil {
+		fmt.Fprintf(k.stdout(), "Warning: could not list the pods of job/%s: %s\n", job, err)
+		return
+	}
+
+	for _, pod := range failedPods(pods.Items) {
+		for _, exit := range podExits(pod) {
+			fmt.Fprintln(k.stdout(), exit)
+		}
+
+		args := append([]string{"logs", "pod/" + pod.Name, "--all-containers", fmt.Sprintf("--tail=%d", failedPodLogLines)}, namespaceFlag(namespace)...)
+		if err := k.runner.Run(k.context(), kubectlCmd, args...); err != nil {
+			fmt.Fprintf(k.stdout(), "Warning: could not print the logs of pod/%s: %s\n", pod.Name, err)
+		}
+	}
+}
+
+func (k *kubectlClient) waitForCondition(resource, namespace string, condition waitCondition, timeout time.Duration) error {
+	command := []string{"wait", "--for=" + condition.kubectlArg(), resource}
+
+	if timeout != 0 {
+		command = append(command, fmt.Sprintf("--timeout=%ds", int(timeout.Seconds())))
+	}
+
+	if namespace != "" {
+		command = append(command, "--namespace", namespace)
+	}
+
+	return k.runner.Run(k.context(), kubectlCmd, command...)
+}
+
+// context returns the context of the commands
+func (k *kubectlClient) context() context.Context {
+	if k.ctx == nil {
+		return context.Background()
+	}
+	return k.ctx
+}
+
+func (k *kubectlClient) withContext(ctx context.Context) clusterClient {
+	client := *k
+	client.ctx = ctx
+	return &client
+}
+
+func (k *kubectlClient) withOutput(w io.Writer) clusterClient {
+	client := *k
+	client.out = w
+	if r, ok := k.runner.(outputRedirector); ok {
+		client.runner = r.WithOutput(w, w)
+	}
+	return &client
+}
+
+func (k *kubectlClient) quiet() clusterClient {
+	client := k.withOutput(ioutil.Discard).(*kubectlClient)
+	if r, ok := client.runner.(quietRunner); ok {
+		client.runner = r.Quiet()
+	}
+	if r, ok := client.runnerSecret.(quietRunner); ok {
+		client.runnerSecret = r.Quiet()
+	}
+	return client
+}
+
+func (k *kubectlClient) stdout() io.Writer {
+	if k.out == nil {
+		return logStdout()
+	}
+	return k.out
+}
+
+// loadBalancerAddresses returns the IPs and hostnames of the load balancer of a Service or Ingress
+func loadBalancerAddresses(object map[string]interface{}) []string {
+	addresses := []string{}
+
+	field, _ := nestedField(object, "status", "loadBalancer", "ingress")
+	ingresses, _ := field.([]interface{})
+	for _, ingress := range ingresses {
+		ingress, ok := ingress.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for _, key := range []string{"ip", "hostname"} {
+			if address, ok := ingress[key].(string); ok && address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses
+}
+
+// objectRef refers to an object as kubectl expects it, e.g. job/migrate
+func objectRef(o *manifestObject) string {
+	return strings.ToLower(o.kind()) + "/" + o.name()
+}
+
+// namespaceFlag returns the kubectl args selecting a namespace, if set
+func namespaceFlag(namespace string) []string {
+	if namespace == "" {
+		return []string{}
+	}
+	return []string{"--namespace", namespace}
+}
+
+// namespaceArgs returns the kubectl args selecting the namespace of an object, if set
+func namespaceArgs(o *manifestObject) []string {
+	return namespaceFlag(o.namespace())
+}
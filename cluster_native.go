@@ -0,0 +1,802 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sschema "k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+const (
+	// fieldManager owns the fields applied by the plugin with server-side apply
+	fieldManager = "drone-gke"
+
+	nativePollInterval  = 2 * time.Second
+	nativeDeleteTimeout = 5 * time.Minute
+)
+
+var crdResource = k8sschema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// nativeClient is the clusterClient calling the Kubernetes API with client-go.
+// Objects are always applied server-side.
+type nativeClient struct {
+	clientset kubernetes.Interface
+	dynamic   dynamic.Interface
+	mapper    meta.ResettableRESTMapper
+	// shortcuts resolves the resources as given to kubectl, e.g. deploy or certificates.cert-manager.io
+	shortcuts meta.RESTMapper
+	// namespace of the objects without one, from the kubeconfig context
+	namespace string
+	interval  time.Duration
+	// out receives the progress of the waits
+	out io.Writer
+	// ctx cancels the requests, the background context if nil
+	ctx context.Context
+}
+
+// newNativeClientFromKubeconfig creates a nativeClient for the current context of the kubeconfig,
+// as configured by gcloud and kubectl
+func newNativeClientFromKubeconfig() (*nativeClient, error) {
+	loader := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+
+	config, err := loader.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading kubeconfig: %s\n", err)
+	}
+
+	namespace, _, err := loader.Namespace()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading kubeconfig: %s\n", err)
+	}
+
+	return newNativeClient(config, namespace)
+}
+
+// newNativeClient creates a nativeClient for an API server
+func newNativeClient(config *rest.Config, namespace string) (*nativeClient, error) {
+	config = rest.CopyConfig(config)
+	config.UserAgent = fmt.Sprintf("drone-gke/%s", version)
+	// The client-side rate limits of kubectl, polling would otherwise exhaust the client-go defaults
+	config.QPS = 50
+	config.Burst = 300
+	// Trace the API requests, as the commands of the kubectl backend
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper { return &tracedTransport{next: rt} })
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the Kubernetes client: %s\n", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the Kubernetes client: %s\n", err)
+	}
+
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating the Kubernetes client: %s\n", err)
+	}
+
+	cachedDiscovery := memory.NewMemCacheClient(discoveryClient)
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(cachedDiscovery)
+
+	return &nativeClient{
+		clientset: clientset,
+		dynamic:   dynamicClient,
+		mapper:    mapper,
+		shortcuts: restmapper.NewShortcutExpander(mapper, cachedDiscovery, func(string) {}),
+		namespace: namespace,
+		interval:  nativePollInterval,
+		out:       logStdout(),
+	}, nil
+}
+
+// resource returns the dynamic client of the resource of an object
+func (n *nativeClient) resource(o *manifestObject) (dynamic.ResourceInterface, error) {
+	gv, err := k8sschema.ParseGroupVersion(o.apiVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	mapping, err := n.mapper.RESTMapping(k8sschema.GroupKind{Group: gv.Group, Kind: o.kind()}, gv.Version)
+	if meta.IsNoMatchError(err) {
+		// The kind may have been defined since the API was discovered
+		n.mapper.Reset()
+		mapping, err = n.mapper.RESTMapping(k8sschema.GroupKind{Group: gv.Group, Kind: o.kind()}, gv.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return n.dynamic.Resource(mapping.Resource), nil
+	}
+
+	return n.dynamic.Resource(mapping.Resource).Namespace(n.namespaceOf(o.namespace())), nil
+}
+
+// resourceByName returns the dynamic client of a resource as given to kubectl, e.g. certificate/app,
+// and the name of the object
+func (n *nativeClient) resourceByName(resource, namespace string) (dynamic.ResourceInterface, string, error) {
+	parts := strings.SplitN(resource, "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, "", fmt.Errorf("invalid resource %q, expected <kind>/<name>", resource)
+	}
+
+	_, gr := k8sschema.ParseResourceArg(strings.ToLower(parts[0]))
+
+	gvk, err := n.shortcuts.KindFor(gr.WithVersion(""))
+	if meta.IsNoMatchError(err) {
+		// The kind may have been defined since the API was discovered
+		n.mapper.Reset()
+		gvk, err = n.shortcuts.KindFor(gr.WithVersion(""))
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	mapping, err := n.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return n.dynamic.Resource(mapping.Resource), parts[1], nil
+	}
+
+	return n.dynamic.Resource(mapping.Resource).Namespace(n.namespaceOf(namespace)), parts[1], nil
+}
+
+func (n *nativeClient) namespaceOf(namespace string) string {
+	if namespace != "" {
+		return namespace
+	}
+	if n.namespace != "" {
+		return n.namespace
+	}
+	return metav1.NamespaceDefault
+}
+
+func (n *nativeClient) apply(m phaseManifest, dryRun bool) error {
+	force := true
+	options := metav1.PatchOptions{FieldManager: fieldManager, Force: &force}
+	if dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+
+	for _, o := range m.objects {
+		resource, err := n.resource(o)
+		if err != nil {
+			return fmt.Errorf("applying %s: %s", o, err)
+		}
+
+		data, err := json.Marshal(o.object)
+		if err != nil {
+			return fmt.Errorf("applying %s: %s", o, err)
+		}
+
+		if _, err := resource.Patch(n.context(), o.name(), types.ApplyPatchType, data, options); err != nil {
+			// The API server may echo the values of secrets
+			if m.secret {
+				return fmt.Errorf("applying %s failed", o)
+			}
+			return fmt.Errorf("applying %s: %s", o, err)
+		}
+
+		if dryRun {
+			fmt.Fprintf(n.out, "%s applied (dry run)\n", o)
+		} else {
+			fmt.Fprintf(n.out, "%s applied\n", o)
+		}
+	}
+
+	return nil
+}
+
+func (n *nativeClient) get(o *manifestObject) (map[string]interface{}, bool, error) {
+	resource, err := n.resource(o)
+	if err != nil {
+		return nil, false, err
+	}
+
+	live, err := resource.Get(n.context(), o.name(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return live.Object, true, nil
+}
+
+func (n *nativeClient) list(apiVersion, kind, namespace, selector string) ([]map[string]interface{}, error) {
+	resource, err := n.resource(objectReference(apiVersion, kind, "", namespace))
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := resource.List(n.context(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	items := []map[string]interface{}{}
+	for _, item := range list.Items {
+		items = append(items, item.Object)
+	}
+	return items, nil
+}
+
+func (n *nativeClient) delete(o *manifestObject) error {
+	resource, err := n.resource(o)
+	if err != nil {
+		return err
+	}
+
+	propagation := metav1.DeletePropagationBackground
+	err = resource.Delete(n.context(), o.name(), metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(n.context(), nativeDeleteTimeout)
+	defer cancel()
+
+	err = wait.PollUntilContextCancel(ctx, n.interval, true, func(ctx context.Context) (bool, error) {
+		_, err := resource.Get(ctx, o.name(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for %s to be deleted: %s", o, err)
+	}
+
+	fmt.Fprintf(n.out, "%s deleted\n", o)
+	return nil
+}
+
+func (n *nativeClient) patch(o *manifestObject, patch map[string]interface{}) error {
+	resource, err := n.resource(o)
+	if err != nil {
+		return err
+	}
+
+	blob, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	if _, err := resource.Patch(n.context(), o.name(), types.MergePatchType, blob, metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(n.out, "%s patched\n", o)
+	return nil
+}
+
+func (n *nativeClient) create(o *manifestObject) error {
+	resource, err := n.resource(o)
+	if err != nil {
+		return err
+	}
+
+	if _, err := resource.Create(n.context(), &unstructured.Unstructured{Object: o.object}, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(n.out, "%s created\n", o)
+	return nil
+}
+
+func (n *nativeClient) update(o *manifestObject) error {
+	resource, err := n.resource(o)
+	if err != nil {
+		return err
+	}
+
+	if _, err := resource.Update(n.context(), &unstructured.Unstructured{Object: o.object}, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(n.out, "%s replaced\n", o)
+	return nil
+}
+
+func (n *nativeClient) waitForCRDs(crds []*manifestObject) error {
+	ctx, cancel := context.WithTimeout(n.context(), crdEstablishedTimeout)
+	defer cancel()
+
+	for _, o := range crds {
+		err := wait.PollUntilContextCancel(ctx, n.interval, true, func(ctx context.Context) (bool, error) {
+			crd, err := n.dynamic.Resource(crdResource).Get(ctx, o.name(), metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+
+			conditions, _ := nestedField(crd.Object, "status", "conditions")
+			items, _ := conditions.([]interface{})
+			for _, item := range items {
+				condition, _ := item.(map[string]interface{})
+				if condition["type"] == "Established" && condition["status"] == "True" {
+					return true, nil
+				}
+			}
+			return false, nil
+		})
+		if err != nil {
+			return fmt.Errorf("waiting for %s to be established: %s", o, err)
+		}
+
+		fmt.Fprintf(n.out, "%s established\n", o)
+	}
+
+	// Discover the new kinds
+	n.mapper.Reset()
+	return nil
+}
+
+// context returns the context of the requests
+func (n *nativeClient) context() context.Context {
+	if n.ctx == nil {
+		return context.Background()
+	}
+	return n.ctx
+}
+
+func (n *nativeClient) withContext(ctx context.Context) clusterClient {
+	client := *n
+	client.ctx = ctx
+	return &client
+}
+
+func (n *nativeClient) withOutput(w io.Writer) clusterClient {
+	client := *n
+	client.out = w
+	return &client
+}
+
+func (n *nativeClient) quiet() clusterClient {
+	return n.withOutput(ioutil.Discard)
+}
+
+func (n *nativeClient) waitForRollout(resource, namespace string, timeout time.Duration) error {
+	kind, name := splitResource(resource)
+	namespace = n.namespaceOf(namespace)
+
+	var status func(ctx context.Context) (bool, string, error)
+	switch kind {
+	case "deployment", "deployments", "deploy":
+		status = func(ctx context.Context) (bool, string, error) {
+			d, err := n.clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return false, "", err
+			}
+			return deploymentRolloutStatus(d)
+		}
+	case "statefulset", "statefulsets", "sts":
+		status = func(ctx context.Context) (bool, string, error) {
+			s, err := n.clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return false, "", err
+			}
+			return statefulSetRolloutStatus(s)
+		}
+	case "daemonset", "daemonsets", "ds":
+		status = func(ctx context.Context) (bool, string, error) {
+			d, err := n.clientset.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return false, "", err
+			}
+			return daemonSetRolloutStatus(d)
+		}
+	default:
+		return fmt.Errorf("waiting for the rollout of %s is not supported", resource)
+	}
+
+	// The status is printed as it changes, like kubectl rollout status
+	printed := ""
+	return n.poll(resource, timeout, func(ctx context.Context) (bool, error) {
+		done, message, err := status(ctx)
+		if message != "" && message != printed {
+			fmt.Fprintln(n.out, message)
+			printed = message
+		}
+		return done, err
+	})
+}
+
+func (n *nativeClient) waitForJob(job, namespace string, timeout time.Duration) error {
+	_, name := splitResource(job)
+	namespace = n.namespaceOf(namespace)
+
+	if timeout == 0 {
+		timeout = defaultWaitTimeout
+	}
+
+	return n.poll(job, timeout, func(ctx context.Context) (bool, error) {
+		j, err := n.clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		complete, failure := jobStatus(j)
+		if complete {
+			fmt.Fprintf(n.out, "%s condition met\n", job)
+			return true, nil
+		}
+
+		if failure != "" {
+			n.printJobFailure(ctx, name, namespace)
+			return false, fmt.Errorf("%s failed: %s", job, failure)
+		}
+
+		return false, nil
+	})
+}
+
+// printJobFailure prints the exit codes and logs of the failed pods of a job
+func (n *nativeClient) printJobFailure(ctx context.Context, job, namespace string) {
+	pods, err := n.clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: jobPodSelector(job)})
+	if err != nil {
+		fmt.Fprintf(n.out, "Warning: could not list the pods of job/%s: %s\n", job, err)
+		return
+	}
+
+	tailLines := int64(failedPodLogLines)
+	for _, pod := range failedPods(pods.Items) {
+		for _, exit := range podExits(pod) {
+			fmt.Fprintln(n.out, exit)
+		}
+
+		containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+		for _, container := range containers {
+			fmt.Fprintf(n.out, "Logs of pod/%s container %s:\n", pod.Name, container.Name)
+
+			logs, err := n.clientset.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: container.Name, TailLines: &tailLines}).Stream(ctx)
+			if err != nil {
+				fmt.Fprintf(n.out, "Warning: could not print the logs of pod/%s: %s\n", pod.Name, err)
+				continue
+			}
+			io.Copy(n.out, logs)
+			logs.Close()
+		}
+	}
+}
+
+func (n *nativeClient) waitForCondition(resource, namespace string, condition waitCondition, timeout time.Duration) error {
+	client, name, err := n.resourceByName(resource, namespace)
+	if err != nil {
+		return err
+	}
+
+	if timeout == 0 {
+		timeout = defaultWaitTimeout
+	}
+
+	var path *jsonpath.JSONPath
+	if condition.kind == waitConditionJSONPath {
+		path = jsonpath.New(resource).AllowMissingKeys(true)
+		if err := path.Parse(condition.expression); err != nil {
+			return fmt.Errorf("invalid JSONPath expression %s: %s", condition.expression, err)
+		}
+	}
+
+	return n.poll(resource, timeout, func(ctx context.Context) (bool, error) {
+		live, err := client.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			if condition.kind == waitConditionDeleted {
+				fmt.Fprintf(n.out, "%s deleted\n", resource)
+				return true, nil
+			}
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		met := false
+		switch condition.kind {
+		case waitConditionExists:
+			met = true
+		case waitConditionCondition:
+			met = conditionMet(live.Object, condition)
+		case waitConditionJSONPath:
+			met, err = jsonPathMet(live.Object, path, condition)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if met {
+			fmt.Fprintf(n.out, "%s %s met\n", resource, condition)
+		}
+		return met, nil
+	})
+}
+
+func (n *nativeClient) waitForAddress(resource, namespace string, timeout time.Duration) ([]string, error) {
+	client, name, err := n.resourceByName(resource, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout == 0 {
+		timeout = defaultWaitTimeout
+	}
+
+	var addresses []string
+	err = n.poll(resource, timeout, func(ctx context.Context) (bool, error) {
+		live, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		addresses = loadBalancerAddresses(live.Object)
+		return len(addresses) > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(n.out, "%s has address %s\n", resource, strings.Join(addresses, ", "))
+	return addresses, nil
+}
+
+// rollback rolls back a Deployment to the template of its previous ReplicaSet, as kubectl rollout undo does.
+// StatefulSets and DaemonSets are not supported.
+func (n *nativeClient) rollback(resource, namespace string) error {
+	kind, name := splitResource(resource)
+	switch kind {
+	case "deployment", "deployments", "deploy":
+	default:
+		return fmt.Errorf("rolling back %s is not supported by the client-go backend, only Deployments are; use the kubectl backend", resource)
+	}
+
+	ctx := n.context()
+	namespace = n.namespaceOf(namespace)
+	deployments := n.clientset.AppsV1().Deployments(namespace)
+
+	d, err := deployments.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(d.Spec.Selector)
+	if err != nil {
+		return err
+	}
+
+	replicaSets, err := n.clientset.AppsV1().ReplicaSets(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+
+	current := revision(d.ObjectMeta)
+	var previous *appsv1.ReplicaSet
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+		if !metav1.IsControlledBy(rs, d) || revision(rs.ObjectMeta) >= current {
+			continue
+		}
+		if previous == nil || revision(rs.ObjectMeta) > revision(previous.ObjectMeta) {
+			previous = rs
+		}
+	}
+
+	if previous == nil {
+		return fmt.Errorf("no previous revision of %s found", resource)
+	}
+
+	template := previous.Spec.Template.DeepCopy()
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	d.Spec.Template = *template
+
+	if _, err := deployments.Update(ctx, d, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(n.out, "%s rolled back to revision %d\n", resource, revision(previous.ObjectMeta))
+	return nil
+}
+
+// revision returns the revision of a Deployment or ReplicaSet
+func revision(o metav1.ObjectMeta) int64 {
+	r, _ := strconv.ParseInt(o.Annotations["deployment.kubernetes.io/revision"], 10, 64)
+	return r
+}
+
+// conditionMet tells whether the status of a condition of an object is the expected one
+func conditionMet(object map[string]interface{}, condition waitCondition) bool {
+	expected := condition.value
+	if expected == "" {
+		expected = string(corev1.ConditionTrue)
+	}
+
+	field, _ := nestedField(object, "status", "conditions")
+	conditions, _ := field.([]interface{})
+	for _, c := range conditions {
+		c, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if strings.EqualFold(fmt.Sprint(c["type"]), condition.expression) {
+			return strings.EqualFold(fmt.Sprint(c["status"]), expected)
+		}
+	}
+
+	return false
+}
+
+// jsonPathMet tells whether the JSONPath expression of a condition evaluates to the expected value,
+// or to any non-empty value if none is expected
+func jsonPathMet(object map[string]interface{}, path *jsonpath.JSONPath, condition waitCondition) (bool, error) {
+	results, err := path.FindResults(object)
+	if err != nil {
+		return false, err
+	}
+
+	for _, result := range results {
+		for _, value := range result {
+			if !value.IsValid() || !value.CanInterface() {
+				continue
+			}
+
+			actual := fmt.Sprint(value.Interface())
+			if condition.value == "" && actual != "" || condition.value != "" && actual == condition.value {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// poll calls condition until it is done or fails, for at most timeout if not zero
+func (n *nativeClient) poll(resource string, timeout time.Duration, condition wait.ConditionWithContextFunc) error {
+	ctx := n.context()
+	if timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := wait.PollUntilContextCancel(ctx, n.interval, true, condition)
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("cancelled waiting for %s", resource)
+	}
+	// The request in flight may fail on the deadline before the context is done
+	deadline, ok := ctx.Deadline()
+	if err != nil && (ctx.Err() != nil || ok && !time.Now().Before(deadline)) {
+		return fmt.Errorf("timed out waiting for %s", resource)
+	}
+	return err
+}
+
+// splitResource splits a resource as given to kubectl, e.g. deployment.apps/app, into its kind and name
+func splitResource(resource string) (string, string) {
+	parts := strings.SplitN(resource, "/", 2)
+	if len(parts) == 1 {
+		return "", parts[0]
+	}
+
+	kind := strings.ToLower(parts[0])
+	if i := strings.Index(kind, "."); i >= 0 {
+		kind = kind[:i]
+	}
+	return kind, parts[1]
+}
+
+// deploymentRolloutStatus follows kubectl rollout status
+func deploymentRolloutStatus(d *appsv1.Deployment) (bool, string, error) {
+	if d.Generation > d.Status.ObservedGeneration {
+		return false, "Waiting for deployment spec update to be observed...", nil
+	}
+
+	for _, condition := range d.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, "", fmt.Errorf("deployment %q exceeded its progress deadline", d.Name)
+		}
+	}
+
+	replicas := int32(1)
+	if d.Spec.Replicas != nil {
+		replicas = *d.Spec.Replicas
+	}
+
+	if d.Status.UpdatedReplicas < replicas {
+		return false, fmt.Sprintf("Waiting for deployment %q rollout to finish: %d out of %d new replicas have been updated...", d.Name, d.Status.UpdatedReplicas, replicas), nil
+	}
+	if d.Status.Replicas > d.Status.UpdatedReplicas {
+		return false, fmt.Sprintf("Waiting for deployment %q rollout to finish: %d old replicas are pending termination...", d.Name, d.Status.Replicas-d.Status.UpdatedReplicas), nil
+	}
+	if d.Status.AvailableReplicas < d.Status.UpdatedReplicas {
+		return false, fmt.Sprintf("Waiting for deployment %q rollout to finish: %d of %d updated replicas are available...", d.Name, d.Status.AvailableReplicas, d.Status.UpdatedReplicas), nil
+	}
+
+	return true, fmt.Sprintf("deployment %q successfully rolled out", d.Name), nil
+}
+
+// statefulSetRolloutStatus follows kubectl rollout status
+func statefulSetRolloutStatus(s *appsv1.StatefulSet) (bool, string, error) {
+	if s.Spec.UpdateStrategy.Type != appsv1.RollingUpdateStatefulSetStrategyType {
+		return true, fmt.Sprintf("rollout status is only available for %s strategy type", appsv1.RollingUpdateStatefulSetStrategyType), nil
+	}
+
+	if s.Status.ObservedGeneration == 0 || s.Generation > s.Status.ObservedGeneration {
+		return false, "Waiting for statefulset spec update to be observed...", nil
+	}
+
+	replicas := int32(1)
+	if s.Spec.Replicas != nil {
+		replicas = *s.Spec.Replicas
+	}
+
+	if s.Status.ReadyReplicas < replicas {
+		return false, fmt.Sprintf("Waiting for %d pods to be ready...", replicas-s.Status.ReadyReplicas), nil
+	}
+
+	if s.Spec.UpdateStrategy.RollingUpdate != nil && s.Spec.UpdateStrategy.RollingUpdate.Partition != nil {
+		partition := *s.Spec.UpdateStrategy.RollingUpdate.Partition
+		if s.Status.UpdatedReplicas < replicas-partition {
+			return false, fmt.Sprintf("Waiting for partitioned roll out to finish: %d out of %d new pods have been updated...", s.Status.UpdatedReplicas, replicas-partition), nil
+		}
+		return true, fmt.Sprintf("partitioned roll out complete: %d new pods have been updated...", s.Status.UpdatedReplicas), nil
+	}
+
+	if s.Status.UpdateRevision != s.Status.CurrentRevision {
+		return false, fmt.Sprintf("waiting for statefulset rolling update to complete %d pods at revision %s...", s.Status.UpdatedReplicas, s.Status.UpdateRevision), nil
+	}
+
+	return true, fmt.Sprintf("statefulset rolling update complete %d pods at revision %s...", s.Status.CurrentReplicas, s.Status.CurrentRevision), nil
+}
+
+// daemonSetRolloutStatus follows kubectl rollout status
+func daemonSetRolloutStatus(d *appsv1.DaemonSet) (bool, string, error) {
+	if d.Spec.UpdateStrategy.Type != appsv1.RollingUpdateDaemonSetStrategyType {
+		return true, fmt.Sprintf("rollout status is only available for %s strategy type", appsv1.RollingUpdateDaemonSetStrategyType), nil
+	}
+
+	if d.Generation > d.Status.ObservedGeneration {
+		return false, "Waiting for daemon set spec update to be observed...", nil
+	}
+
+	if d.Status.UpdatedNumberScheduled < d.Status.DesiredNumberScheduled {
+		return false, fmt.Sprintf("Waiting for daemon set %q rollout to finish: %d out of %d new pods have been updated...", d.Name, d.Status.UpdatedNumberScheduled, d.Status.DesiredNumberScheduled), nil
+	}
+	if d.Status.NumberAvailable < d.Status.DesiredNumberScheduled {
+		return false, fmt.Sprintf("Waiting for daemon set %q rollout to finish: %d of %d updated pods are available...", d.Name, d.Status.NumberAvailable, d.Status.DesiredNumberScheduled), nil
+	}
+
+	return true, fmt.Sprintf("daemon set %q successfully rolled out", d.Name), nil
+}
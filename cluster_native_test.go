@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+// fakeAPIServer serves the discovery, apply, get and delete endpoints of a few Kubernetes resources
+type fakeAPIServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// objects by API path, e.g. /apis/apps/v1/namespaces/default/deployments/app
+	objects map[string]map[string]interface{}
+	// requests received, e.g. PATCH /api/v1/namespaces/default/configmaps/app?dryRun=All
+	requests []string
+}
+
+var fakeAPIResources = map[string]string{
+	"/api/v1": `{"kind": "APIResourceList", "groupVersion": "v1", "resources": [
+		{"name": "configmaps", "namespaced": true, "kind": "ConfigMap", "verbs": ["get", "patch", "delete"]},
+		{"name": "namespaces", "namespaced": false, "kind": "Namespace", "verbs": ["get", "patch", "delete"]},
+		{"name": "pods", "namespaced": true, "kind": "Pod", "verbs": ["get", "list"]},
+		{"name": "services", "singularName": "service", "shortNames": ["svc"], "namespaced": true, "kind": "Service", "verbs": ["get", "patch", "delete"]}
+	]}`,
+	"/apis/apps/v1": `{"kind": "APIResourceList", "groupVersion": "apps/v1", "resources": [
+		{"name": "deployments", "namespaced": true, "kind": "Deployment", "verbs": ["get", "patch", "delete"]},
+		{"name": "statefulsets", "namespaced": true, "kind": "StatefulSet", "verbs": ["get", "patch", "delete"]},
+		{"name": "daemonsets", "namespaced": true, "kind": "DaemonSet", "verbs": ["get", "patch", "delete"]},
+		{"name": "replicasets", "namespaced": true, "kind": "ReplicaSet", "verbs": ["get", "list"]}
+	]}`,
+	"/apis/batch/v1": `{"kind": "APIResourceList", "groupVersion": "batch/v1", "resources": [
+		{"name": "jobs", "namespaced": true, "kind": "Job", "verbs": ["get", "patch", "delete"]}
+	]}`,
+	"/apis/coordination.k8s.io/v1": `{"kind": "APIResourceList", "groupVersion": "coordination.k8s.io/v1", "resources": [
+		{"name": "leases", "namespaced": true, "kind": "Lease", "verbs": ["create", "get", "update", "delete"]}
+	]}`,
+	"/apis/cert-manager.io/v1": `{"kind": "APIResourceList", "groupVersion": "cert-manager.io/v1", "resources": [
+		{"name": "certificates", "singularName": "certificate", "shortNames": ["cert"], "namespaced": true, "kind": "Certificate", "verbs": ["get", "patch", "delete"]}
+	]}`,
+	"/apis/apiextensions.k8s.io/v1": `{"kind": "APIResourceList", "groupVersion": "apiextensions.k8s.io/v1", "resources": [
+		{"name": "customresourcedefinitions", "namespaced": false, "kind": "CustomResourceDefinition", "verbs": ["get", "patch", "delete"]}
+	]}`,
+}
+
+func newFakeAPIServer(t *testing.T) *fakeAPIServer {
+	f := &fakeAPIServer{objects: make(map[string]map[string]interface{})}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/api":
+			w.Write([]byte(`{"kind": "APIVersions", "versions": ["v1"]}`))
+			return
+		case r.URL.Path == "/apis":
+			groups := []string{}
+			for _, gv := range []string{"apps/v1", "batch/v1", "apiextensions.k8s.io/v1", "cert-manager.io/v1", "coordination.k8s.io/v1"} {
+				name := strings.Split(gv, "/")[0]
+				groups = append(groups, `{"name": "`+name+`", "versions": [{"groupVersion": "`+gv+`", "version": "v1"}], "preferredVersion": {"groupVersion": "`+gv+`", "version": "v1"}}`)
+			}
+			w.Write([]byte(`{"kind": "APIGroupList", "groups": [` + strings.Join(groups, ",") + `]}`))
+			return
+		case fakeAPIResources[r.URL.Path] != "":
+			w.Write([]byte(fakeAPIResources[r.URL.Path]))
+			return
+		}
+
+		request := r.Method + " " + r.URL.Path
+		if r.URL.RawQuery != "" {
+			request += "?" + r.URL.RawQuery
+		}
+		f.requests = append(f.requests, request)
+
+		switch r.Method {
+		case http.MethodPatch:
+			assert.Equal(t, fieldManager, r.URL.Query().Get("fieldManager"))
+
+			body, _ := ioutil.ReadAll(r.Body)
+			var object map[string]interface{}
+			assert.NoError(t, json.Unmarshal(body, &object))
+
+			if r.Header.Get("Content-Type") == "application/merge-patch+json" {
+				live, ok := f.objects[r.URL.Path]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+					return
+				}
+				mergePatch(live, object)
+				json.NewEncoder(w).Encode(live)
+				return
+			}
+			assert.Equal(t, "application/apply-patch+yaml", r.Header.Get("Content-Type"))
+
+			if r.URL.Query().Get("dryRun") == "" {
+				// Keep the status of the live object
+				if live, ok := f.objects[r.URL.Path]; ok {
+					object["status"] = live["status"]
+				}
+				f.objects[r.URL.Path] = object
+			}
+			json.NewEncoder(w).Encode(object)
+		case http.MethodGet:
+			if strings.HasSuffix(r.URL.Path, "/log") {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("logs of " + strings.Split(r.URL.Path, "/")[6] + " " + r.URL.Query().Get("container") + "\n"))
+				return
+			}
+
+			object, ok := f.objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+				return
+			}
+			json.NewEncoder(w).Encode(object)
+		case http.MethodPost:
+			body, _ := ioutil.ReadAll(r.Body)
+			var object map[string]interface{}
+			assert.NoError(t, json.Unmarshal(body, &object))
+			path := r.URL.Path + "/" + nestedString(object, "metadata", "name")
+			if _, ok := f.objects[path]; ok {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "AlreadyExists", "code": 409}`))
+				return
+			}
+			f.objects[path] = object
+			w.WriteHeader(http.StatusCreated)
+			w.Write(body)
+		case http.MethodPut:
+			body, _ := ioutil.ReadAll(r.Body)
+			var object map[string]interface{}
+			assert.NoError(t, json.Unmarshal(body, &object))
+			f.objects[r.URL.Path] = object
+			w.Write(body)
+		case http.MethodDelete:
+			if _, ok := f.objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "NotFound", "code": 404}`))
+				return
+			}
+			delete(f.objects, r.URL.Path)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Success"}`))
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+
+	return f
+}
+
+// mergePatch merges a JSON merge patch into an object
+func mergePatch(object, patch map[string]interface{}) {
+	for k, v := range patch {
+		switch v := v.(type) {
+		case nil:
+			delete(object, k)
+		case map[string]interface{}:
+			nested, ok := object[k].(map[string]interface{})
+			if !ok {
+				nested = make(map[string]interface{})
+				object[k] = nested
+			}
+			mergePatch(nested, v)
+		default:
+			object[k] = v
+		}
+	}
+}
+
+// set stores an object, as decoded from JSON
+func (f *fakeAPIServer) set(t *testing.T, path, object string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(object), &decoded); err != nil {
+		t.Fatalf("invalid test object: %s", err)
+	}
+	f.objects[path] = decoded
+}
+
+func newTestNativeClient(t *testing.T, f *fakeAPIServer) *nativeClient {
+	client, err := newNativeClient(&rest.Config{Host: f.URL, ContentConfig: rest.ContentConfig{ContentType: "application/json"}}, "test-ns")
+	if err != nil {
+		t.Fatalf("creating the client: %s", err)
+	}
+	client.interval = 10 * time.Millisecond
+	return client
+}
+
+func TestNativeClientApply(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	deployment := testObject(t, testDeployment)
+	namespace := testObject(t, "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: other-ns\n")
+	configMap := testObject(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  namespace: other-ns\ndata:\n  key: value\n")
+	m := phaseManifest{objects: []*manifestObject{namespace, configMap, deployment}}
+
+	// Dry-run
+	assert.NoError(t, client.apply(m, true))
+	assert.Equal(t, []string{
+		"PATCH /api/v1/namespaces/other-ns?dryRun=All&fieldManager=drone-gke&force=true",
+		"PATCH /api/v1/namespaces/other-ns/configmaps/app?dryRun=All&fieldManager=drone-gke&force=true",
+		"PATCH /apis/apps/v1/namespaces/test-ns/deployments/app?dryRun=All&fieldManager=drone-gke&force=true",
+	}, f.requests)
+	assert.Empty(t, f.objects)
+
+	// Apply
+	assert.NoError(t, client.apply(m, false))
+	assert.Equal(t, "value", nestedString(f.objects["/api/v1/namespaces/other-ns/configmaps/app"], "data", "key"))
+	assert.Contains(t, f.objects, "/apis/apps/v1/namespaces/test-ns/deployments/app")
+
+	// Get
+	live, found, err := client.get(configMap)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "value", nestedString(live, "data", "key"))
+
+	// Delete
+	assert.NoError(t, client.delete(configMap))
+	_, found, err = client.get(configMap)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.NoError(t, client.delete(configMap))
+
+	// Unknown kind
+	err = client.apply(phaseManifest{objects: []*manifestObject{testObject(t, "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\n")}}, false)
+	assert.Error(t, err)
+}
+
+func TestNativeClientWaitForCRDs(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	crd := testObject(t, testCRD)
+	f.set(t, "/apis/apiextensions.k8s.io/v1/customresourcedefinitions/widgets.example.com", `{"apiVersion": "apiextensions.k8s.io/v1", "kind": "CustomResourceDefinition", "metadata": {"name": "widgets.example.com"}, "status": {"conditions": [{"type": "Established", "status": "True"}]}}`)
+	assert.NoError(t, client.waitForCRDs([]*manifestObject{crd}))
+}
+
+func TestNativeClientWaitForRollout(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	path := "/apis/apps/v1/namespaces/test-ns/deployments/app"
+
+	// Rolled out
+	f.set(t, path, `{"metadata": {"name": "app", "generation": 2}, "spec": {"replicas": 2}, "status": {"observedGeneration": 2, "replicas": 2, "updatedReplicas": 2, "availableReplicas": 2}}`)
+	assert.NoError(t, client.waitForRollout("deployment/app", "", time.Second))
+	assert.NoError(t, client.waitForRollout("deployments.apps/app", "test-ns", time.Second))
+
+	// Still rolling out, the unchanged status printed once
+	var out bytes.Buffer
+	client.out = &out
+	f.set(t, path, `{"metadata": {"name": "app", "generation": 2}, "spec": {"replicas": 2}, "status": {"observedGeneration": 2, "replicas": 3, "updatedReplicas": 1, "availableReplicas": 2}}`)
+	err := client.waitForRollout("deployment/app", "", 50*time.Millisecond)
+	assert.EqualError(t, err, "timed out waiting for deployment/app")
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"), out.String())
+
+	// Cancelled, e.g. the build was
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	err = client.withContext(ctx).waitForRollout("deployment/app", "", time.Second)
+	assert.EqualError(t, err, "cancelled waiting for deployment/app")
+
+	// Failed
+	f.set(t, path, `{"metadata": {"name": "app", "generation": 2}, "spec": {"replicas": 2}, "status": {"observedGeneration": 2, "conditions": [{"type": "Progressing", "status": "False", "reason": "ProgressDeadlineExceeded"}]}}`)
+	err = client.waitForRollout("deployment/app", "", time.Second)
+	assert.EqualError(t, err, `deployment "app" exceeded its progress deadline`)
+
+	// StatefulSet in another namespace
+	f.set(t, "/apis/apps/v1/namespaces/other-ns/statefulsets/db", `{"metadata": {"name": "db", "generation": 1}, "spec": {"replicas": 1, "updateStrategy": {"type": "RollingUpdate"}}, "status": {"observedGeneration": 1, "readyReplicas": 1, "currentRevision": "db-1", "updateRevision": "db-1"}}`)
+	assert.NoError(t, client.waitForRollout("statefulset/db", "other-ns", time.Second))
+
+	// Not found
+	assert.Error(t, client.waitForRollout("daemonset/missing", "", time.Second))
+
+	// Unsupported
+	assert.Error(t, client.waitForRollout("job/migrate", "", time.Second))
+}
+
+func TestNativeClientWaitForJob(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	path := "/apis/batch/v1/namespaces/test-ns/jobs/migrate"
+
+	f.set(t, path, `{"metadata": {"name": "migrate"}, "status": {"conditions": [{"type": "Complete", "status": "True"}]}}`)
+	assert.NoError(t, client.waitForJob("job/migrate", "", time.Second))
+
+	f.set(t, path, `{"metadata": {"name": "migrate"}, "status": {"active": 1}}`)
+	assert.EqualError(t, client.waitForJob("job/migrate", "", 50*time.Millisecond), "timed out waiting for job/migrate")
+
+	// Failed jobs fail fast, printing the exit codes and logs of the failed pods
+	f.set(t, path, testJobFailed)
+	f.set(t, "/api/v1/namespaces/test-ns/pods", `{"kind": "PodList", "apiVersion": "v1", "items": [
+		{"metadata": {"name": "migrate-a"}, "spec": {"containers": [{"name": "migrate"}]}, "status": {"phase": "Failed", "containerStatuses": [{"name": "migrate", "state": {"terminated": {"exitCode": 1, "reason": "Error"}}}]}},
+		{"metadata": {"name": "migrate-b"}, "spec": {"containers": [{"name": "migrate"}]}, "status": {"phase": "Running"}}
+	]}`)
+	var out bytes.Buffer
+	client.out = &out
+	assert.EqualError(t, client.waitForJob("job/migrate", "", time.Minute), "job/migrate failed: Job has reached the specified backoff limit")
+	assert.Equal(t, "pod/migrate-a: container migrate exited with code 1 (Error)\nLogs of pod/migrate-a container migrate:\nlogs of migrate-a migrate\n", out.String())
+	assert.Contains(t, f.requests, "GET /api/v1/namespaces/test-ns/pods?labelSelector=job-name%3Dmigrate")
+}
+
+func TestNativeClientWaitForCondition(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	path := "/apis/cert-manager.io/v1/namespaces/test-ns/certificates/app"
+	mustParse := func(s string) waitCondition {
+		condition, err := parseWaitCondition(s)
+		assert.NoError(t, err)
+		return condition
+	}
+
+	// Not created yet
+	assert.EqualError(t, client.waitForCondition("certificate/app", "", mustParse("exists"), 50*time.Millisecond), "timed out waiting for certificate/app")
+	assert.NoError(t, client.waitForCondition("certificate/app", "", mustParse("deleted"), time.Second))
+
+	f.set(t, path, `{"apiVersion": "cert-manager.io/v1", "kind": "Certificate", "metadata": {"name": "app"}, "status": {"conditions": [{"type": "Ready", "status": "False"}], "notAfter": "2027-01-01T00:00:00Z"}}`)
+	assert.NoError(t, client.waitForCondition("certificate/app", "", mustParse("exists"), time.Second))
+	assert.NoError(t, client.waitForCondition("certificates.cert-manager.io/app", "test-ns", mustParse("condition=Ready=False"), time.Second))
+	assert.NoError(t, client.waitForCondition("cert/app", "", mustParse("jsonpath={.status.notAfter}"), time.Second))
+	assert.Error(t, client.waitForCondition("cert/app", "", mustParse("Ready"), 50*time.Millisecond))
+	assert.Error(t, client.waitForCondition("cert/app", "", mustParse("jsonpath={.status.renewalTime}"), 50*time.Millisecond))
+
+	f.set(t, path, `{"apiVersion": "cert-manager.io/v1", "kind": "Certificate", "metadata": {"name": "app"}, "status": {"conditions": [{"type": "Ready", "status": "True"}]}}`)
+	assert.NoError(t, client.waitForCondition("Certificate/app", "", mustParse("condition=ready"), time.Second))
+	assert.NoError(t, client.waitForCondition("certificate/app", "", mustParse("jsonpath='{.status.conditions[?(@.type==\"Ready\")].status}'=True"), time.Second))
+
+	// Unknown kinds
+	assert.Error(t, client.waitForCondition("widget/w", "", mustParse("exists"), time.Second))
+}
+
+func TestNativeClientWaitForAddress(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	path := "/api/v1/namespaces/test-ns/services/app"
+
+	f.set(t, path, `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "app"}, "status": {"loadBalancer": {}}}`)
+	_, err := client.waitForAddress("service/app", "", 50*time.Millisecond)
+	assert.EqualError(t, err, "timed out waiting for service/app")
+
+	f.set(t, path, `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "app"}, "status": {"loadBalancer": {"ingress": [{"ip": "34.1.2.3"}]}}}`)
+	addresses, err := client.waitForAddress("svc/app", "test-ns", time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"34.1.2.3"}, addresses)
+}
+
+func TestNativeClientRollback(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	path := "/apis/apps/v1/namespaces/test-ns/deployments/app"
+	f.set(t, path, `{"apiVersion": "apps/v1", "kind": "Deployment", "metadata": {"name": "app", "uid": "d1", "annotations": {"deployment.kubernetes.io/revision": "3"}},
+		"spec": {"selector": {"matchLabels": {"app": "app"}}, "template": {"metadata": {"labels": {"app": "app"}}, "spec": {"containers": [{"name": "app", "image": "app:3"}]}}}}`)
+	f.set(t, "/apis/apps/v1/namespaces/test-ns/replicasets", `{"kind": "ReplicaSetList", "apiVersion": "apps/v1", "items": [
+		{"metadata": {"name": "app-1", "annotations": {"deployment.kubernetes.io/revision": "1"}, "ownerReferences": [{"apiVersion": "apps/v1", "kind": "Deployment", "name": "app", "uid": "d1", "controller": true}]},
+			"spec": {"template": {"metadata": {"labels": {"app": "app", "pod-template-hash": "1"}}, "spec": {"containers": [{"name": "app", "image": "app:1"}]}}}},
+		{"metadata": {"name": "app-2", "annotations": {"deployment.kubernetes.io/revision": "2"}, "ownerReferences": [{"apiVersion": "apps/v1", "kind": "Deployment", "name": "app", "uid": "d1", "controller": true}]},
+			"spec": {"template": {"metadata": {"labels": {"app": "app", "pod-template-hash": "2"}}, "spec": {"containers": [{"name": "app", "image": "app:2"}]}}}},
+		{"metadata": {"name": "app-3", "annotations": {"deployment.kubernetes.io/revision": "3"}, "ownerReferences": [{"apiVersion": "apps/v1", "kind": "Deployment", "name": "app", "uid": "d1", "controller": true}]},
+			"spec": {"template": {"metadata": {"labels": {"app": "app", "pod-template-hash": "3"}}, "spec": {"containers": [{"name": "app", "image": "app:3"}]}}}},
+		{"metadata": {"name": "other-2", "annotations": {"deployment.kubernetes.io/revision": "2"}, "ownerReferences": [{"apiVersion": "apps/v1", "kind": "Deployment", "name": "other", "uid": "d2", "controller": true}]},
+			"spec": {"template": {"metadata": {"labels": {"app": "app"}}, "spec": {"containers": [{"name": "app", "image": "other:2"}]}}}}
+	]}`)
+
+	assert.NoError(t, client.rollback("deployment/app", ""))
+	containers, _ := nestedField(f.objects[path], "spec", "template", "spec", "containers")
+	assert.Equal(t, "app:2", nestedString(containers.([]interface{})[0].(map[string]interface{}), "image"))
+	assert.Equal(t, "", nestedString(f.objects[path], "spec", "template", "metadata", "labels", "pod-template-hash"))
+
+	assert.EqualError(t, client.rollback("statefulset/db", ""), "rolling back statefulset/db is not supported by the client-go backend, only Deployments are; use the kubectl backend")
+}
+
+func TestNativeClientPatch(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	path := "/api/v1/namespaces/test-ns/services/app"
+	f.set(t, path, `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "app", "namespace": "test-ns"},
+		"spec": {"selector": {"app": "app", "drone-gke.nytimes.com/color": "blue"}}}`)
+	service := objectReference("v1", "Service", "app", "test-ns")
+
+	assert.NoError(t, client.patch(service, map[string]interface{}{"spec": map[string]interface{}{"selector": map[string]interface{}{colorLabel: "green"}}}))
+	assert.Equal(t, "green", nestedString(f.objects[path], "spec", "selector", colorLabel))
+
+	assert.NoError(t, client.patch(service, map[string]interface{}{"spec": map[string]interface{}{"selector": map[string]interface{}{colorLabel: nil}}}))
+	selector, _ := nestedField(f.objects[path], "spec", "selector")
+	assert.Equal(t, map[string]interface{}{"app": "app"}, selector)
+
+	assert.Error(t, client.patch(objectReference("v1", "Service", "web", "test-ns"), map[string]interface{}{}))
+}
+
+func TestNativeClientCreateUpdate(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	path := "/apis/coordination.k8s.io/v1/namespaces/test-ns/leases/drone-gke-lock"
+	lease := &manifestObject{object: map[string]interface{}{
+		"apiVersion": "coordination.k8s.io/v1",
+		"kind":       "Lease",
+		"metadata":   map[string]interface{}{"name": "drone-gke-lock", "namespace": "test-ns"},
+		"spec":       map[string]interface{}{"holderIdentity": "build 12"},
+	}}
+	assert.NoError(t, client.create(lease))
+	assert.Equal(t, "build 12", nestedString(f.objects[path], "spec", "holderIdentity"))
+	assert.Error(t, client.create(lease))
+
+	lease.object["spec"] = map[string]interface{}{"holderIdentity": "build 13"}
+	assert.NoError(t, client.update(lease))
+	assert.Equal(t, "build 13", nestedString(f.objects[path], "spec", "holderIdentity"))
+}
+
+func TestNativeClientList(t *testing.T) {
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+
+	f.set(t, "/api/v1/namespaces/test-ns/configmaps", `{"kind": "ConfigMapList", "apiVersion": "v1", "items": [
+		{"metadata": {"name": "drone-gke-release-1617271445"}, "data": {"build-number": "12"}}
+	]}`)
+
+	items, err := client.list("v1", "ConfigMap", "test-ns", releaseLabel+"=true")
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "12", nestedString(items[0], "data", "build-number"))
+	assert.Contains(t, f.requests, "GET /api/v1/namespaces/test-ns/configmaps?labelSelector=drone-gke.nytimes.com%2Frelease%3Dtrue")
+}
+
+func TestRolloutStatus(t *testing.T) {
+	for _, test := range []struct {
+		object   string
+		done     bool
+		message  string
+		resource string
+	}{
+		{`{"metadata": {"name": "app", "generation": 3}, "status": {"observedGeneration": 2}}`, false, "Waiting for deployment spec update to be observed...", "deployment"},
+		{`{"metadata": {"name": "app"}, "spec": {"replicas": 3}, "status": {"replicas": 3, "updatedReplicas": 3, "availableReplicas": 1}}`, false, `Waiting for deployment "app" rollout to finish: 1 of 3 updated replicas are available...`, "deployment"},
+		{`{"metadata": {"name": "db", "generation": 1}, "spec": {"replicas": 3, "updateStrategy": {"type": "RollingUpdate", "rollingUpdate": {"partition": 2}}}, "status": {"observedGeneration": 1, "readyReplicas": 3, "updatedReplicas": 1}}`, true, "partitioned roll out complete: 1 new pods have been updated...", "statefulset"},
+		{`{"metadata": {"name": "db", "generation": 1}, "spec": {"updateStrategy": {"type": "OnDelete"}}}`, true, "rollout status is only available for RollingUpdate strategy type", "statefulset"},
+		{`{"metadata": {"name": "agent", "generation": 1}, "spec": {"updateStrategy": {"type": "RollingUpdate"}}, "status": {"observedGeneration": 1, "desiredNumberScheduled": 3, "updatedNumberScheduled": 2}}`, false, `Waiting for daemon set "agent" rollout to finish: 2 out of 3 new pods have been updated...`, "daemonset"},
+	} {
+		f := newFakeAPIServer(t)
+		client := newTestNativeClient(t, f)
+		kinds := map[string]string{"deployment": "deployments", "statefulset": "statefulsets", "daemonset": "daemonsets"}
+
+		var decoded map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(test.object), &decoded))
+		name := nestedString(decoded, "metadata", "name")
+		f.set(t, "/apis/apps/v1/namespaces/test-ns/"+kinds[test.resource]+"/"+name, test.object)
+
+		err := client.waitForRollout(test.resource+"/"+name, "", 30*time.Millisecond)
+		if test.done {
+			assert.NoError(t, err, test.message)
+		} else {
+			assert.Error(t, err, test.message)
+		}
+		f.Close()
+	}
+}
+
+func TestSplitResource(t *testing.T) {
+	kind, name := splitResource("deployment/app")
+	assert.Equal(t, "deployment", kind)
+	assert.Equal(t, "app", name)
+
+	kind, name = splitResource("Deployment.apps/app")
+	assert.Equal(t, "deployment", kind)
+	assert.Equal(t, "app", name)
+
+	kind, name = splitResource("app")
+	assert.Equal(t, "", kind)
+	assert.Equal(t, "app", name)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+const testJobComplete = `{"metadata": {"name": "migrate"}, "status": {"conditions": [{"type": "Complete", "status": "True"}]}}`
+
+const testJobRunning = `{"metadata": {"name": "migrate"}, "status": {"active": 1}}`
+
+const testJobFailed = `{"metadata": {"name": "migrate"}, "status": {"conditions": [{"type": "Failed", "status": "True", "reason": "BackoffLimitExceeded", "message": "Job has reached the specified backoff limit"}]}}`
+
+const testJobPods = `{"items": [
+	{"metadata": {"name": "migrate-b", "creationTimestamp": "2026-01-01T00:01:00Z"}, "status": {"phase": "Failed", "containerStatuses": [{"name": "migrate", "state": {"terminated": {"exitCode": 2, "reason": "Error"}}}]}},
+	{"metadata": {"name": "migrate-a", "creationTimestamp": "2026-01-01T00:00:00Z"}, "status": {"phase": "Failed", "initContainerStatuses": [{"name": "wait-db", "state": {"terminated": {"exitCode": 1}}}]}},
+	{"metadata": {"name": "migrate-c", "creationTimestamp": "2026-01-01T00:02:00Z"}, "status": {"phase": "Running", "containerStatuses": [{"name": "migrate", "state": {"running": {}}}]}}
+]}`
+
+func TestValidateBackend(t *testing.T) {
+	for backend, valid := range map[string]bool{"": true, "kubectl": true, "client-go": true, "helm": false} {
+		set := flag.NewFlagSet("test-set", 0)
+		set.String("backend", backend, "")
+		c := cli.NewContext(nil, set, nil)
+
+		if valid {
+			assert.NoError(t, validateBackend(c), backend)
+		} else {
+			assert.Error(t, validateBackend(c), backend)
+		}
+	}
+}
+
+// deadlineRunner records the time left before the deadline of each command, zero without deadline
+type deadlineRunner struct {
+	timeouts []time.Duration
+}
+
+func (r *deadlineRunner) Run(ctx context.Context, name string, arg ...string) error {
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline).Round(time.Second)
+	}
+	r.timeouts = append(r.timeouts, timeout)
+	return nil
+}
+
+func (r *deadlineRunner) Output(ctx context.Context, name string, arg ...string) (*Result, error) {
+	return &Result{}, r.Run(ctx, name, arg...)
+}
+
+func TestKubectlClientWaitForRollout(t *testing.T) {
+	runner := &deadlineRunner{}
+	client := &kubectlClient{runner: runner}
+	assert.NoError(t, client.waitForRollout("deployment/app", "test-ns", 256*time.Second))
+	assert.NoError(t, client.waitForRollout("deployment/app", "test-ns", 0))
+	assert.Equal(t, []time.Duration{256 * time.Second, 0}, runner.timeouts)
+}
+
+func TestKubectlClientWaitForJob(t *testing.T) {
+	var out bytes.Buffer
+	// Completes after running
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "job/migrate", "-o=json", "--namespace", "test-ns"}).Return(testJobRunning, nil).Twice()
+	testRunner.On("Output", []string{"kubectl", "get", "job/migrate", "-o=json", "--namespace", "test-ns"}).Return(testJobComplete, nil).Once()
+	client := &kubectlClient{runner: testRunner, out: &out, interval: time.Millisecond}
+	assert.NoError(t, client.waitForJob("job/migrate", "test-ns", time.Minute))
+	testRunner.AssertExpectations(t)
+	assert.Equal(t, "job/migrate condition met\n", out.String())
+
+	// Times out
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "job/migrate", "-o=json"}).Return(testJobRunning, nil)
+	client = &kubectlClient{runner: testRunner, out: &out, interval: 10 * time.Millisecond}
+	assert.EqualError(t, client.waitForJob("job/migrate", "", 50*time.Millisecond), "timed out waiting for job/migrate")
+
+	// Cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	client = &kubectlClient{runner: testRunner, out: &out, interval: time.Hour, ctx: ctx}
+	assert.EqualError(t, client.waitForJob("job/migrate", "", time.Hour), "cancelled waiting for job/migrate")
+
+	// Fails fast, printing the exit codes and logs of the failed pods
+	out.Reset()
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "job/migrate", "-o=json"}).Return(testJobFailed, nil).Once()
+	testRunner.On("Output", []string{"kubectl", "get", "pods", "--selector=job-name=migrate", "-o=json"}).Return(testJobPods, nil).Once()
+	testRunner.On("Run", []string{"kubectl", "logs", "pod/migrate-a", "--all-containers", "--tail=50"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "logs", "pod/migrate-b", "--all-containers", "--tail=50"}).Return(nil).Once()
+	client = &kubectlClient{runner: testRunner, out: &out, interval: time.Hour}
+	err := client.waitForJob("job/migrate", "", time.Hour)
+	testRunner.AssertExpectations(t)
+	assert.EqualError(t, err, "job/migrate failed: Job has reached the specified backoff limit")
+	assert.Equal(t, strings.Join([]string{
+		"pod/migrate-a: container wait-db exited with code 1",
+		"pod/migrate-b: container migrate exited with code 2 (Error)",
+		"",
+	}, "\n"), out.String())
+}
+
+func TestKubectlClientWaitForAddress(t *testing.T) {
+	var out bytes.Buffer
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "service/app", "-o=json", "--namespace", "test-ns"}).Return(`{"status": {"loadBalancer": {}}}`, nil).Once()
+	testRunner.On("Output", []string{"kubectl", "get", "service/app", "-o=json", "--namespace", "test-ns"}).Return(`{"status": {"loadBalancer": {"ingress": [{"ip": "34.1.2.3"}, {"hostname": "app.example.com"}]}}}`, nil).Once()
+	client := &kubectlClient{runner: testRunner, out: &out, interval: time.Millisecond}
+	addresses, err := client.waitForAddress("service/app", "test-ns", time.Minute)
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"34.1.2.3", "app.example.com"}, addresses)
+	assert.Equal(t, "service/app has address 34.1.2.3, app.example.com\n", out.String())
+
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "ingress/web", "-o=json"}).Return(`{"status": {"loadBalancer": {}}}`, nil)
+	client = &kubectlClient{runner: testRunner, out: &out, interval: 10 * time.Millisecond}
+	_, err = client.waitForAddress("ingress/web", "", 50*time.Millisecond)
+	assert.EqualError(t, err, "timed out waiting for ingress/web")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	deprecatedAPIsWarn = "warn"
+	deprecatedAPIsFail = "fail"
+)
+
+// deprecatedAPI is an apiVersion / kind pair deprecated or removed as of a Kubernetes minor version
+type deprecatedAPI struct {
+	apiVersion   string
+	kind         string
+	deprecatedIn int64
+	// 0 if the API has not been scheduled for removal
+	removedIn   int64
+	replacement string
+}
+
+// deprecatedAPIs follows https://kubernetes.io/docs/reference/using-api/deprecation-guide/
+var deprecatedAPIs = []deprecatedAPI{
+	// 1.16
+	{"extensions/v1beta1", "Deployment", 9, 16, "apps/v1"},
+	{"extensions/v1beta1", "DaemonSet", 9, 16, "apps/v1"},
+	{"extensions/v1beta1", "ReplicaSet", 9, 16, "apps/v1"},
+	{"extensions/v1beta1", "NetworkPolicy", 9, 16, "networking.k8s.io/v1"},
+	{"extensions/v1beta1", "PodSecurityPolicy", 10, 16, "policy/v1beta1"},
+	{"apps/v1beta1", "Deployment", 9, 16, "apps/v1"},
+	{"apps/v1beta1", "StatefulSet", 9, 16, "apps/v1"},
+	{"apps/v1beta1", "ReplicaSet", 9, 16, "apps/v1"},
+	{"apps/v1beta2", "Deployment", 9, 16, "apps/v1"},
+	{"apps/v1beta2", "StatefulSet", 9, 16, "apps/v1"},
+	{"apps/v1beta2", "DaemonSet", 9, 16, "apps/v1"},
+	{"apps/v1beta2", "ReplicaSet", 9, 16, "apps/v1"},
+
+	// 1.22
+	{"admissionregistration.k8s.io/v1beta1", "MutatingWebhookConfiguration", 16, 22, "admissionregistration.k8s.io/v1"},
+	{"admissionregistration.k8s.io/v1beta1", "ValidatingWebhookConfiguration", 16, 22, "admissionregistration.k8s.io/v1"},
+	{"apiextensions.k8s.io/v1beta1", "CustomResourceDefinition", 16, 22, "apiextensions.k8s.io/v1"},
+	{"apiregistration.k8s.io/v1beta1", "APIService", 19, 22, "apiregistration.k8s.io/v1"},
+	{"authentication.k8s.io/v1beta1", "TokenReview", 19, 22, "authentication.k8s.io/v1"},
+	{"authorization.k8s.io/v1beta1", "LocalSubjectAccessReview", 19, 22, "authorization.k8s.io/v1"},
+	{"authorization.k8s.io/v1beta1", "SelfSubjectAccessReview", 19, 22, "authorization.k8s.io/v1"},
+	{"authorization.k8s.io/v1beta1", "SubjectAccessReview", 19, 22, "authorization.k8s.io/v1"},
+	{"certificates.k8s.io/v1beta1", "CertificateSigningRequest", 19, 22, "certificates.k8s.io/v1"},
+	{"coordination.k8s.io/v1beta1", "Lease", 19, 22, "coordination.k8s.io/v1"},
+	{"extensions/v1beta1", "Ingress", 14, 22, "networking.k8s.io/v1"},
+	{"networking.k8s.io/v1beta1", "Ingress", 19, 22, "networking.k8s.io/v1"},
+	{"networking.k8s.io/v1beta1", "IngressClass", 19, 22, "networking.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", "ClusterRole", 17, 22, "rbac.authorization.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", "ClusterRoleBinding", 17, 22, "rbac.authorization.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", "Role", 17, 22, "rbac.authorization.k8s.io/v1"},
+	{"rbac.authorization.k8s.io/v1beta1", "RoleBinding", 17, 22, "rbac.authorization.k8s.io/v1"},
+	{"scheduling.k8s.io/v1beta1", "PriorityClass", 14, 22, "scheduling.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", "CSIDriver", 19, 22, "storage.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", "CSINode", 17, 22, "storage.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", "StorageClass", 19, 22, "storage.k8s.io/v1"},
+	{"storage.k8s.io/v1beta1", "VolumeAttachment", 19, 22, "storage.k8s.io/v1"},
+
+	// 1.25
+	{"batch/v1beta1", "CronJob", 21, 25, "batch/v1"},
+	{"discovery.k8s.io/v1beta1", "EndpointSlice", 21, 25, "discovery.k8s.io/v1"},
+	{"events.k8s.io/v1beta1", "Event", 21, 25, "events.k8s.io/v1"},
+	{"autoscaling/v2beta1", "HorizontalPodAutoscaler", 22, 25, "autoscaling/v2"},
+	{"policy/v1beta1", "PodDisruptionBudget", 21, 25, "policy/v1"},
+	{"policy/v1beta1", "PodSecurityPolicy", 21, 25, ""},
+	{"node.k8s.io/v1beta1", "RuntimeClass", 20, 25, "node.k8s.io/v1"},
+
+	// 1.26
+	{"flowcontrol.apiserver.k8s.io/v1beta1", "FlowSchema", 23, 26, "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta1", "PriorityLevelConfiguration", 23, 26, "flowcontrol.apiserver.k8s.io/v1"},
+	{"autoscaling/v2beta2", "HorizontalPodAutoscaler", 23, 26, "autoscaling/v2"},
+
+	// 1.27
+	{"storage.k8s.io/v1beta1", "CSIStorageCapacity", 24, 27, "storage.k8s.io/v1"},
+
+	// 1.29
+	{"flowcontrol.apiserver.k8s.io/v1beta2", "FlowSchema", 26, 29, "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta2", "PriorityLevelConfiguration", 26, 29, "flowcontrol.apiserver.k8s.io/v1"},
+
+	// 1.32
+	{"flowcontrol.apiserver.k8s.io/v1beta3", "FlowSchema", 29, 32, "flowcontrol.apiserver.k8s.io/v1"},
+	{"flowcontrol.apiserver.k8s.io/v1beta3", "PriorityLevelConfiguration", 29, 32, "flowcontrol.apiserver.k8s.io/v1"},
+
+	// Deprecated without a scheduled removal
+	{"v1", "ComponentStatus", 19, 0, ""},
+	{"v1", "Endpoints", 33, 0, "discovery.k8s.io/v1 EndpointSlice"},
+}
+
+// validateDeprecatedAPIsMode validates the deprecated-apis param
+func validateDeprecatedAPIsMode(c *cli.Context) error {
+	switch c.String("deprecated-apis") {
+	case "", deprecatedAPIsWarn, deprecatedAPIsFail:
+		return nil
+	}
+	return fmt.Errorf("Invalid param deprecated-apis: must be one of %s, %s", deprecatedAPIsWarn, deprecatedAPIsFail)
+}
+
+// checkDeprecatedAPIs reports objects using APIs deprecated or removed as of a Kubernetes version.
+// Only deprecated-apis=fail returns an error.
+func checkDeprecatedAPIs(c *cli.Context, objects []*manifestObject, version string) error {
+	minor, err := parseMinorVersion(version)
+	if err != nil {
+		return fmt.Errorf("Error checking for deprecated APIs: %s\n", err)
+	}
+
+	log("Checking the Kubernetes manifests for APIs deprecated or removed as of Kubernetes 1.%d\n", minor)
+
+	findings := findDeprecatedAPIs(objects, minor)
+	if len(findings) == 0 {
+		return nil
+	}
+
+	fail := c.String("deprecated-apis") == deprecatedAPIsFail
+	for _, finding := range findings {
+		if fail {
+			fmt.Fprintf(logStdout(), "%s\n", finding)
+		} else {
+			fmt.Fprintf(logStdout(), "Warning: %s\n", finding)
+		}
+	}
+
+	if fail {
+		return fmt.Errorf("Error: %d object(s) use deprecated or removed APIs\n", len(findings))
+	}
+
+	return nil
+}
+
+// findDeprecatedAPIs describes every object using an API deprecated or removed as of a Kubernetes minor version
+func findDeprecatedAPIs(objects []*manifestObject, minor int64) []string {
+	findings := []string{}
+
+	for _, o := range objects {
+		for _, api := range deprecatedAPIs {
+			if o.apiVersion() != api.apiVersion || o.kind() != api.kind {
+				continue
+			}
+
+			var finding string
+			if api.removedIn > 0 && minor >= api.removedIn {
+				finding = fmt.Sprintf("%s: %s %s was removed in Kubernetes 1.%d", o.location(), api.apiVersion, api.kind, api.removedIn)
+			} else if minor >= api.deprecatedIn {
+				finding = fmt.Sprintf("%s: %s %s is deprecated since Kubernetes 1.%d", o.location(), api.apiVersion, api.kind, api.deprecatedIn)
+				if api.removedIn > 0 {
+					finding += fmt.Sprintf(" and will be removed in 1.%d", api.removedIn)
+				}
+			} else {
+				break
+			}
+
+			if api.replacement != "" {
+				finding += fmt.Sprintf(", use %s instead", api.replacement)
+			}
+
+			findings = append(findings, finding)
+			break
+		}
+	}
+
+	return findings
+}
+
+// getServerVersion fetches the version of the cluster from kubectl
+func getServerVersion(ctx context.Context, runner Runner) (string, error) {
+	result, err := runner.Output(ctx, kubectlCmd, "version", "-o=json")
+	if err != nil {
+		return "", fmt.Errorf("Error fetching the cluster version: %v", err)
+	}
+
+	var versionOutput struct {
+		ServerVersion struct {
+			GitVersion string
+		}
+	}
+
+	if err := json.Unmarshal(result.Stdout, &versionOutput); err != nil {
+		return "", fmt.Errorf("Error reading kubectl version: %v", err)
+	}
+
+	if versionOutput.ServerVersion.GitVersion == "" {
+		return "", fmt.Errorf("Error reading kubectl version: missing server version")
+	}
+
+	return versionOutput.ServerVersion.GitVersion, nil
+}
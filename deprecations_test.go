@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestValidateDeprecatedAPIsMode(t *testing.T) {
+	for _, mode := range []string{"", "warn", "fail"} {
+		set := flag.NewFlagSet("test-set", 0)
+		set.String("deprecated-apis", mode, "")
+		c := cli.NewContext(nil, set, nil)
+		assert.NoError(t, validateDeprecatedAPIsMode(c))
+	}
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("deprecated-apis", "error", "")
+	c := cli.NewContext(nil, set, nil)
+	assert.Error(t, validateDeprecatedAPIsMode(c))
+}
+
+func TestFindDeprecatedAPIs(t *testing.T) {
+	objects := []*manifestObject{
+		testObject(t, "apiVersion: extensions/v1beta1\nkind: Deployment\nmetadata:\n  name: app\n"),
+		testObject(t, "apiVersion: batch/v1beta1\nkind: CronJob\nmetadata:\n  name: cron\n"),
+		testObject(t, "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n"),
+		testObject(t, "apiVersion: v1\nkind: Endpoints\nmetadata:\n  name: external\n"),
+	}
+
+	assert.Equal(t, []string{
+		".kube.yml (document 1) Deployment/app: extensions/v1beta1 Deployment was removed in Kubernetes 1.16, use apps/v1 instead",
+		".kube.yml (document 1) CronJob/cron: batch/v1beta1 CronJob is deprecated since Kubernetes 1.21 and will be removed in 1.25, use batch/v1 instead",
+	}, findDeprecatedAPIs(objects, 22))
+
+	assert.Equal(t, []string{
+		".kube.yml (document 1) Deployment/app: extensions/v1beta1 Deployment was removed in Kubernetes 1.16, use apps/v1 instead",
+		".kube.yml (document 1) CronJob/cron: batch/v1beta1 CronJob was removed in Kubernetes 1.25, use batch/v1 instead",
+		".kube.yml (document 1) Endpoints/external: v1 Endpoints is deprecated since Kubernetes 1.33, use discovery.k8s.io/v1 EndpointSlice instead",
+	}, findDeprecatedAPIs(objects, 34))
+
+	// Not deprecated yet
+	assert.Empty(t, findDeprecatedAPIs(objects[1:], 20))
+}
+
+func TestCheckDeprecatedAPIs(t *testing.T) {
+	objects := []*manifestObject{
+		testObject(t, "apiVersion: extensions/v1beta1\nkind: Deployment\nmetadata:\n  name: app\n"),
+	}
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("deprecated-apis", "warn", "")
+	c := cli.NewContext(nil, set, nil)
+	assert.NoError(t, checkDeprecatedAPIs(c, objects, "v1.34.2-gke.1000"))
+
+	set = flag.NewFlagSet("test-set", 0)
+	set.String("deprecated-apis", "fail", "")
+	c = cli.NewContext(nil, set, nil)
+	assert.Error(t, checkDeprecatedAPIs(c, objects, "1.34"))
+	assert.NoError(t, checkDeprecatedAPIs(c, objects, "1.8"))
+	assert.Error(t, checkDeprecatedAPIs(c, objects, "latest"))
+}
+
+func TestGetServerVersion(t *testing.T) {
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "version", "-o=json"}).Return(`{
+		"clientVersion": {"major": "1", "minor": "34", "gitVersion": "v1.34.1"},
+		"serverVersion": {"major": "1", "minor": "33+", "gitVersion": "v1.33.5-gke.1308000"}
+	}`, nil).Once()
+	version, err := getServerVersion(context.Background(), testRunner)
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1.33.5-gke.1308000", version)
+
+	// No server version
+	testRunner.On("Output", []string{"kubectl", "version", "-o=json"}).Return(`{"clientVersion": {"major": "1", "minor": "34"}}`, nil).Once()
+	_, err = getServerVersion(context.Background(), testRunner)
+	assert.Error(t, err)
+
+	// kubectl error
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "version", "-o=json"}).Return("", fmt.Errorf("e"))
+	_, err = getServerVersion(context.Background(), testRunner)
+	assert.Error(t, err)
+}
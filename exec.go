@@ -1,14 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// programKillDelay is the time a cancelled program is given to terminate before it is killed
+const programKillDelay = 10 * time.Second
+
+// Runner executes programs, until they exit or ctx is done.
 type Runner interface {
-	Run(name string, arg ...string) error
+	// Run executes a program, writing its output to the writers of the runner
+	Run(ctx context.Context, name string, arg ...string) error
+	// Output executes a program, returning its output
+	Output(ctx context.Context, name string, arg ...string) (*Result, error)
+}
+
+// Result is the output and exit code of a program
+type Result struct {
+	Stdout []byte
+	Stderr []byte
+	// ExitCode is -1 if the program did not exit, e.g. it was killed
+	ExitCode int
 }
 
 type BasicRunner struct {
@@ -17,6 +38,8 @@ type BasicRunner struct {
 	env    []string
 	stdout io.Writer
 	stderr io.Writer
+	// quiet runners do not print or log the programs they run
+	quiet bool
 }
 
 func NewBasicRunner(dir string, env []string, stdout, stderr io.Writer) *BasicRunner {
@@ -28,18 +51,108 @@ func NewBasicRunner(dir string, env []string, stdout, stderr io.Writer) *BasicRu
 	}
 }
 
-// Run executes the given program.
-func (e *BasicRunner) Run(name string, arg ...string) error {
-	cmd := exec.Command(name, arg...)
+// WithOutput returns a copy of the runner writing the output of the programs to stdout and stderr.
+func (e *BasicRunner) WithOutput(stdout, stderr io.Writer) Runner {
+	return e.withWriters(stdout, stderr)
+}
+
+// Quiet returns a copy of the runner which does not print or log the programs it runs.
+func (e *BasicRunner) Quiet() Runner {
+	runner := *e
+	runner.quiet = true
+	return &runner
+}
+
+// withWriters returns a copy of the runner writing the output of the programs to stdout and stderr
+func (e *BasicRunner) withWriters(stdout, stderr io.Writer) *BasicRunner {
+	runner := *e
+	runner.stdout = stdout
+	runner.stderr = stderr
+	return &runner
+}
+
+// Run executes the given program. Once ctx is done, the program and its children are sent SIGTERM,
+// then killed after programKillDelay.
+func (e *BasicRunner) Run(ctx context.Context, name string, arg ...string) error {
+	return e.run(ctx, e.stdout, e.stderr, name, arg...)
+}
+
+// run executes the given program, writing its output to stdout and stderr. The program is printed
+// to the stdout of the runner, e.g. prefixed with the waited resource.
+func (e *BasicRunner) run(ctx context.Context, stdout, stderr io.Writer, name string, arg ...string) error {
+	cmd := exec.CommandContext(ctx, name, arg...)
 	cmd.Dir = e.dir
 	cmd.Env = e.env
-	cmd.Stdout = e.stdout
-	cmd.Stderr = e.stderr
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// Run the program in its own process group, so that its children are signaled with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var kill *time.Timer
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		kill = time.AfterFunc(programKillDelay, func() {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = programKillDelay
 
 	// TODO: Extract this
-	fmt.Println()
-	fmt.Println("$", strings.Join(cmd.Args, " "))
+	if logFormat != logFormatJSON && !e.quiet {
+		var echo io.Writer = os.Stdout
+		if e.stdout != nil {
+			echo = e.stdout
+		}
+		fmt.Fprintln(echo)
+		fmt.Fprintln(echo, "$", strings.Join(cmd.Args, " "))
+	}
 	//--
 
-	return cmd.Run()
+	start := time.Now()
+	err := cmd.Run()
+	// The group exited, its id may be reused by the time the kill would be sent
+	if kill != nil {
+		kill.Stop()
+	}
+	if logFormat == logFormatJSON && !e.quiet {
+		logCommand(cmd.Args, time.Since(start), err)
+	}
+	traceCommand(cmd.Args, start, err)
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			return fmt.Errorf("%s timed out", name)
+		case context.Canceled:
+			return fmt.Errorf("%s was cancelled", name)
+		}
+	}
+
+	return err
+}
+
+// Output executes the given program like Run, returning its output rather than writing it.
+// Its error output is still written to the stderr of the runner, if any.
+func (e *BasicRunner) Output(ctx context.Context, name string, arg ...string) (*Result, error) {
+	var stdout, stderr bytes.Buffer
+	var w io.Writer = &stderr
+	if e.stderr != nil {
+		w = io.MultiWriter(e.stderr, &stderr)
+	}
+
+	err := e.run(ctx, &stdout, w, name, arg...)
+
+	return &Result{Stdout: stdout.Bytes(), Stderr: stderr.Bytes(), ExitCode: exitCode(err)}, err
+}
+
+// exitCode returns the exit code of a program which failed with err, -1 if it did not exit
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	}
+	return -1
 }
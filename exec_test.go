@@ -2,7 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,9 +23,52 @@ func TestEnvironRun(t *testing.T) {
 		stderr: stderr,
 	}
 
-	err := e.Run("/bin/echo", "hello, gke")
+	err := e.Run(context.Background(), "/bin/echo", "hello, gke")
 	if assert.NoError(t, err) {
-		assert.Equal(t, "hello, gke\n", stdout.String())
+		assert.Equal(t, "\n$ /bin/echo hello, gke\nhello, gke\n", stdout.String())
 		assert.Equal(t, "", stderr.String())
 	}
 }
+
+func TestEnvironRunTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatalf("creating the temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := NewBasicRunner(dir, []string{}, &bytes.Buffer{}, &bytes.Buffer{})
+
+	// The child of the program is terminated with it
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = e.Run(ctx, "/bin/sh", "-c", "(sleep 1; touch child) & wait")
+	assert.EqualError(t, err, "/bin/sh timed out")
+	assert.Less(t, time.Since(start), time.Second)
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, "child"))
+	assert.True(t, os.IsNotExist(err), "the child of the program kept running")
+
+	// Cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.EqualError(t, e.Run(ctx, "/bin/echo", "hello, gke"), "/bin/echo was cancelled")
+}
+
+func TestEnvironOutput(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	e := NewBasicRunner("/tmp", []string{"A=1"}, &bytes.Buffer{}, stderr)
+
+	result, err := e.Output(context.Background(), "/bin/sh", "-c", "echo $A; echo oops >&2; exit 3")
+	assert.EqualError(t, err, "exit status 3")
+	assert.Equal(t, &Result{Stdout: []byte("1\n"), Stderr: []byte("oops\n"), ExitCode: 3}, result)
+	// The error output is still written
+	assert.Equal(t, "oops\n", stderr.String())
+
+	result, err = e.Output(context.Background(), "/bin/echo", "hello, gke")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, gke\n", string(result.Stdout))
+	assert.Equal(t, 0, result.ExitCode)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// releaseLabel marks the ConfigMaps recording the releases of a namespace
+	releaseLabel = annotationPrefix + "release"
+
+	releasePrefix = "drone-gke-release-"
+
+	releaseSucceeded = "succeeded"
+	releaseFailed    = "failed"
+)
+
+// release is the record of a deploy, kept in a ConfigMap of the namespace
+type release struct {
+	name        string
+	buildNumber string
+	commit      string
+	branch      string
+	tag         string
+	// timestamp is the time of the deploy, in RFC 3339 with nanoseconds
+	timestamp string
+	outcome   string
+	// err is the error the deploy failed with
+	err string
+	// objects lists the objects applied, e.g. Deployment/app
+	objects []string
+	// redeployOf is the release redeployed, if any
+	redeployOf string
+	// manifest is the kube-template applied, with its common metadata and pinned images
+	manifest []byte
+}
+
+// newRelease records a deploy of objects rendered to manifest, which failed if err is set
+func newRelease(c *cli.Context, objects []*manifestObject, manifest []byte, err error, now time.Time) *release {
+	r := &release{
+		// The random suffix tells apart the releases of deploys in the same second
+		name:        fmt.Sprintf("%s%d-%s", releasePrefix, now.Unix(), randomID(3)),
+		buildNumber: c.String("drone-build-number"),
+		commit:      c.String("drone-commit"),
+		branch:      c.String("drone-branch"),
+		tag:         c.String("drone-tag"),
+		timestamp:   now.UTC().Format(time.RFC3339Nano),
+		outcome:     releaseSucceeded,
+		objects:     []string{},
+		redeployOf:  c.String("redeploy"),
+		manifest:    manifest,
+	}
+
+	if err != nil {
+		r.outcome = releaseFailed
+		r.err = strings.TrimSpace(err.Error())
+	}
+
+	for _, o := range objects {
+		r.objects = append(r.objects, o.String())
+	}
+
+	return r
+}
+
+// deployedAt returns the time of the deploy, zero if its timestamp is invalid
+func (r *release) deployedAt() time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, r.timestamp)
+	return t
+}
+
+// configMap returns the ConfigMap recording the release, the manifest compressed
+func (r *release) configMap(namespace string) (*manifestObject, error) {
+	var manifest bytes.Buffer
+	w := gzip.NewWriter(&manifest)
+	if _, err := w.Write(r.manifest); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	o := objectReference("v1", "ConfigMap", r.name, namespace)
+	metadata, _ := ensureNestedMap(o.object, "metadata")
+	metadata["labels"] = map[string]interface{}{releaseLabel: "true"}
+	o.object["data"] = map[string]interface{}{
+		"build-number": r.buildNumber,
+		"commit":       r.commit,
+		"branch":       r.branch,
+		"tag":          r.tag,
+		"timestamp":    r.timestamp,
+		"outcome":      r.outcome,
+		"error":        r.err,
+		"objects":      strings.Join(r.objects, "\n"),
+		"redeploy-of":  r.redeployOf,
+	}
+	o.object["binaryData"] = map[string]interface{}{
+		"manifest.gz": base64.StdEncoding.EncodeToString(manifest.Bytes()),
+	}
+
+	return o, nil
+}
+
+// parseRelease parses the live ConfigMap of a release
+func parseRelease(live map[string]interface{}) (*release, error) {
+	data := func(key string) string {
+		return nestedString(live, "data", key)
+	}
+
+	r := &release{
+		name:        nestedString(live, "metadata", "name"),
+		buildNumber: data("build-number"),
+		commit:      data("commit"),
+		branch:      data("branch"),
+		tag:         data("tag"),
+		timestamp:   data("timestamp"),
+		outcome:     data("outcome"),
+		err:         data("error"),
+		objects:     []string{},
+		redeployOf:  data("redeploy-of"),
+	}
+
+	if objects := data("objects"); objects != "" {
+		r.objects = strings.Split(objects, "\n")
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(nestedString(live, "binaryData", "manifest.gz"))
+	if err != nil {
+		return nil, fmt.Errorf("decoding the manifest of %s: %s", r.name, err)
+	}
+	if len(compressed) > 0 {
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, fmt.Errorf("decoding the manifest of %s: %s", r.name, err)
+		}
+		if r.manifest, err = ioutil.ReadAll(reader); err != nil {
+			return nil, fmt.Errorf("decoding the manifest of %s: %s", r.name, err)
+		}
+	}
+
+	return r, nil
+}
+
+// listReleases returns the releases recorded in a namespace, newest first
+func listReleases(namespace string, client clusterClient) ([]*release, error) {
+	items, err := client.list("v1", "ConfigMap", namespace, releaseLabel+"=true")
+	if err != nil {
+		return nil, fmt.Errorf("Error listing releases: %s\n", err)
+	}
+
+	releases := []*release{}
+	for _, item := range items {
+		r, err := parseRelease(item)
+		if err != nil {
+			return nil, fmt.Errorf("Error: %s\n", err)
+		}
+		releases = append(releases, r)
+	}
+
+	sort.SliceStable(releases, func(i, j int) bool {
+		return releases[i].deployedAt().After(releases[j].deployedAt())
+	})
+
+	return releases, nil
+}
+
+// recordRelease records a release in the namespace, deleting the releases beyond history-limit
+func recordRelease(c *cli.Context, client clusterClient, r *release) error {
+	namespace := c.String("namespace")
+
+	o, err := r.configMap(namespace)
+	if err != nil {
+		return fmt.Errorf("Error recording release %s: %s\n", r.name, err)
+	}
+
+	log("Recording release %s\n", r.name)
+	if err := client.create(o); err != nil {
+		return fmt.Errorf("Error recording release %s: %s\n", r.name, err)
+	}
+
+	releases, err := listReleases(namespace, client)
+	if err != nil {
+		return err
+	}
+
+	limit := c.Int("history-limit")
+	if limit < 1 || len(releases) <= limit {
+		return nil
+	}
+
+	for _, old := range releases[limit:] {
+		log("Deleting release %s, beyond history-limit\n", old.name)
+		if err := client.delete(objectReference("v1", "ConfigMap", old.name, namespace)); err != nil {
+			return fmt.Errorf("Error deleting release %s: %s\n", old.name, err)
+		}
+	}
+
+	return nil
+}
+
+// loadRelease writes the manifest of the release named by the redeploy param to manifestPath,
+// in place of the rendered kube-template
+func loadRelease(c *cli.Context, client clusterClient, manifestPath string) error {
+	name := c.String("redeploy")
+
+	live, found, err := client.get(objectReference("v1", "ConfigMap", name, c.String("namespace")))
+	if err != nil {
+		return fmt.Errorf("Error getting release %s: %s\n", name, err)
+	}
+	if !found || nestedString(live, "metadata", "labels", releaseLabel) != "true" {
+		return fmt.Errorf("Error: release %s not found\n", name)
+	}
+
+	r, err := parseRelease(live)
+	if err != nil {
+		return fmt.Errorf("Error: %s\n", err)
+	}
+
+	log("Redeploying release %s of build %s (commit %s)\n", r.name, r.buildNumber, r.commit)
+	if err := ioutil.WriteFile(manifestPath, r.manifest, 0600); err != nil {
+		return fmt.Errorf("Error writing manifest: %s\n", err)
+	}
+
+	return nil
+}
+
+// printReleases prints a table of releases
+func printReleases(out io.Writer, releases []*release) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RELEASE\tBUILD\tCOMMIT\tBRANCH\tTAG\tDEPLOYED\tOUTCOME\tOBJECTS")
+
+	for _, r := range releases {
+		commit := r.commit
+		if len(commit) > 7 {
+			commit = commit[:7]
+		}
+
+		outcome := r.outcome
+		if r.redeployOf != "" {
+			outcome += " (redeploy of " + r.redeployOf + ")"
+		}
+
+		deployed := r.timestamp
+		if t := r.deployedAt(); !t.IsZero() {
+			deployed = t.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", r.name, orDash(r.buildNumber), orDash(commit), orDash(r.branch), orDash(r.tag), deployed, outcome, len(r.objects))
+	}
+
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// history is the history command. It lists the releases recorded in the namespace.
+func history(c *cli.Context) error {
+	if err := checkParams(c); err != nil {
+		return err
+	}
+
+	defer removeCredentials()
+	client, err := connectCluster(c)
+	if err != nil {
+		return err
+	}
+
+	releases, err := listReleases(c.String("namespace"), client)
+	if err != nil {
+		return err
+	}
+
+	if len(releases) == 0 {
+		log("No release recorded\n")
+		return nil
+	}
+
+	printReleases(logStdout(), releases)
+	return nil
+}
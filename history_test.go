@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func testHistoryContext() (*flag.FlagSet, *cli.Context) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("namespace", "test-ns", "")
+	set.String("drone-build-number", "12", "")
+	set.String("drone-commit", "4923x0c3380413ec9288e3c0bfbf534b0f18fed1", "")
+	set.String("drone-branch", "main", "")
+	set.String("drone-tag", "", "")
+	set.String("redeploy", "", "")
+	set.Int("history-limit", 2, "")
+	return set, cli.NewContext(nil, set, nil)
+}
+
+// testReleaseJSON returns the live ConfigMap of a release, as printed by kubectl
+func testReleaseJSON(t *testing.T, r *release) string {
+	o, err := r.configMap("test-ns")
+	assert.NoError(t, err)
+	blob, err := json.Marshal(o.object)
+	assert.NoError(t, err)
+	return string(blob)
+}
+
+func TestRelease(t *testing.T) {
+	_, c := testHistoryContext()
+	objects := []*manifestObject{
+		{object: map[string]interface{}{"kind": "Service", "metadata": map[string]interface{}{"name": "app"}}},
+		{object: map[string]interface{}{"kind": "Deployment", "metadata": map[string]interface{}{"name": "app"}}},
+	}
+	now := time.Date(2021, 4, 1, 10, 4, 5, 0, time.UTC)
+
+	r := newRelease(c, objects, []byte("kind: Service\n"), errors.New("Error: 1 of 2 waits failed\n"), now)
+	assert.Regexp(t, "^drone-gke-release-1617271445-[0-9a-f]{6}$", r.name)
+	assert.NotEqual(t, r.name, newRelease(c, objects, nil, nil, now).name)
+	assert.Equal(t, releaseFailed, r.outcome)
+	assert.Equal(t, "Error: 1 of 2 waits failed", r.err)
+	assert.Equal(t, []string{"Service/app", "Deployment/app"}, r.objects)
+
+	// Recorded and parsed back
+	var live map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(testReleaseJSON(t, r)), &live))
+	assert.Equal(t, "true", nestedString(live, "metadata", "labels", releaseLabel))
+	parsed, err := parseRelease(live)
+	assert.NoError(t, err)
+	assert.Equal(t, r, parsed)
+}
+
+func TestRecordRelease(t *testing.T) {
+	_, c := testHistoryContext()
+	r := func(timestamp string) *release {
+		return &release{name: "drone-gke-release-" + timestamp, timestamp: timestamp, outcome: releaseSucceeded, objects: []string{}}
+	}
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "create", "--filename", "/tmp/configmap-drone-gke-release-2021-04-04T10:00:00Z.yml"}).Return(nil).Once()
+	testRunner.On("Output", []string{"kubectl", "get", "configmap", "--selector=drone-gke.nytimes.com/release=true", "-o=json", "--namespace", "test-ns"}).
+		Return(`{"items": [`+strings.Join([]string{
+			testReleaseJSON(t, r("2021-04-04T10:00:00Z")),
+			testReleaseJSON(t, r("2021-04-01T10:00:00Z")),
+			testReleaseJSON(t, r("2021-04-03T10:00:00Z")),
+			testReleaseJSON(t, r("2021-04-02T10:00:00Z")),
+			testReleaseJSON(t, r("2021-03-31T10:00:00Z")),
+		}, ",")+`]}`, nil).Once()
+	testRunner.On("Run", []string{"kubectl", "delete", "configmap/drone-gke-release-2021-04-02T10:00:00Z", "--ignore-not-found", "--wait=true", "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "delete", "configmap/drone-gke-release-2021-04-01T10:00:00Z", "--ignore-not-found", "--wait=true", "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "delete", "configmap/drone-gke-release-2021-03-31T10:00:00Z", "--ignore-not-found", "--wait=true", "--namespace", "test-ns"}).Return(nil).Once()
+
+	assert.NoError(t, recordRelease(c, &kubectlClient{runner: testRunner}, r("2021-04-04T10:00:00Z")))
+	testRunner.AssertExpectations(t)
+}
+
+func TestListReleases(t *testing.T) {
+	r := func(timestamp string) *release {
+		return &release{name: "drone-gke-release-" + timestamp, timestamp: timestamp, outcome: releaseSucceeded, objects: []string{}}
+	}
+
+	// Releases of the same second are ordered by their sub-second time
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "configmap", "--selector=drone-gke.nytimes.com/release=true", "-o=json", "--namespace", "test-ns"}).
+		Return(`{"items": [`+strings.Join([]string{
+			testReleaseJSON(t, r("2021-04-04T10:00:00Z")),
+			testReleaseJSON(t, r("2021-04-04T10:00:00.25Z")),
+			testReleaseJSON(t, r("2021-04-04T10:00:00.5Z")),
+			testReleaseJSON(t, r("2021-04-03T10:00:00Z")),
+		}, ",")+`]}`, nil).Once()
+
+	releases, err := listReleases("test-ns", &kubectlClient{runner: testRunner})
+	assert.NoError(t, err)
+	timestamps := []string{}
+	for _, r := range releases {
+		timestamps = append(timestamps, r.timestamp)
+	}
+	assert.Equal(t, []string{"2021-04-04T10:00:00.5Z", "2021-04-04T10:00:00.25Z", "2021-04-04T10:00:00Z", "2021-04-03T10:00:00Z"}, timestamps)
+	testRunner.AssertExpectations(t)
+}
+
+func TestLoadRelease(t *testing.T) {
+	set, c := testHistoryContext()
+	set.Set("redeploy", "drone-gke-release-1617271445")
+
+	manifest, err := ioutil.TempFile("", "manifest")
+	if err != nil {
+		t.Fatalf("creating the manifest: %s", err)
+	}
+	defer os.Remove(manifest.Name())
+
+	testRunner := new(MockedRunner)
+	get := []string{"kubectl", "get", "configmap/drone-gke-release-1617271445", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}
+	recorded := &release{name: "drone-gke-release-1617271445", buildNumber: "11", manifest: []byte("kind: Deployment\n")}
+	testRunner.On("Output", get).Return(testReleaseJSON(t, recorded), nil).Once()
+	assert.NoError(t, loadRelease(c, &kubectlClient{runner: testRunner}, manifest.Name()))
+
+	blob, err := ioutil.ReadFile(manifest.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Deployment\n", string(blob))
+
+	// Not found
+	testRunner.On("Output", get).Return("", nil).Once()
+	err = loadRelease(c, &kubectlClient{runner: testRunner}, manifest.Name())
+	assert.EqualError(t, err, "Error: release drone-gke-release-1617271445 not found\n")
+	testRunner.AssertExpectations(t)
+}
+
+func TestPrintReleases(t *testing.T) {
+	var output bytes.Buffer
+	printReleases(&output, []*release{
+		{name: "drone-gke-release-1617357845", buildNumber: "13", commit: "8a3f2c1e", branch: "main", timestamp: "2021-04-02T10:04:05.123456789Z", outcome: releaseSucceeded, objects: []string{"Service/app", "Deployment/app"}, redeployOf: "drone-gke-release-1617184445"},
+		{name: "drone-gke-release-1617271445", buildNumber: "12", commit: "4923x0c3380413ec", branch: "main", tag: "v1.2.0", timestamp: "2021-04-01T10:04:05Z", outcome: releaseFailed, objects: []string{"Service/app"}},
+	})
+
+	assert.Equal(t, strings.Join([]string{
+		"RELEASE                       BUILD  COMMIT   BRANCH  TAG     DEPLOYED              OUTCOME                                               OBJECTS",
+		"drone-gke-release-1617357845  13     8a3f2c1  main    -       2021-04-02T10:04:05Z  succeeded (redeploy of drone-gke-release-1617184445)  2",
+		"drone-gke-release-1617271445  12     4923x0c  main    v1.2.0  2021-04-01T10:04:05Z  failed                                                1",
+		"",
+	}, "\n"), output.String())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	hookAnnotation             = annotationPrefix + "hook"
+	hookDeletePolicyAnnotation = annotationPrefix + "hook-delete-policy"
+
+	hookPreDeploy  = "pre-deploy"
+	hookPostDeploy = "post-deploy"
+
+	hookDeleteBeforeCreation = "before-creation"
+	hookDeleteSucceeded      = "succeeded"
+)
+
+// hook returns the hook an object is annotated as, if any
+func (o *manifestObject) hook() string {
+	return nestedString(o.object, "metadata", "annotations", hookAnnotation)
+}
+
+// hookDeletePolicies returns the delete policies a hook is annotated with
+func (o *manifestObject) hookDeletePolicies() []string {
+	policies := []string{}
+	for _, policy := range strings.Split(nestedString(o.object, "metadata", "annotations", hookDeletePolicyAnnotation), ",") {
+		if policy = strings.TrimSpace(policy); policy != "" {
+			policies = append(policies, policy)
+		}
+	}
+	return policies
+}
+
+// validateHooks checks the hook annotations of objects
+func validateHooks(objects []*manifestObject) error {
+	for _, o := range objects {
+		hook := o.hook()
+		if hook == "" {
+			continue
+		}
+
+		if hook != hookPreDeploy && hook != hookPostDeploy {
+			return fmt.Errorf("Error: %s: %s must be one of %s, %s\n", o.location(), hookAnnotation, hookPreDeploy, hookPostDeploy)
+		}
+
+		if o.kind() != "Job" {
+			return fmt.Errorf("Error: %s: only Jobs can be hooks\n", o.location())
+		}
+
+		for _, policy := range o.hookDeletePolicies() {
+			if policy != hookDeleteBeforeCreation && policy != hookDeleteSucceeded {
+				return fmt.Errorf("Error: %s: %s must be a list of %s, %s\n", o.location(), hookDeletePolicyAnnotation, hookDeleteBeforeCreation, hookDeleteSucceeded)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hookObjects returns the objects annotated as the given hook, in manifest order
+func hookObjects(objects []*manifestObject, hook string) []*manifestObject {
+	hooks := []*manifestObject{}
+	for _, o := range objects {
+		if o.hook() == hook {
+			hooks = append(hooks, o)
+		}
+	}
+	return hooks
+}
+
+// withoutHooks filters out the objects annotated as hooks
+func withoutHooks(objects []*manifestObject) []*manifestObject {
+	filtered := []*manifestObject{}
+	for _, o := range objects {
+		if o.hook() == "" {
+			filtered = append(filtered, o)
+		}
+	}
+	return filtered
+}
+
+// runHooks applies hook Jobs one after the other, waiting for each to complete before the next
+func runHooks(c *cli.Context, hooks []*manifestObject, client clusterClient) error {
+	for counter, o := range hooks {
+		log("Running %s hook %s %d/%d\n", o.hook(), o, counter+1, len(hooks))
+
+		m := phaseManifest{phase: workloadsPhase, objects: []*manifestObject{o}}
+		extension := ".yml"
+		if o.file == c.String("secret-template") {
+			m.secret = true
+			extension = ".sec.yml"
+		}
+
+		policies := o.hookDeletePolicies()
+
+		// Jobs are immutable, delete the Job of the previous run
+		if slices.Contains(policies, hookDeleteBeforeCreation) {
+			if err := client.delete(o); err != nil {
+				return fmt.Errorf("Error: %s\n", err)
+			}
+		}
+
+		blob, err := encodeObjects(m.objects)
+		if err != nil {
+			return err
+		}
+
+		m.path = path.Join(templateBasePath, fmt.Sprintf("hook-%s%s", o.name(), extension))
+		if err := ioutil.WriteFile(m.path, blob, 0600); err != nil {
+			return fmt.Errorf("Error writing manifest: %s\n", err)
+		}
+
+		if err := client.apply(m, false); err != nil {
+			return fmt.Errorf("Error: %s\n", err)
+		}
+
+		timeout := time.Duration(c.Int("wait-hooks-seconds")) * time.Second
+		if err := client.waitForJob(objectRef(o), o.namespace(), timeout); err != nil {
+			return fmt.Errorf("Error: %s hook %s did not complete: %s\n", o.hook(), o, err)
+		}
+
+		if slices.Contains(policies, hookDeleteSucceeded) {
+			if err := client.delete(o); err != nil {
+				return fmt.Errorf("Error: %s\n", err)
+			}
+		}
+	}
+
+	return nil
+}
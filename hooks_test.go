@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+const testHookJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    drone-gke.nytimes.com/hook: pre-deploy
+    drone-gke.nytimes.com/hook-delete-policy: before-creation, succeeded
+spec:
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+        - name: migrate
+          image: gcr.io/project/app:1.0
+`
+
+func TestValidateHooks(t *testing.T) {
+	hook := testObject(t, testHookJob)
+	assert.NoError(t, validateHooks([]*manifestObject{hook}))
+	assert.Equal(t, hookPreDeploy, hook.hook())
+	assert.Equal(t, []string{hookDeleteBeforeCreation, hookDeleteSucceeded}, hook.hookDeletePolicies())
+
+	// Unknown hook
+	o := testObject(t, "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: j\n  annotations:\n    drone-gke.nytimes.com/hook: during-deploy\n")
+	assert.Error(t, validateHooks([]*manifestObject{o}))
+
+	// Not a Job
+	o = testObject(t, "apiVersion: v1\nkind: Pod\nmetadata:\n  name: p\n  annotations:\n    drone-gke.nytimes.com/hook: pre-deploy\n")
+	assert.Error(t, validateHooks([]*manifestObject{o}))
+
+	// Unknown delete policy
+	o = testObject(t, "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: j\n  annotations:\n    drone-gke.nytimes.com/hook: post-deploy\n    drone-gke.nytimes.com/hook-delete-policy: failed\n")
+	assert.Error(t, validateHooks([]*manifestObject{o}))
+}
+
+func TestHookObjects(t *testing.T) {
+	hook := testObject(t, testHookJob)
+	deployment := testObject(t, testDeployment)
+	objects := []*manifestObject{deployment, hook}
+
+	assert.Equal(t, []*manifestObject{hook}, hookObjects(objects, hookPreDeploy))
+	assert.Equal(t, []*manifestObject{}, hookObjects(objects, hookPostDeploy))
+	assert.Equal(t, []*manifestObject{deployment}, withoutHooks(objects))
+}
+
+func TestRunHooks(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("secret-template", ".kube.sec.yml", "")
+	set.Int("wait-hooks-seconds", 120, "")
+	c := cli.NewContext(nil, set, nil)
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "delete", "job/migrate", "--ignore-not-found", "--wait=true"}).Return(nil).Twice()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/hook-migrate.yml"}).Return(nil).Once()
+	testRunner.On("Output", []string{"kubectl", "get", "job/migrate", "-o=json"}).Return(testJobComplete, nil).Once()
+	err := runHooks(c, []*manifestObject{testObject(t, testHookJob)}, &kubectlClient{runner: testRunner, runnerSecret: testRunner})
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+
+	// A failed hook aborts the deploy
+	hook := testObject(t, "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: smoke\n  namespace: test-ns\n  annotations:\n    drone-gke.nytimes.com/hook: post-deploy\n")
+	testRunner = new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/hook-smoke.yml"}).Return(nil).Once()
+	testRunner.On("Output", []string{"kubectl", "get", "job/smoke", "-o=json", "--namespace", "test-ns"}).Return("", assert.AnError).Once()
+	err = runHooks(c, []*manifestObject{hook, testObject(t, testHookJob)}, &kubectlClient{runner: testRunner, runnerSecret: testRunner})
+	testRunner.AssertExpectations(t)
+	assert.Error(t, err)
+}
+
+func TestApplyManifestsPreDeployHooks(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("kube-template", ".kube.yml", "")
+	set.String("secret-template", ".kube.sec.yml", "")
+	set.Bool("dry-run", false, "")
+	set.Int("wait-hooks-seconds", 300, "")
+	c := cli.NewContext(nil, set, nil)
+
+	configMap := testObject(t, "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n")
+	objects := []*manifestObject{testObject(t, testDeployment), testObject(t, testHookJob), configMap}
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-4.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-6.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-4.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "delete", "job/migrate", "--ignore-not-found", "--wait=true"}).Return(nil).Twice()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/hook-migrate.yml"}).Return(nil).Once()
+	testRunner.On("Output", []string{"kubectl", "get", "job/migrate", "-o=json"}).Return(testJobComplete, nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-6.yml"}).Return(nil).Once()
+	err := applyManifests(c, objects, nil, &kubectlClient{runner: testRunner, runnerSecret: testRunner}, nil)
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+
+	// The hook runs after the ConfigMap is applied, before the Deployment
+	calls := []string{}
+	for _, call := range testRunner.Calls {
+		calls = append(calls, call.Arguments.Get(0).([]string)[1])
+	}
+	assert.Equal(t, []string{"apply", "apply", "apply", "delete", "apply", "get", "delete", "apply"}, calls)
+	assert.Equal(t, "/tmp/apply-6.yml", testRunner.Calls[7].Arguments.Get(0).([]string)[3])
+
+	// The Deployment alone is applied in the workloads phase
+	applied, err := parseManifest(".kube.yml", "/tmp/apply-6.yml")
+	assert.NoError(t, err)
+	assert.Len(t, applied, 1)
+}
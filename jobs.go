@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// failedPodLogLines is the number of lines of logs printed for each container of the pods of a failed job
+	failedPodLogLines = 50
+)
+
+// jobStatus tells whether a job completed and, if it failed, why
+func jobStatus(j *batchv1.Job) (bool, string) {
+	for _, condition := range j.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return true, ""
+		case batchv1.JobFailed:
+			message := condition.Message
+			if message == "" {
+				message = condition.Reason
+			}
+			if message == "" {
+				message = "unknown reason"
+			}
+			return false, message
+		}
+	}
+
+	return false, ""
+}
+
+// jobPodSelector selects the pods created for a job
+func jobPodSelector(job string) string {
+	return "job-name=" + job
+}
+
+// failedPods returns the pods which failed or have a container which exited with an error, oldest first
+func failedPods(pods []corev1.Pod) []corev1.Pod {
+	failed := []corev1.Pod{}
+	for _, pod := range pods {
+		if pod.Status.Phase == corev1.PodFailed || len(podExits(pod)) > 0 {
+			failed = append(failed, pod)
+		}
+	}
+
+	sort.SliceStable(failed, func(i, j int) bool {
+		return failed[i].CreationTimestamp.Before(&failed[j].CreationTimestamp)
+	})
+
+	return failed
+}
+
+// podExits describes the containers of a pod which exited with an error, e.g.
+// "pod/migrate-x2k4f: container migrate exited with code 1 (Error)"
+func podExits(pod corev1.Pod) []string {
+	exits := []string{}
+
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		terminated := status.State.Terminated
+		if terminated == nil {
+			// The container restarted after exiting
+			terminated = status.LastTerminationState.Terminated
+		}
+		if terminated == nil || terminated.ExitCode == 0 {
+			continue
+		}
+
+		exit := fmt.Sprintf("pod/%s: container %s exited with code %d", pod.Name, status.Name, terminated.ExitCode)
+		if terminated.Reason != "" {
+			exit += fmt.Sprintf(" (%s)", terminated.Reason)
+		}
+		exits = append(exits, exit)
+	}
+
+	return exits
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli/v2"
+)
+
+// parseCommonMetadata parses the common-labels or common-annotations param (in JSON)
+// and renders each value as a template with templateData
+func parseCommonMetadata(c *cli.Context, name string, templateData map[string]interface{}) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	metadataJSON := c.String(name)
+	if metadataJSON == "" {
+		return metadata, nil
+	}
+
+	values := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(metadataJSON), &values); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s\n", name, err)
+	}
+
+	for k, v := range values {
+		tmpl, err := template.New(k).Option("missingkey=error").Parse(fmt.Sprint(v))
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s template for %s: %s\n", name, k, err)
+		}
+
+		var rendered bytes.Buffer
+		if err := tmpl.Execute(&rendered, templateData); err != nil {
+			return nil, fmt.Errorf("Error rendering %s template for %s: %s\n", name, k, err)
+		}
+
+		metadata[k] = rendered.String()
+	}
+
+	return metadata, nil
+}
+
+// addCommonMetadata merges labels and annotations into the metadata of every object,
+// and into the pod template of workloads. Values set by the manifests are kept.
+func addCommonMetadata(objects []*manifestObject, labels, annotations map[string]string) error {
+	for _, o := range objects {
+		metadataPaths := [][]string{{"metadata"}}
+		if template, ok := podTemplateFields(o.kind()); ok {
+			metadataPaths = append(metadataPaths, append(template, "metadata"))
+		}
+
+		for _, metadataPath := range metadataPaths {
+			if err := mergeMetadata(o, metadataPath, "labels", labels); err != nil {
+				return err
+			}
+			if err := mergeMetadata(o, metadataPath, "annotations", annotations); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mergeMetadata adds values missing from the labels or annotations of a metadata field
+func mergeMetadata(o *manifestObject, metadataPath []string, field string, values map[string]string) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	fields := append(append([]string{}, metadataPath...), field)
+	existing, ok := ensureNestedMap(o.object, fields...)
+	if !ok {
+		return fmt.Errorf("Error adding common %s to %s: %s is not a map\n", field, o.location(), strings.Join(fields, "."))
+	}
+
+	for k, v := range values {
+		if _, ok := existing[k]; !ok {
+			existing[k] = v
+		}
+	}
+
+	return nil
+}
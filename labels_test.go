@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseCommonMetadata(t *testing.T) {
+	tmplData := map[string]interface{}{
+		"COMMIT":       "e0f21b90a",
+		"BUILD_NUMBER": "2",
+	}
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("common-labels", `{"app.kubernetes.io/managed-by": "drone-gke", "commit": "{{.COMMIT}}", "build": 2}`, "")
+	c := cli.NewContext(nil, set, nil)
+
+	labels, err := parseCommonMetadata(c, "common-labels", tmplData)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"app.kubernetes.io/managed-by": "drone-gke",
+		"commit":                       "e0f21b90a",
+		"build":                        "2",
+	}, labels)
+
+	// Not set
+	annotations, err := parseCommonMetadata(c, "common-annotations", tmplData)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, annotations)
+
+	// Invalid JSON
+	set = flag.NewFlagSet("test-set", 0)
+	set.String("common-labels", "{", "")
+	c = cli.NewContext(nil, set, nil)
+	_, err = parseCommonMetadata(c, "common-labels", tmplData)
+	assert.Error(t, err)
+
+	// Missing template variable
+	set = flag.NewFlagSet("test-set", 0)
+	set.String("common-labels", `{"branch": "{{.BRANCH}}"}`, "")
+	c = cli.NewContext(nil, set, nil)
+	_, err = parseCommonMetadata(c, "common-labels", tmplData)
+	assert.Error(t, err)
+}
+
+func TestAddCommonMetadata(t *testing.T) {
+	deployment := testObject(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    commit: pinned
+spec:
+  selector:
+    matchLabels:
+      app: echo
+  template:
+    metadata:
+      labels:
+        app: echo
+`)
+	service := testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n")
+
+	labels := map[string]string{"commit": "e0f21b90a", "app.kubernetes.io/managed-by": "drone-gke"}
+	annotations := map[string]string{"build": "2"}
+	err := addCommonMetadata([]*manifestObject{deployment, service}, labels, annotations)
+	assert.NoError(t, err)
+
+	// Labels set by the manifest are kept, selectors are untouched
+	assert.Equal(t, map[string]interface{}{
+		"name":        "app",
+		"labels":      map[string]interface{}{"commit": "pinned", "app.kubernetes.io/managed-by": "drone-gke"},
+		"annotations": map[string]interface{}{"build": "2"},
+	}, deployment.object["metadata"])
+	template, _ := nestedField(deployment.object, "spec", "template", "metadata")
+	assert.Equal(t, map[string]interface{}{
+		"labels":      map[string]interface{}{"app": "echo", "commit": "e0f21b90a", "app.kubernetes.io/managed-by": "drone-gke"},
+		"annotations": map[string]interface{}{"build": "2"},
+	}, template)
+	selector, _ := nestedField(deployment.object, "spec", "selector", "matchLabels")
+	assert.Equal(t, map[string]interface{}{"app": "echo"}, selector)
+
+	assert.Equal(t, map[string]interface{}{
+		"name":        "app",
+		"labels":      map[string]interface{}{"commit": "e0f21b90a", "app.kubernetes.io/managed-by": "drone-gke"},
+		"annotations": map[string]interface{}{"build": "2"},
+	}, service.object["metadata"])
+	_, ok := nestedField(service.object, "spec")
+	assert.False(t, ok)
+
+	// Invalid metadata
+	invalid := testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n  labels: []\n")
+	err = addCommonMetadata([]*manifestObject{invalid}, labels, annotations)
+	assert.Error(t, err)
+}
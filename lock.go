@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// lockName is the name of the Lease locking a namespace while it is deployed to
+	lockName = "drone-gke-lock"
+
+	lockPollInterval = 5 * time.Second
+)
+
+// deployLock is a Lease held by a build while it deploys to a namespace, so that builds deploying
+// to the same namespace do not interleave
+type deployLock struct {
+	lease    *manifestObject
+	identity string
+	// details describe the build holding the lock, as annotations of the Lease
+	details map[string]interface{}
+	wait    time.Duration
+	steal   time.Duration
+	// interval between attempts while the lock is held by another build
+	interval time.Duration
+	// renewal is the interval between the renewals of the Lease while it is held, a third of steal
+	renewal time.Duration
+	held    bool
+	// stopRenewing stops renewing the Lease, once the build releases it
+	stopRenewing func()
+}
+
+// newDeployLock creates the lock of the namespace, if the lock param is set
+func newDeployLock(c *cli.Context) *deployLock {
+	if !c.Bool("lock") {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &deployLock{
+		lease:    objectReference("coordination.k8s.io/v1", "Lease", lockName, c.String("namespace")),
+		identity: fmt.Sprintf("build %s on %s", c.String("drone-build-number"), hostname),
+		details: map[string]interface{}{
+			annotationPrefix + "build-number": c.String("drone-build-number"),
+			annotationPrefix + "commit":       c.String("drone-commit"),
+			annotationPrefix + "branch":       c.String("drone-branch"),
+		},
+		wait:     time.Duration(c.Int("lock-wait-seconds")) * time.Second,
+		steal:    time.Duration(c.Int("lock-steal-seconds")) * time.Second,
+		interval: lockPollInterval,
+		renewal:  time.Duration(c.Int("lock-steal-seconds")) * time.Second / 3,
+	}
+}
+
+// object returns the Lease held by the build, replacing the live Lease if any.
+// A Lease already held by the build is renewed.
+func (l *deployLock) object(live map[string]interface{}) *manifestObject {
+	now := time.Now().UTC().Format(metav1.RFC3339Micro)
+
+	acquired := now
+	if nestedString(live, "spec", "holderIdentity") == l.identity && nestedString(live, "spec", "acquireTime") != "" {
+		acquired = nestedString(live, "spec", "acquireTime")
+	}
+
+	metadata := map[string]interface{}{
+		"name":        lockName,
+		"annotations": l.details,
+	}
+	if namespace := l.lease.namespace(); namespace != "" {
+		metadata["namespace"] = namespace
+	}
+	if resourceVersion, ok := nestedField(live, "metadata", "resourceVersion"); ok {
+		metadata["resourceVersion"] = resourceVersion
+	}
+
+	return &manifestObject{object: map[string]interface{}{
+		"apiVersion": "coordination.k8s.io/v1",
+		"kind":       "Lease",
+		"metadata":   metadata,
+		"spec": map[string]interface{}{
+			"holderIdentity":       l.identity,
+			"acquireTime":          acquired,
+			"renewTime":            now,
+			"leaseDurationSeconds": int(l.steal.Seconds()),
+		},
+	}}
+}
+
+// lockHolder describes the build holding a live Lease, e.g.
+// "build 12 on drone-x2k4f (commit 4923x0c on main) since 2021-04-01T10:04:05Z"
+func lockHolder(live map[string]interface{}) string {
+	holder := nestedString(live, "spec", "holderIdentity")
+	if holder == "" {
+		holder = "an unknown build"
+	}
+
+	commit := nestedString(live, "metadata", "annotations", annotationPrefix+"commit")
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	branch := nestedString(live, "metadata", "annotations", annotationPrefix+"branch")
+	switch {
+	case commit != "" && branch != "":
+		holder += fmt.Sprintf(" (commit %s on %s)", commit, branch)
+	case commit != "":
+		holder += fmt.Sprintf(" (commit %s)", commit)
+	}
+
+	if acquired := nestedString(live, "spec", "acquireTime"); acquired != "" {
+		holder += " since " + acquired
+	}
+
+	return holder
+}
+
+// lockExpired tells whether the Lease was not renewed for its duration, e.g. its build was killed
+func lockExpired(live map[string]interface{}, now time.Time) bool {
+	renewed, err := time.Parse(metav1.RFC3339Micro, nestedString(live, "spec", "renewTime"))
+	if err != nil {
+		// Unknown renew time, steal it
+		return true
+	}
+
+	seconds, _ := nestedInt(live, "spec", "leaseDurationSeconds")
+	return now.After(renewed.Add(time.Duration(seconds) * time.Second))
+}
+
+// acquire waits until the lock is released by the build holding it, or its Lease expired, and takes it,
+// renewing it until it is released. It fails once lock-wait-seconds elapsed or ctx is done.
+func (l *deployLock) acquire(ctx context.Context, client clusterClient) error {
+	deadline := time.Now().Add(l.wait)
+	waitingFor := ""
+
+	for {
+		live, found, err := client.get(l.lease)
+		if err != nil {
+			return fmt.Errorf("Error getting the deploy lock %s: %s\n", l.lease, err)
+		}
+
+		holder := ""
+		if found {
+			holder = nestedString(live, "spec", "holderIdentity")
+		}
+
+		switch {
+		case !found:
+			log("Acquiring the deploy lock %s\n", l.lease)
+			err = client.create(l.object(nil))
+		case holder == l.identity:
+			l.held = true
+			l.renew(client)
+			return nil
+		case lockExpired(live, time.Now()):
+			log("Stealing the deploy lock %s held by %s, it expired\n", l.lease, lockHolder(live))
+			err = client.update(l.object(live))
+		default:
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Error: timed out waiting for the deploy lock %s held by %s\n", l.lease, lockHolder(live))
+			}
+			if waitingFor != holder {
+				log("Waiting for the deploy lock %s held by %s\n", l.lease, lockHolder(live))
+				waitingFor = holder
+			}
+			if err := sleepContext(ctx, l.interval); err != nil {
+				return fmt.Errorf("Error: cancelled waiting for the deploy lock %s held by %s\n", l.lease, lockHolder(live))
+			}
+			continue
+		}
+
+		// Another build may have taken the lock first
+		current, foundNow, getErr := client.get(l.lease)
+		if getErr != nil {
+			return fmt.Errorf("Error getting the deploy lock %s: %s\n", l.lease, getErr)
+		}
+		currentHolder := ""
+		if foundNow {
+			currentHolder = nestedString(current, "spec", "holderIdentity")
+		}
+
+		if currentHolder == l.identity {
+			log("Acquired the deploy lock %s\n", l.lease)
+			l.held = true
+			l.renew(client)
+			return nil
+		}
+		if err != nil && currentHolder == holder {
+			return fmt.Errorf("Error acquiring the deploy lock %s: %s\n", l.lease, err)
+		}
+	}
+}
+
+// renew renews the Lease in the background until it is released, so that it does not expire during a deploy
+// longer than lock-steal-seconds
+func (l *deployLock) renew(client clusterClient) {
+	done, stopped := make(chan struct{}), make(chan struct{})
+	l.stopRenewing = func() {
+		close(done)
+		<-stopped
+	}
+
+	// The renewals are not printed, they would interleave with the output of the deploy
+	client = client.quiet()
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(l.renewal)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			live, found, err := client.get(l.lease)
+			if err != nil {
+				log("Warning: renewing the deploy lock %s: %s\n", l.lease, err)
+				continue
+			}
+			if !found || nestedString(live, "spec", "holderIdentity") != l.identity {
+				log("Warning: the deploy lock %s was stolen\n", l.lease)
+				return
+			}
+			if err := client.update(l.object(live)); err != nil {
+				log("Warning: renewing the deploy lock %s: %s\n", l.lease, err)
+			}
+		}
+	}()
+}
+
+// release stops renewing the Lease and deletes it, if still held by the build
+func (l *deployLock) release(client clusterClient) error {
+	if !l.held {
+		return nil
+	}
+
+	if l.stopRenewing != nil {
+		l.stopRenewing()
+		l.stopRenewing = nil
+	}
+
+	live, found, err := client.get(l.lease)
+	if err != nil {
+		return fmt.Errorf("Error getting the deploy lock %s: %s\n", l.lease, err)
+	}
+	if !found || nestedString(live, "spec", "holderIdentity") != l.identity {
+		log("Warning: the deploy lock %s was stolen\n", l.lease)
+		l.held = false
+		return nil
+	}
+
+	if err := client.delete(l.lease); err != nil {
+		return fmt.Errorf("Error releasing the deploy lock %s: %s\n", l.lease, err)
+	}
+
+	log("Released the deploy lock %s\n", l.lease)
+	l.held = false
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/urfave/cli/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testDeployLock() *deployLock {
+	set := flag.NewFlagSet("test-set", 0)
+	set.Bool("lock", true, "")
+	set.String("namespace", "test-ns", "")
+	set.String("drone-build-number", "12", "")
+	set.String("drone-commit", "4923x0c3380413ec9288e3c0bfbf534b0f18fed1", "")
+	set.String("drone-branch", "main", "")
+	set.Int("lock-wait-seconds", 0, "")
+	set.Int("lock-steal-seconds", 3600, "")
+
+	lock := newDeployLock(cli.NewContext(nil, set, nil))
+	lock.interval = time.Millisecond
+	return lock
+}
+
+func testLease(holder string, renewed time.Time) string {
+	return fmt.Sprintf(`{"metadata": {"name": "drone-gke-lock", "resourceVersion": "7", "annotations": {"drone-gke.nytimes.com/commit": "8a3f2c1e", "drone-gke.nytimes.com/branch": "main"}},
+		"spec": {"holderIdentity": %q, "acquireTime": %q, "renewTime": %q, "leaseDurationSeconds": 3600}}`,
+		holder, renewed.Format(metav1.RFC3339Micro), renewed.Format(metav1.RFC3339Micro))
+}
+
+func TestDeployLock(t *testing.T) {
+	getLease := []string{"kubectl", "get", "lease/drone-gke-lock", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}
+
+	// Acquired, then released
+	lock := testDeployLock()
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", getLease).Return("", nil).Once()
+	testRunner.On("Run", []string{"kubectl", "create", "--filename", "/tmp/lease-drone-gke-lock.yml"}).Return(nil).Once()
+	testRunner.On("Output", getLease).Return(testLease(lock.identity, time.Now()), nil).Twice()
+	testRunner.On("Run", []string{"kubectl", "delete", "lease/drone-gke-lock", "--ignore-not-found", "--wait=true", "--namespace", "test-ns"}).Return(nil).Once()
+	client := &kubectlClient{runner: testRunner}
+	assert.NoError(t, lock.acquire(context.Background(), client))
+	assert.NoError(t, lock.release(client))
+	assert.NoError(t, lock.release(client))
+	testRunner.AssertExpectations(t)
+
+	// Held by another build until the wait timed out
+	lock = testDeployLock()
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", getLease).Return(testLease("build 11 on drone-x2k4f", time.Now()), nil).Once()
+	err := lock.acquire(context.Background(), &kubectlClient{runner: testRunner})
+	assert.Contains(t, err.Error(), "Error: timed out waiting for the deploy lock Lease/drone-gke-lock held by build 11 on drone-x2k4f (commit 8a3f2c1 on main) since ")
+	testRunner.AssertExpectations(t)
+
+	// Stolen once expired
+	lock = testDeployLock()
+	acquired := time.Date(2021, 4, 1, 10, 4, 5, 0, time.UTC)
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", getLease).Return(testLease("build 11 on drone-x2k4f", acquired), nil).Once()
+	testRunner.On("Run", []string{"kubectl", "replace", "--filename", "/tmp/lease-drone-gke-lock.yml"}).Return(nil).Once()
+	testRunner.On("Output", getLease).Return(testLease(lock.identity, time.Now()), nil).Once()
+	assert.NoError(t, lock.acquire(context.Background(), &kubectlClient{runner: testRunner}))
+	lock.stopRenewing()
+	testRunner.AssertExpectations(t)
+
+	// Another build created it first
+	lock = testDeployLock()
+	lock.wait = time.Hour
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", getLease).Return("", nil).Once()
+	testRunner.On("Run", []string{"kubectl", "create", "--filename", "/tmp/lease-drone-gke-lock.yml"}).Return(fmt.Errorf("exit status 1")).Once()
+	testRunner.On("Output", getLease).Return(testLease("build 13 on drone-b7d9q", time.Now()), nil).Twice()
+	testRunner.On("Output", getLease).Return("", nil).Once()
+	testRunner.On("Run", []string{"kubectl", "create", "--filename", "/tmp/lease-drone-gke-lock.yml"}).Return(nil).Once()
+	testRunner.On("Output", getLease).Return(testLease(lock.identity, time.Now()), nil).Once()
+	assert.NoError(t, lock.acquire(context.Background(), &kubectlClient{runner: testRunner}))
+	lock.stopRenewing()
+	testRunner.AssertExpectations(t)
+
+	// Failed to create it
+	lock = testDeployLock()
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", getLease).Return("", nil).Twice()
+	testRunner.On("Run", []string{"kubectl", "create", "--filename", "/tmp/lease-drone-gke-lock.yml"}).Return(fmt.Errorf("exit status 1")).Once()
+	err = lock.acquire(context.Background(), &kubectlClient{runner: testRunner})
+	assert.EqualError(t, err, "Error acquiring the deploy lock Lease/drone-gke-lock: exit status 1\n")
+	testRunner.AssertExpectations(t)
+}
+
+func TestDeployLockRenewal(t *testing.T) {
+	getLease := []string{"kubectl", "get", "lease/drone-gke-lock", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}
+	acquired := time.Now().Add(-time.Hour)
+
+	// Renewed until released, keeping the time it was acquired
+	lock := testDeployLock()
+	lock.renewal = 10 * time.Millisecond
+	renewed := make(chan struct{})
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", getLease).Return(testLease(lock.identity, acquired), nil)
+	testRunner.On("Run", []string{"kubectl", "replace", "--filename", "/tmp/lease-drone-gke-lock.yml"}).Return(nil).Once().Run(func(mock.Arguments) {
+		blob, err := ioutil.ReadFile("/tmp/lease-drone-gke-lock.yml")
+		assert.NoError(t, err)
+		assert.Contains(t, string(blob), acquired.UTC().Format(metav1.RFC3339Micro))
+		close(renewed)
+	})
+	testRunner.On("Run", []string{"kubectl", "replace", "--filename", "/tmp/lease-drone-gke-lock.yml"}).Return(nil)
+	testRunner.On("Run", []string{"kubectl", "delete", "lease/drone-gke-lock", "--ignore-not-found", "--wait=true", "--namespace", "test-ns"}).Return(nil).Once()
+	client := &kubectlClient{runner: testRunner}
+	assert.NoError(t, lock.acquire(context.Background(), client))
+	<-renewed
+	assert.NoError(t, lock.release(client))
+	testRunner.AssertExpectations(t)
+}
+
+func TestDeployLockRenewalQuiet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A kubectl printing the Lease held by the build, and recording its replacements
+	lock := testDeployLock()
+	lock.renewal = 10 * time.Millisecond
+	lease, replaced := filepath.Join(dir, "lease.json"), filepath.Join(dir, "replaced")
+	assert.NoError(t, ioutil.WriteFile(lease, []byte(testLease(lock.identity, time.Now())), 0644))
+	script := "#!/bin/sh\ncase $1 in get) cat " + lease + ";; replace) echo replaced; touch " + replaced + ";; esac\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte(script), 0755))
+	defer func(cmd string) { kubectlCmd = cmd }(kubectlCmd)
+	kubectlCmd = filepath.Join(dir, "kubectl")
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	printed := make(chan string)
+	go func() {
+		blob, _ := ioutil.ReadAll(r)
+		printed <- string(blob)
+	}()
+
+	runner := NewRetryRunner(NewBasicRunner("", os.Environ(), os.Stdout, os.Stderr), 1, time.Second)
+	lock.renew(&kubectlClient{runner: runner, runnerSecret: runner})
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(replaced); err == nil {
+			break
+		}
+	}
+	lock.stopRenewing()
+
+	os.Stdout = stdout
+	w.Close()
+	assert.FileExists(t, replaced)
+	assert.Empty(t, <-printed)
+}
+
+func TestDeployLockCancelled(t *testing.T) {
+	getLease := []string{"kubectl", "get", "lease/drone-gke-lock", "--ignore-not-found", "-o=json", "--namespace", "test-ns"}
+
+	lock := testDeployLock()
+	lock.wait, lock.interval = time.Hour, time.Hour
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", getLease).Return(testLease("build 11 on drone-x2k4f", time.Now()), nil).Once()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := lock.acquire(ctx, &kubectlClient{runner: testRunner})
+	assert.Contains(t, err.Error(), "Error: cancelled waiting for the deploy lock Lease/drone-gke-lock held by build 11 on drone-x2k4f")
+	testRunner.AssertExpectations(t)
+}
+
+func TestLockExpired(t *testing.T) {
+	renewed := time.Date(2021, 4, 1, 10, 0, 0, 0, time.UTC)
+	var live map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(testLease("build 11", renewed)), &live))
+
+	assert.False(t, lockExpired(live, renewed.Add(59*time.Minute)))
+	assert.True(t, lockExpired(live, renewed.Add(61*time.Minute)))
+	assert.True(t, lockExpired(map[string]interface{}{}, renewed))
+}
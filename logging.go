@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	levelInfo    = "info"
+	levelWarning = "warning"
+	levelError   = "error"
+)
+
+var (
+	// logFormat is the format of the output, set by the log-format param
+	logFormat = logFormatText
+	// logOutput receives the events of the json log-format
+	logOutput io.Writer = os.Stdout
+
+	// logMu serializes the events, written by the concurrent waits
+	logMu sync.Mutex
+	// logPhase is the phase of the run the events belong to
+	logPhase string
+)
+
+// sensitiveArgRegex matches the flags whose value is redacted from the logged commands, e.g. --token=...
+var sensitiveArgRegex = regexp.MustCompile(`(?i)^(--?[a-z0-9-]*(token|password|secret)[a-z0-9-]*)(=.*)?$`)
+
+// logEvent is a line of the json log-format
+type logEvent struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Phase   string `json:"phase,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Command is the program run, with its sensitive args redacted
+	Command string `json:"command,omitempty"`
+	// Duration is the duration of the command or wait, in seconds
+	Duration *float64 `json:"duration,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+	Resource string   `json:"resource,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// setLogFormat validates and sets the log-format param
+func setLogFormat(c *cli.Context) error {
+	switch format := c.String("log-format"); format {
+	case "", logFormatText:
+		logFormat = logFormatText
+	case logFormatJSON:
+		logFormat = logFormatJSON
+	default:
+		return fmt.Errorf("Invalid param log-format: must be one of %s, %s", logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// setLogPhase sets the phase of the run the following events belong to, e.g. apply
+func setLogPhase(phase string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logPhase = phase
+}
+
+// emit writes an event of the json log-format
+func emit(e logEvent) {
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	e.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	if e.Level == "" {
+		e.Level = levelInfo
+	}
+	if e.Phase == "" {
+		e.Phase = logPhase
+	}
+
+	blob, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	logOutput.Write(append(blob, '\n'))
+}
+
+// messageLevel infers the level of a logged message from its prefix, e.g. Warning:
+func messageLevel(message string) string {
+	switch {
+	case strings.HasPrefix(message, "Warning"):
+		return levelWarning
+	case strings.HasPrefix(message, "Error"):
+		return levelError
+	}
+	return levelInfo
+}
+
+// logCommand logs a program run by a runner, once it exited after duration
+func logCommand(args []string, duration time.Duration, err error) {
+	seconds := duration.Seconds()
+	exitCode := exitCode(err)
+
+	e := logEvent{Command: strings.Join(redactArgs(args), " "), Duration: &seconds, ExitCode: &exitCode}
+	if err != nil {
+		e.Level = levelError
+		e.Error = err.Error()
+	}
+	emit(e)
+}
+
+// redactArgs returns args with the values of the sensitive flags redacted
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+
+	for i := 0; i < len(redacted); i++ {
+		m := sensitiveArgRegex.FindStringSubmatch(redacted[i])
+		if m == nil {
+			continue
+		}
+		if m[3] != "" {
+			redacted[i] = m[1] + "=REDACTED"
+		} else if i+1 < len(redacted) {
+			redacted[i+1] = "REDACTED"
+			i++
+		}
+	}
+
+	return redacted
+}
+
+// logStdout returns the writer of the output to print, which is written as events in the json log-format
+func logStdout() io.Writer {
+	if logFormat == logFormatJSON {
+		return newEventWriter(logEvent{Level: levelInfo})
+	}
+	return os.Stdout
+}
+
+// logStderr returns the writer of the error output to print, which is written as events in the json log-format
+func logStderr() io.Writer {
+	if logFormat == logFormatJSON {
+		return newEventWriter(logEvent{Level: levelError})
+	}
+	return os.Stderr
+}
+
+// eventWriter writes each line written to it as the message of an event
+type eventWriter struct {
+	event logEvent
+	mu    sync.Mutex
+	line  bytes.Buffer
+}
+
+func newEventWriter(event logEvent) *eventWriter {
+	return &eventWriter{event: event}
+}
+
+func (e *eventWriter) Write(data []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, b := range data {
+		if b != '\n' {
+			e.line.WriteByte(b)
+			continue
+		}
+		e.writeLine()
+	}
+	return len(data), nil
+}
+
+// Flush writes the last line, if not terminated by a newline
+func (e *eventWriter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.line.Len() > 0 {
+		e.writeLine()
+	}
+	return nil
+}
+
+func (e *eventWriter) writeLine() {
+	event := e.event
+	event.Message = strings.TrimRight(e.line.String(), "\r")
+	e.line.Reset()
+
+	if strings.TrimSpace(event.Message) != "" {
+		emit(event)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+// captureEvents switches to the json log-format, returning the events logged until restore is called
+func captureEvents(t *testing.T) (events func() []map[string]interface{}, restore func()) {
+	var output bytes.Buffer
+	previous := logOutput
+	logFormat, logOutput = logFormatJSON, &output
+
+	events = func() []map[string]interface{} {
+		parsed := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+			var e map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("parsing the event %q: %s", line, err)
+			}
+			delete(e, "time")
+			parsed = append(parsed, e)
+		}
+		output.Reset()
+		return parsed
+	}
+	restore = func() {
+		logFormat, logOutput, logPhase = logFormatText, previous, ""
+	}
+	return events, restore
+}
+
+func TestSetLogFormat(t *testing.T) {
+	defer func() { logFormat = logFormatText }()
+
+	for format, valid := range map[string]bool{"": true, "text": true, "json": true, "yaml": false} {
+		set := flag.NewFlagSet("test-set", 0)
+		set.String("log-format", format, "")
+		err := setLogFormat(cli.NewContext(nil, set, nil))
+		if valid {
+			assert.NoError(t, err, format)
+		} else {
+			assert.EqualError(t, err, "Invalid param log-format: must be one of text, json", format)
+		}
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	events, restore := captureEvents(t)
+	defer restore()
+
+	setLogPhase("apply")
+	log("Applying %s\n", "workloads")
+	log("Warning: the deploy lock Lease/drone-gke-lock was stolen\n")
+	assert.Equal(t, []map[string]interface{}{
+		{"level": "info", "phase": "apply", "message": "Applying workloads"},
+		{"level": "warning", "phase": "apply", "message": "Warning: the deploy lock Lease/drone-gke-lock was stolen"},
+	}, events())
+
+	// Commands, their output and errors
+	stdout := logStdout()
+	e := NewBasicRunner("/tmp", []string{}, stdout, logStderr())
+	assert.NoError(t, e.Run(context.Background(), "/bin/echo", "hello, gke"))
+	assert.Error(t, e.Run(context.Background(), "/bin/sh", "-c", "echo oops >&2; exit 3", "--token=abc"))
+
+	logged := events()
+	assert.Len(t, logged, 4)
+	assert.Equal(t, map[string]interface{}{"level": "info", "phase": "apply", "message": "hello, gke"}, logged[0])
+	assert.Equal(t, "/bin/echo hello, gke", logged[1]["command"])
+	assert.Equal(t, float64(0), logged[1]["exit_code"])
+	assert.Contains(t, logged[1], "duration")
+	assert.Equal(t, map[string]interface{}{"level": "error", "phase": "apply", "message": "oops"}, logged[2])
+	assert.Equal(t, "error", logged[3]["level"])
+	assert.Equal(t, "/bin/sh -c echo oops >&2; exit 3 --token=REDACTED", logged[3]["command"])
+	assert.Equal(t, float64(3), logged[3]["exit_code"])
+	assert.Equal(t, "exit status 3", logged[3]["error"])
+
+	// Wait results
+	logWaitResults([]waitResult{
+		{wait: resourceWait{resource: "service/app"}, addresses: []string{"34.1.2.3"}},
+		{wait: resourceWait{resource: "job/migrate"}, err: errors.New("timed out waiting for job/migrate")},
+	})
+	assert.Equal(t, []map[string]interface{}{
+		{"level": "info", "phase": "apply", "resource": "service/app", "duration": float64(0), "message": "passed, addresses 34.1.2.3"},
+		{"level": "error", "phase": "apply", "resource": "job/migrate", "duration": float64(0), "message": "failed", "error": "timed out waiting for job/migrate"},
+	}, events())
+}
+
+func TestRedactArgs(t *testing.T) {
+	assert.Equal(t,
+		[]string{"kubectl", "--token=REDACTED", "--password", "REDACTED", "--key-file", "/tmp/gcloud.json", "get", "secret/app"},
+		redactArgs([]string{"kubectl", "--token=abc", "--password", "def", "--key-file", "/tmp/gcloud.json", "get", "secret/app"}))
+}
+
+func TestEventWriter(t *testing.T) {
+	events, restore := captureEvents(t)
+	defer restore()
+
+	w := newEventWriter(logEvent{Level: levelInfo, Resource: "deployment/app"})
+	w.Write([]byte("Waiting for deployment \"app\" rollout to finish\ndeployment \"app\" "))
+	w.Write([]byte("successfully rolled out"))
+	w.Flush()
+
+	assert.Equal(t, []map[string]interface{}{
+		{"level": "info", "resource": "deployment/app", "message": "Waiting for deployment \"app\" rollout to finish"},
+		{"level": "info", "resource": "deployment/app", "message": "deployment \"app\" successfully rolled out"},
+	}, events())
+}
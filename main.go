@@ -3,18 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
@@ -33,7 +39,6 @@ var (
 const (
 	gcloudCmd      = "gcloud"
 	kubectlCmdName = "kubectl"
-	timeoutCmd     = "timeout"
 
 	keyPath          = "/tmp/gcloud.json"
 	nsPath           = "/tmp/namespace.json"
@@ -44,6 +49,9 @@ const (
 	serverSideDryRunFlagPre118  = "--server-dry-run=true"
 	serverSideDryRunFlagDefault = "--dry-run=server"
 	serverSideApplyFlag         = "--server-side"
+
+	// secretPlaceholder replaces secret values in render-only mode ("REDACTED", base64 encoded)
+	secretPlaceholder = "UkVEQUNURUQ="
 )
 
 // default to kubectlCmdName, can be overriden via kubectl-version param
@@ -58,11 +66,16 @@ metadata:
 `
 var invalidNameRegex = regexp.MustCompile(`[^a-z0-9\.\-]+`)
 var dryRunFlag = clientSideDryRunFlagDefault
+var secretRefRegex = regexp.MustCompile(`\.(SECRET_[A-Za-z0-9_]+)`)
 
 func main() {
 	err := wrapMain()
 	if err != nil {
-		fmt.Println(err)
+		if logFormat == logFormatJSON {
+			emit(logEvent{Level: levelError, Error: strings.TrimSpace(err.Error())})
+		} else {
+			fmt.Println(err)
+		}
 		os.Exit(1)
 	}
 }
@@ -79,11 +92,33 @@ func getAppFlags() []cli.Flag {
 			Usage:   "perform a server-side apply",
 			EnvVars: []string{"PLUGIN_SERVER_SIDE"},
 		},
+		&cli.StringFlag{
+			Name:    "backend",
+			Usage:   "apply and wait for the manifests with kubectl, or client-go calling the Kubernetes API (always applying server-side)",
+			EnvVars: []string{"PLUGIN_BACKEND"},
+			Value:   backendKubectl,
+		},
 		&cli.BoolFlag{
 			Name:    "verbose",
 			Usage:   "dump available vars and the generated Kubernetes manifest, keeping secrets hidden",
 			EnvVars: []string{"PLUGIN_VERBOSE"},
 		},
+		&cli.StringFlag{
+			Name:    "log-format",
+			Usage:   "format of the output, text or json for one JSON object per event",
+			EnvVars: []string{"PLUGIN_LOG_FORMAT"},
+			Value:   logFormatText,
+		},
+		&cli.StringFlag{
+			Name:    "otlp-endpoint",
+			Usage:   "URL of the OTLP/HTTP collector to export the trace of the deploy to, e.g. http://otel-collector:4318",
+			EnvVars: []string{"PLUGIN_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_ENDPOINT"},
+		},
+		&cli.StringFlag{
+			Name:    "traceparent",
+			Usage:   "W3C trace context of the parent span of the trace of the deploy",
+			EnvVars: []string{"PLUGIN_TRACEPARENT", "TRACEPARENT"},
+		},
 		&cli.StringFlag{
 			Name:    "token",
 			Usage:   "service account's `JSON` credentials",
@@ -185,7 +220,7 @@ func getAppFlags() []cli.Flag {
 		},
 		&cli.StringSliceFlag{
 			Name:    "wait-jobs",
-			Usage:   "list of Jobs to wait for successful completion using kubectl wait",
+			Usage:   "list of Jobs to wait for successful completion, failing as soon as one fails",
 			EnvVars: []string{"PLUGIN_WAIT_JOBS"},
 		},
 		&cli.IntFlag{
@@ -194,6 +229,197 @@ func getAppFlags() []cli.Flag {
 			EnvVars: []string{"PLUGIN_WAIT_JOBS_SECONDS"},
 			Value:   0,
 		},
+		&cli.StringFlag{
+			Name:    "wait-for",
+			Usage:   "list of resources to wait for until a condition is met using kubectl wait in `JSON` format, e.g. [{\"resource\": \"certificate/app\", \"for\": \"condition=Ready\"}]",
+			EnvVars: []string{"PLUGIN_WAIT_FOR"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "wait-addresses",
+			Usage:   "list of Services and Ingresses to wait for until their load balancer has an address",
+			EnvVars: []string{"PLUGIN_WAIT_ADDRESSES"},
+		},
+		&cli.IntFlag{
+			Name:    "wait-addresses-seconds",
+			Usage:   "if wait-addresses is set, number of seconds to wait before failing the build",
+			EnvVars: []string{"PLUGIN_WAIT_ADDRESSES_SECONDS"},
+			Value:   300,
+		},
+		&cli.StringFlag{
+			Name:    "outputs-file",
+			Usage:   "file to write the addresses of wait-addresses to, in `JSON` format",
+			EnvVars: []string{"PLUGIN_OUTPUTS_FILE"},
+		},
+		&cli.IntFlag{
+			Name:    "wait-hooks-seconds",
+			Usage:   "number of seconds to wait for each pre-deploy and post-deploy hook Job to complete before failing the build",
+			EnvVars: []string{"PLUGIN_WAIT_HOOKS_SECONDS"},
+			Value:   300,
+		},
+		&cli.StringFlag{
+			Name:    "smoke-tests",
+			Usage:   "list of HTTP requests to check once the rollouts completed in `JSON` format, urls and headers are templates",
+			EnvVars: []string{"PLUGIN_SMOKE_TESTS"},
+		},
+		&cli.BoolFlag{
+			Name:    "smoke-tests-rollback",
+			Usage:   "roll back wait-deployments if a smoke test fails",
+			EnvVars: []string{"PLUGIN_SMOKE_TESTS_ROLLBACK"},
+		},
+		&cli.StringFlag{
+			Name:    "canary",
+			Usage:   "name of a Deployment to deploy a canary of first, promoted once it rolled out and passed canary-smoke-tests",
+			EnvVars: []string{"PLUGIN_CANARY"},
+		},
+		&cli.StringFlag{
+			Name:    "canary-replicas",
+			Usage:   "number of replicas of the canary, or percentage of the replicas of its Deployment, e.g. 10%",
+			EnvVars: []string{"PLUGIN_CANARY_REPLICAS"},
+			Value:   "1",
+		},
+		&cli.StringFlag{
+			Name:    "canary-smoke-tests",
+			Usage:   "list of HTTP requests to check once the canary rolled out in `JSON` format, as smoke-tests",
+			EnvVars: []string{"PLUGIN_CANARY_SMOKE_TESTS"},
+		},
+		&cli.StringFlag{
+			Name:    "blue-green",
+			Usage:   "name of a Deployment to deploy as <name>-blue and <name>-green in turn, switching its Services to the color deployed once it rolled out",
+			EnvVars: []string{"PLUGIN_BLUE_GREEN"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "blue-green-services",
+			Usage:   "list of Services to switch between the colors of the blue-green Deployment (default: the Service named as the Deployment)",
+			EnvVars: []string{"PLUGIN_BLUE_GREEN_SERVICES"},
+		},
+		&cli.IntFlag{
+			Name:    "blue-green-grace-seconds",
+			Usage:   "number of seconds to keep the previous color scaled after the switch before scaling it to zero, negative to keep it scaled",
+			EnvVars: []string{"PLUGIN_BLUE_GREEN_GRACE_SECONDS"},
+			Value:   -1,
+		},
+		&cli.BoolFlag{
+			Name:    "lock",
+			Usage:   "hold a Lease in the namespace while deploying, waiting for the deploys of other builds to the namespace to complete",
+			EnvVars: []string{"PLUGIN_LOCK"},
+		},
+		&cli.IntFlag{
+			Name:    "lock-wait-seconds",
+			Usage:   "if lock is set, number of seconds to wait for the lock held by another build before failing the build",
+			EnvVars: []string{"PLUGIN_LOCK_WAIT_SECONDS"},
+			Value:   600,
+		},
+		&cli.IntFlag{
+			Name:    "lock-steal-seconds",
+			Usage:   "if lock is set, number of seconds after which the lock of a build which did not renew it, e.g. killed, may be stolen",
+			EnvVars: []string{"PLUGIN_LOCK_STEAL_SECONDS"},
+			Value:   3600,
+		},
+		&cli.BoolFlag{
+			Name:    "history",
+			Usage:   "record each deploy as a release in a ConfigMap of the namespace",
+			EnvVars: []string{"PLUGIN_HISTORY"},
+		},
+		&cli.IntFlag{
+			Name:    "history-limit",
+			Usage:   "if history is set, number of releases to keep",
+			EnvVars: []string{"PLUGIN_HISTORY_LIMIT"},
+			Value:   10,
+		},
+		&cli.StringFlag{
+			Name:    "redeploy",
+			Usage:   "name of a recorded release to deploy the manifest of, in place of the rendered kube-template",
+			EnvVars: []string{"PLUGIN_REDEPLOY"},
+		},
+		&cli.IntFlag{
+			Name:    "retry-attempts",
+			Usage:   "number of times to attempt the gcloud and kubectl commands which fail with a transient error, e.g. a TLS handshake timeout",
+			EnvVars: []string{"PLUGIN_RETRY_ATTEMPTS"},
+			Value:   3,
+		},
+		&cli.IntFlag{
+			Name:    "retry-backoff-seconds",
+			Usage:   "number of seconds to wait before the first retry of a command, doubled for each retry",
+			EnvVars: []string{"PLUGIN_RETRY_BACKOFF_SECONDS"},
+			Value:   2,
+		},
+		&cli.IntFlag{
+			Name:    "wait-deadline-seconds",
+			Usage:   "number of seconds to wait for all of wait-deployments, wait-jobs, wait-for, wait-addresses and the replaced jobs, which are waited for concurrently",
+			EnvVars: []string{"PLUGIN_WAIT_DEADLINE_SECONDS"},
+			Value:   0,
+		},
+		&cli.BoolFlag{
+			Name:    "replace-jobs",
+			Usage:   "delete and recreate Jobs whose rendered spec changed since they were applied, then wait for them to complete",
+			EnvVars: []string{"PLUGIN_REPLACE_JOBS"},
+		},
+		&cli.BoolFlag{
+			Name:    "render-only",
+			Usage:   "only render the templates to output-dir, without credentials or access to the cluster",
+			EnvVars: []string{"PLUGIN_RENDER_ONLY"},
+		},
+		&cli.StringFlag{
+			Name:    "output-dir",
+			Usage:   "if render-only is set, directory to write the rendered manifests to",
+			EnvVars: []string{"PLUGIN_OUTPUT_DIR"},
+			Value:   "rendered",
+		},
+		&cli.BoolFlag{
+			Name:    "validate-schemas",
+			Usage:   "validate the rendered manifests against the bundled Kubernetes schemas before fetching credentials",
+			EnvVars: []string{"PLUGIN_VALIDATE_SCHEMAS"},
+		},
+		&cli.StringFlag{
+			Name:    "deprecated-apis",
+			Usage:   "check the rendered manifests for deprecated or removed APIs, either 'warn' or 'fail' when found",
+			EnvVars: []string{"PLUGIN_DEPRECATED_APIS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "policies",
+			Usage:   "list of built-in policies the rendered manifests must comply with: no-latest-tag, require-resources, no-privileged, allowed-registries",
+			EnvVars: []string{"PLUGIN_POLICIES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "allowed-registries",
+			Usage:   "if the allowed-registries policy is enabled, list of image prefixes containers may use",
+			EnvVars: []string{"PLUGIN_ALLOWED_REGISTRIES"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "policy-files",
+			Usage:   "list of YAML files with policy rules the rendered manifests must comply with",
+			EnvVars: []string{"PLUGIN_POLICY_FILES"},
+		},
+		&cli.StringFlag{
+			Name:    "kubernetes-version",
+			Usage:   "Kubernetes version to check the rendered manifests for, e.g. 1.34 (default: latest bundled schemas, version of the cluster for deprecated APIs)",
+			EnvVars: []string{"PLUGIN_KUBERNETES_VERSION"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "crd-schemas",
+			Usage:   "list of CustomResourceDefinition manifests providing the schemas of custom resources",
+			EnvVars: []string{"PLUGIN_CRD_SCHEMAS"},
+		},
+		&cli.StringFlag{
+			Name:    "common-labels",
+			Usage:   "labels to add to every object and pod template in `JSON` format, values are templates",
+			EnvVars: []string{"PLUGIN_COMMON_LABELS"},
+		},
+		&cli.StringFlag{
+			Name:    "common-annotations",
+			Usage:   "annotations to add to every object and pod template in `JSON` format, values are templates",
+			EnvVars: []string{"PLUGIN_COMMON_ANNOTATIONS"},
+		},
+		&cli.BoolFlag{
+			Name:    "pin-image-digests",
+			Usage:   "resolve every container image to the digest its tag points to before applying the manifests",
+			EnvVars: []string{"PLUGIN_PIN_IMAGE_DIGESTS"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "insecure-registries",
+			Usage:   "if pin-image-digests is set, list of registries to access over plain HTTP",
+			EnvVars: []string{"PLUGIN_INSECURE_REGISTRIES"},
+		},
 		&cli.StringFlag{
 			Name:    "kubectl-version",
 			Usage:   "optional - version of kubectl binary to use, e.g. 1.14",
@@ -211,38 +437,73 @@ func wrapMain() error {
 		rev = "[unknown]"
 	}
 
-	fmt.Printf("Drone GKE Plugin built from %s\n", rev)
-
 	app := cli.NewApp()
 	app.Name = "gke plugin"
 	app.Usage = "gke plugin"
+	app.Before = func(c *cli.Context) error {
+		if err := setLogFormat(c); err != nil {
+			return err
+		}
+		fmt.Fprintf(logStdout(), "Drone GKE Plugin built from %s\n", rev)
+		return nil
+	}
 	app.Action = run
 	app.Version = fmt.Sprintf("%s-%s", version, rev)
 	app.Flags = getAppFlags()
+	app.Commands = []*cli.Command{
+		{
+			Name:   "history",
+			Usage:  "list the releases recorded in the namespace",
+			Action: history,
+		},
+		{
+			Name:   "flip-back",
+			Usage:  "switch the Services of the blue-green Deployment back to its previous color",
+			Action: flipBack,
+		},
+	}
+
+	// Cancel the commands once the Drone agent stops the build
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	return app.Run(os.Args)
+	return app.RunContext(ctx, os.Args)
 }
 
-func run(c *cli.Context) error {
+func run(c *cli.Context) (err error) {
+	// Summarize the phases once the deploy completed, after its cleanup
+	resetPhases()
+	defer func() {
+		endPhase(err)
+		printPhases()
+		finishTracing(c, err)
+	}()
+
+	// Trace the deploy if a collector is configured
+	if err := startTracing(c); err != nil {
+		return err
+	}
+
 	// Check required params
 	if err := checkParams(c); err != nil {
 		return err
 	}
 
+	renderOnly := c.Bool("render-only")
 	token := decodeToken(c.String("token"))
 
 	// Use project if explicitly stated, otherwise infer from the service account token.
 	project := c.String("project")
-	if project == "" {
+	if project == "" && token != "" {
 		log("Parsing Project ID from credentials\n")
 		project = getProjectFromToken(token)
-		if project == "" {
-			return fmt.Errorf("Missing required param: project")
-		}
+	}
+	if project == "" && !renderOnly {
+		return fmt.Errorf("Missing required param: project")
 	}
 
 	// Parse skipping template processing.
-	err := parseSkips(c)
+	err = parseSkips(c)
 	if err != nil {
 		return err
 	}
@@ -254,13 +515,15 @@ func run(c *cli.Context) error {
 	}
 
 	// Parse and adjust the dry-run flag if needed
-	var dryRunBuffer bytes.Buffer
-	dryRunRunner := NewBasicRunner("/", []string{}, &dryRunBuffer, &dryRunBuffer)
-	if err := setDryRunFlag(dryRunRunner, &dryRunBuffer, c); err != nil {
-		return err
+	if !renderOnly {
+		dryRunRunner := NewBasicRunner("/", []string{}, nil, nil)
+		if err := setDryRunFlag(dryRunRunner, c); err != nil {
+			return err
+		}
 	}
 
 	// Parse variables and secrets
+	startPhase("render")
 	vars, err := parseVars(c)
 	if err != nil {
 		return err
@@ -271,25 +534,13 @@ func run(c *cli.Context) error {
 		return err
 	}
 
-	// Setup execution environment
-	environ := os.Environ()
-	environ = append(environ, fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", keyPath))
-	runner := NewBasicRunner("", environ, os.Stdout, os.Stderr)
-
-	// Auth with gcloud and fetch kubectl credentials
-	if err := fetchCredentials(c, token, project, runner); err != nil {
-		return err
-	}
-
-	// Delete credentials from filesystem when finishing
-	// Warn if the keyfile can't be deleted, but don't abort.
-	// We're almost certainly running inside an ephemeral container, so the file will be discarded when we're finished anyway.
-	defer func() {
-		err := os.Remove(keyPath)
+	// Secrets never end up in rendered build artifacts
+	if renderOnly {
+		secrets, err = renderOnlySecrets(c, secrets)
 		if err != nil {
-			log("Warning: error removing token file: %s\n", err)
+			return err
 		}
-	}()
+	}
 
 	// Build template data maps
 	templateData, secretsData, secretsDataRedacted, err := templateData(c, project, vars, secrets)
@@ -299,8 +550,9 @@ func run(c *cli.Context) error {
 
 	// Print variables and secret keys
 	if c.Bool("verbose") {
-		dumpData(os.Stdout, "VARIABLES AVAILABLE FOR ALL TEMPLATES", templateData)
-		dumpData(os.Stdout, "ADDITIONAL SECRET VARIABLES AVAILABLE FOR .sec.yml TEMPLATES", secretsDataRedacted)
+		out := logStdout()
+		dumpData(out, "VARIABLES AVAILABLE FOR ALL TEMPLATES", templateData)
+		dumpData(out, "ADDITIONAL SECRET VARIABLES AVAILABLE FOR .sec.yml TEMPLATES", secretsDataRedacted)
 	}
 
 	// Render manifest templates
@@ -309,26 +561,235 @@ func run(c *cli.Context) error {
 		return err
 	}
 
+	// Replace the rendered kube-template with the manifest of a recorded release
+	if c.String("redeploy") != "" {
+		defer removeCredentials()
+		client, err := connectCluster(c)
+		if err != nil {
+			return err
+		}
+		if err := loadRelease(c, client, manifestPaths[c.String("kube-template")]); err != nil {
+			return err
+		}
+	}
+
+	// Parse the rendered objects
+	objects, err := parseManifests(c, manifestPaths)
+	if err != nil {
+		return err
+	}
+
+	if err := validateHooks(objects); err != nil {
+		return err
+	}
+
+	if err := validateApplyStrategies(objects); err != nil {
+		return err
+	}
+
+	smokeTests, err := parseSmokeTests(c, "smoke-tests")
+	if err != nil {
+		return err
+	}
+
+	// The manifest of a redeployed release already has the metadata and the digests it was deployed with,
+	// only the objects of the secret-template are rendered
+	rendered := objects
+	if c.String("redeploy") != "" {
+		rendered = []*manifestObject{}
+		for _, o := range objects {
+			if o.file != c.String("kube-template") {
+				rendered = append(rendered, o)
+			}
+		}
+	}
+
+	// Add common labels and annotations to the rendered objects
+	addMetadata := c.String("common-labels") != "" || c.String("common-annotations") != ""
+	if addMetadata {
+		labels, err := parseCommonMetadata(c, "common-labels", templateData)
+		if err != nil {
+			return err
+		}
+
+		annotations, err := parseCommonMetadata(c, "common-annotations", templateData)
+		if err != nil {
+			return err
+		}
+
+		if err := addCommonMetadata(rendered, labels, annotations); err != nil {
+			return err
+		}
+	}
+
+	// Enforce policies before anything is applied, on the images as the template wrote them rather than pinned
+	if policiesEnabled(c) {
+		if err := checkPolicies(c, objects); err != nil {
+			return err
+		}
+	}
+
+	// Pin images to immutable digests
+	if c.Bool("pin-image-digests") {
+		log("Resolving container images to digests\n")
+		registry := newRegistryClient(token, c.StringSlice("insecure-registries"))
+		if err := pinImageDigests(rendered, registry); err != nil {
+			return err
+		}
+	}
+
+	// Write back the modified objects
+	if addMetadata || c.Bool("pin-image-digests") {
+		if err := writeManifests(c, manifestPaths, objects); err != nil {
+			return err
+		}
+	}
+
+	// Keep the kube-template as it is applied to record the release
+	var renderedManifest []byte
+	if c.Bool("history") && !renderOnly {
+		if renderedManifest, err = ioutil.ReadFile(manifestPaths[c.String("kube-template")]); err != nil {
+			return fmt.Errorf("Error reading manifest: %s\n", err)
+		}
+	}
+
 	// Print rendered file
 	if c.Bool("verbose") {
-		dumpFile(os.Stdout, "RENDERED MANIFEST (Secret Manifest Omitted)", manifestPaths[c.String("kube-template")])
+		dumpFile(logStdout(), "RENDERED MANIFEST (Secret Manifest Omitted)", manifestPaths[c.String("kube-template")])
+	}
+
+	// Validate the rendered objects offline
+	if c.Bool("validate-schemas") {
+		if err := validateSchemas(c, objects); err != nil {
+			return err
+		}
+	}
+
+	// Check for deprecated APIs offline if the target version is known, otherwise once connected to the cluster
+	checkDeprecated := c.String("deprecated-apis") != ""
+	if checkDeprecated {
+		if kubernetesVersion := c.String("kubernetes-version"); kubernetesVersion != "" {
+			if err := checkDeprecatedAPIs(c, objects, kubernetesVersion); err != nil {
+				return err
+			}
+			checkDeprecated = false
+		} else if renderOnly {
+			log("Warning: skipping the deprecated APIs check, kubernetes-version is required when only rendering templates\n")
+		}
+	}
+
+	if renderOnly {
+		for _, t := range []string{c.String("kube-template"), c.String("secret-template")} {
+			if p, ok := manifestPaths[t]; ok {
+				log("Rendered %s to %s\n", t, p)
+			}
+		}
+		return nil
+	}
+
+	// Find the Deployment to deploy a canary of
+	canary, err := newCanary(c, objects, smokeTestData(templateData, nil))
+	if err != nil {
+		return err
+	}
+
+	// Setup execution environment
+	environ := os.Environ()
+	environ = append(environ, fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", keyPath))
+	runner := newRetryRunner(c, NewBasicRunner("", environ, logStdout(), logStderr()))
+
+	// Auth with gcloud and fetch kubectl credentials
+	startPhase("credentials")
+	if err := fetchCredentials(c, token, project, runner); err != nil {
+		return err
 	}
 
+	// Delete credentials from filesystem when finishing
+	defer removeCredentials()
+
 	// kubectl version
-	if err := printKubectlVersion(runner); err != nil {
+	if err := printKubectlVersion(c.Context, runner); err != nil {
 		return fmt.Errorf("Error: %s\n", err)
 	}
 
+	// Check for deprecated APIs against the version of the cluster
+	if checkDeprecated {
+		serverVersion, err := getServerVersion(c.Context, runner)
+		if err != nil {
+			return err
+		}
+
+		if err := checkDeprecatedAPIs(c, objects, serverVersion); err != nil {
+			return err
+		}
+	}
+
 	// Set namespace and ensure it exists
+	startPhase("namespace")
 	if err := setNamespace(c, project, runner); err != nil {
 		return fmt.Errorf("Error: %s\n", err)
 	}
 
-	// Apply manifests
+	// Apply and wait through kubectl, or the Kubernetes API
 	// Separate runner for catching secret output
 	var secretStderr bytes.Buffer
-	runnerSecret := NewBasicRunner("", environ, os.Stdout, &secretStderr)
-	if err := applyManifests(c, manifestPaths, runner, runnerSecret); err != nil {
+	runnerSecret := newRetryRunner(c, NewBasicRunner("", environ, logStdout(), &secretStderr))
+	client, err := newClusterClient(c, runner, runnerSecret)
+	if err != nil {
+		return err
+	}
+
+	// Clean up after the deploy even once the build is cancelled
+	cleanupClient := client.withContext(context.WithoutCancel(c.Context))
+
+	// Lock the namespace so that the deploys of other builds do not interleave
+	if lock := newDeployLock(c); lock != nil && !c.Bool("dry-run") {
+		startPhase("lock")
+		if err := lock.acquire(c.Context, client); err != nil {
+			return err
+		}
+		defer func() {
+			if err := lock.release(cleanupClient); err != nil {
+				log("Warning: %s\n", err)
+			}
+		}()
+	}
+
+	// Find what the deploy changes, e.g. the blue-green color and the objects to replace
+	startPhase("prepare")
+
+	// Record the release once the deploy completed, whether it succeeded or not
+	if c.Bool("history") && !c.Bool("dry-run") {
+		defer func() {
+			if recordErr := recordRelease(c, cleanupClient, newRelease(c, objects, renderedManifest, err, time.Now())); recordErr != nil {
+				log("Warning: %s\n", recordErr)
+			}
+		}()
+	}
+
+	// Deploy the blue-green Deployment as the color its Services do not select
+	blueGreen, err := newBlueGreen(c, objects, client)
+	if err != nil {
+		return err
+	}
+
+	// Remove the canary if the deploy is aborted
+	if canary != nil {
+		defer func() {
+			if err := canary.remove(cleanupClient); err != nil {
+				log("Warning: %s\n", err)
+			}
+		}()
+	}
+
+	// Find the objects to replace rather than apply, their rendered spec changed since they were applied
+	replaced, err := replacedObjects(c, objects, client)
+	if err != nil {
+		return err
+	}
+
+	// Apply manifests
+	if err := applyManifests(c, objects, replaced, client, canary); err != nil {
 		// Print last line of error of applying secret manifest to stderr
 		// Disable it for now as it might still leak secrets
 		// printTrimmedError(&secretStderr, os.Stderr)
@@ -339,14 +800,68 @@ func run(c *cli.Context) error {
 		log("Not waiting for rollout, this was a dry-run\n")
 		return nil
 	}
-	// Wait for rollout to finish
-	if err := waitForRollout(c, runner); err != nil {
+	// Wait for rollouts, jobs, replaced jobs, conditions and load balancer addresses
+	startPhase("wait")
+	waits := append(rolloutWaits(c), jobWaits(c)...)
+	waits = append(waits, replacedJobWaits(c, objects, replaced)...)
+	conditions, err := conditionWaits(c)
+	if err != nil {
+		return err
+	}
+	waits = append(waits, conditions...)
+	waits = append(waits, addressWaits(c)...)
+	if blueGreen != nil {
+		waits = blueGreen.rolloutWaits(c, waits)
+	}
+	results, err := waitForResources(c, waits, client)
+	recordWaits(results)
+	if err != nil {
 		return fmt.Errorf("Error: %s\n", err)
 	}
 
-	// Wait for jobs to finish
-	if err := waitForJobs(c, runner); err != nil {
-		return fmt.Errorf("Error: %s\n", err)
+	// The canary was promoted once its Deployment rolled out
+	if canary != nil {
+		if err := canary.remove(client); err != nil {
+			return err
+		}
+	}
+
+	// Switch the Services to the color which rolled out
+	if blueGreen != nil {
+		if err := blueGreen.promote(client); err != nil {
+			return err
+		}
+	}
+
+	// Expose the load balancer addresses to the next steps
+	if err := writeOutputs(c, results); err != nil {
+		return err
+	}
+
+	// Check the service responds, rolling back if it does not
+	startPhase("smoke-tests")
+	if err := runSmokeTests(c.Context, smokeTests, smokeTestData(templateData, results)); err != nil {
+		if c.Bool("smoke-tests-rollback") {
+			undo := rollback
+			if blueGreen != nil {
+				undo = func(*cli.Context, clusterClient) error { return blueGreen.revert(client) }
+			}
+			if rollbackErr := undo(c, client); rollbackErr != nil {
+				return fmt.Errorf("%s%s", err, rollbackErr)
+			}
+		}
+		return err
+	}
+
+	// Run post-deploy hooks once the rollouts succeeded
+	startPhase("post-deploy")
+	if err := runHooks(c, hookObjects(objects, hookPostDeploy), client); err != nil {
+		return err
+	}
+
+	// Scale the previous color down once the grace period elapsed
+	if blueGreen != nil {
+		return blueGreen.retire(c, client)
 	}
 
 	return nil
@@ -358,18 +873,21 @@ func decodeToken(token string) string {
 		// if no error then the SA key is base64 encoded
 		token = string(decodedToken)
 	} else {
-		fmt.Println("info: skipping base64 credentials decode")
+		fmt.Fprintln(logStdout(), "info: skipping base64 credentials decode")
 	}
 	return token
 }
 
 // checkParams checks required params
+// Credentials and the cluster location are not required when only rendering templates.
 func checkParams(c *cli.Context) error {
-	if c.String("token") == "" {
+	renderOnly := c.Bool("render-only")
+
+	if c.String("token") == "" && !renderOnly {
 		return fmt.Errorf("Missing required param: token")
 	}
 
-	if c.String("zone") == "" && c.String("region") == "" {
+	if c.String("zone") == "" && c.String("region") == "" && !renderOnly {
 		return fmt.Errorf("Missing required param: at least one of region or zone must be specified")
 	}
 
@@ -377,10 +895,14 @@ func checkParams(c *cli.Context) error {
 		return fmt.Errorf("Invalid params: at most one of region or zone may be specified")
 	}
 
-	if c.String("cluster") == "" {
+	if c.String("cluster") == "" && !renderOnly {
 		return fmt.Errorf("Missing required param: cluster")
 	}
 
+	if renderOnly && c.String("output-dir") == "" {
+		return fmt.Errorf("Missing required param: output-dir")
+	}
+
 	namespace := c.String("namespace")
 	c.Set("namespace", sanitizeNamespace(namespace))
 
@@ -388,6 +910,42 @@ func checkParams(c *cli.Context) error {
 		return err
 	}
 
+	if err := validateDeprecatedAPIsMode(c); err != nil {
+		return err
+	}
+
+	if err := validateBackend(c); err != nil {
+		return err
+	}
+
+	if _, err := conditionWaits(c); err != nil {
+		return err
+	}
+
+	for _, name := range []string{"smoke-tests", "canary-smoke-tests"} {
+		if _, err := parseSmokeTests(c, name); err != nil {
+			return err
+		}
+	}
+
+	if c.String("canary") != "" {
+		if _, err := parseCanaryReplicas(c, 1); err != nil {
+			return err
+		}
+	}
+
+	if c.String("redeploy") != "" && (renderOnly || c.String("kube-template") == "") {
+		return fmt.Errorf("Invalid params: redeploy requires the kube-template and may not be used with render-only")
+	}
+
+	if c.Bool("lock") && c.Int("lock-steal-seconds") <= 0 {
+		return fmt.Errorf("Invalid param lock-steal-seconds: must be greater than 0")
+	}
+
+	if c.String("canary") != "" && c.String("canary") == c.String("blue-green") {
+		return fmt.Errorf("Invalid params: canary and blue-green may not name the same Deployment")
+	}
+
 	return nil
 }
 
@@ -420,6 +978,13 @@ func validateKubectlVersion(c *cli.Context, availableVersions []string) error {
 	return fmt.Errorf("Invalid param kubectl-version: %s must be one of %s", kubectlVersionParam, strings.Join(availableVersions, ", "))
 }
 
+// randomID returns n random bytes, hex encoded, e.g. to tell apart trace spans or releases
+func randomID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 // getProjectFromToken gets project id from token
 func getProjectFromToken(j string) string {
 	t := token{}
@@ -457,10 +1022,10 @@ func parseSkips(c *cli.Context) error {
 
 // setDryRunFlag sets the value of the dry-run flag based on the version of kubectl being
 // used and whether the apply should be client-side or server-side
-func setDryRunFlag(runner Runner, output io.Reader, c *cli.Context) error {
+func setDryRunFlag(runner Runner, c *cli.Context) error {
 	dryRunFlag = clientSideDryRunFlagDefault
 
-	version, err := getMinorVersion(runner, output)
+	version, err := getMinorVersion(c.Context, runner)
 	if err != nil {
 		return fmt.Errorf("Error determining which kubectl version is running: %v", err)
 	}
@@ -484,11 +1049,10 @@ func setDryRunFlag(runner Runner, output io.Reader, c *cli.Context) error {
 }
 
 // getMinorVersion fetches and parses the version from kubectl
-func getMinorVersion(runner Runner, output io.Reader) (int64, error) {
-	runner.Run(kubectlCmd, "version", "--client", "-o=json")
-	data, err := ioutil.ReadAll(output)
+func getMinorVersion(ctx context.Context, runner Runner) (int64, error) {
+	result, err := runner.Output(ctx, kubectlCmd, "version", "--client", "-o=json")
 	if err != nil {
-		return 0, fmt.Errorf("Error reading kubectl version: %v", err)
+		return 0, fmt.Errorf("Error getting kubectl version: %v", err)
 	}
 
 	var versionOutput struct {
@@ -497,7 +1061,7 @@ func getMinorVersion(runner Runner, output io.Reader) (int64, error) {
 		}
 	}
 
-	err = json.Unmarshal(data, &versionOutput)
+	err = json.Unmarshal(result.Stdout, &versionOutput)
 	if err != nil {
 		return 0, fmt.Errorf("Error reading kubectl version: %v", err)
 	}
@@ -570,6 +1134,35 @@ func parseSecrets() (map[string]string, error) {
 	return secrets, nil
 }
 
+// renderOnlySecrets replaces the value of every secret with a placeholder.
+// Secrets referenced by the secret template but not provided are added as placeholders too,
+// so templates can be rendered without access to the real secrets.
+func renderOnlySecrets(c *cli.Context, secrets map[string]string) (map[string]string, error) {
+	placeholders := make(map[string]string)
+	for k := range secrets {
+		placeholders[k] = secretPlaceholder
+	}
+
+	t := c.String("secret-template")
+	if t == "" {
+		return placeholders, nil
+	}
+
+	blob, err := ioutil.ReadFile(t)
+	if os.IsNotExist(err) {
+		return placeholders, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading template: %s\n", err)
+	}
+
+	for _, match := range secretRefRegex.FindAllStringSubmatch(string(blob), -1) {
+		placeholders[match[1]] = secretPlaceholder
+	}
+
+	return placeholders, nil
+}
+
 // fetchCredentials authenticates with gcloud and fetches credentials for kubectl
 func fetchCredentials(c *cli.Context, token, project string, runner Runner) error {
 	// Write credentials to tmp file to be picked up by the 'gcloud' command.
@@ -579,7 +1172,7 @@ func fetchCredentials(c *cli.Context, token, project string, runner Runner) erro
 		return fmt.Errorf("Error writing token file: %s\n", err)
 	}
 
-	err = runner.Run(gcloudCmd, "auth", "activate-service-account", "--key-file", keyPath)
+	err = runner.Run(c.Context, gcloudCmd, "auth", "activate-service-account", "--key-file", keyPath)
 	if err != nil {
 		return fmt.Errorf("Error: %s\n", err)
 	}
@@ -601,7 +1194,7 @@ func fetchCredentials(c *cli.Context, token, project string, runner Runner) erro
 		getCredentialsArgs = append(getCredentialsArgs, "--region", c.String("region"))
 	}
 
-	err = runner.Run(gcloudCmd, getCredentialsArgs...)
+	err = runner.Run(c.Context, gcloudCmd, getCredentialsArgs...)
 	if err != nil {
 		return fmt.Errorf("Error: %s\n", err)
 	}
@@ -609,6 +1202,46 @@ func fetchCredentials(c *cli.Context, token, project string, runner Runner) erro
 	return nil
 }
 
+// removeCredentials deletes the credentials from the filesystem.
+// Warn if the keyfile can't be deleted, but don't abort.
+// We're almost certainly running inside an ephemeral container, so the file will be discarded when we're finished anyway.
+func removeCredentials() {
+	if err := os.Remove(keyPath); err != nil && !os.IsNotExist(err) {
+		log("Warning: error removing token file: %s\n", err)
+	}
+}
+
+// connectCluster fetches the credentials of the cluster and configures its namespace, for the commands
+// which do not deploy. The credentials should be removed with removeCredentials once done.
+func connectCluster(c *cli.Context) (clusterClient, error) {
+	token := decodeToken(c.String("token"))
+
+	project := c.String("project")
+	if project == "" {
+		project = getProjectFromToken(token)
+	}
+	if project == "" {
+		return nil, fmt.Errorf("Missing required param: project")
+	}
+
+	if kubectlVersion := c.String("kubectl-version"); kubectlVersion != "" {
+		kubectlCmd = fmt.Sprintf("%s.%s", kubectlCmdName, kubectlVersion)
+	}
+
+	environ := append(os.Environ(), fmt.Sprintf("GOOGLE_APPLICATION_CREDENTIALS=%s", keyPath))
+	runner := newRetryRunner(c, NewBasicRunner("", environ, logStdout(), logStderr()))
+
+	if err := fetchCredentials(c, token, project, runner); err != nil {
+		return nil, err
+	}
+
+	if err := setNamespace(c, project, runner); err != nil {
+		return nil, fmt.Errorf("Error: %s\n", err)
+	}
+
+	return newClusterClient(c, runner, runner)
+}
+
 // templateData builds template and data maps
 func templateData(c *cli.Context, project string, vars map[string]interface{}, secrets map[string]string) (map[string]interface{}, map[string]interface{}, map[string]string, error) {
 	// Built-in template vars
@@ -676,6 +1309,15 @@ func renderTemplates(c *cli.Context, templateData map[string]interface{}, secret
 
 	manifestPaths := make(map[string]string)
 
+	// Rendered manifests are kept as build artifacts when only rendering templates
+	basePath := templateBasePath
+	if c.Bool("render-only") {
+		basePath = c.String("output-dir")
+		if err := os.MkdirAll(basePath, 0755); err != nil {
+			return nil, fmt.Errorf("Error creating output directory: %s\n", err)
+		}
+	}
+
 	// YAML files path for kubectl
 	for t, content := range mapping {
 		if t == "" {
@@ -696,7 +1338,7 @@ func renderTemplates(c *cli.Context, templateData map[string]interface{}, secret
 		// Create the output file.
 		// If template is a path, extract file name
 		filename := filepath.Base(t)
-		manifestPaths[t] = path.Join(templateBasePath, filename)
+		manifestPaths[t] = path.Join(basePath, filename)
 		f, err := os.Create(manifestPaths[t])
 		if err != nil {
 			return nil, fmt.Errorf("Error creating deployment file: %s\n", err)
@@ -727,8 +1369,8 @@ func renderTemplates(c *cli.Context, templateData map[string]interface{}, secret
 }
 
 // printKubectlVersion runs kubectl version
-func printKubectlVersion(runner Runner) error {
-	return runner.Run(kubectlCmd, "version")
+func printKubectlVersion(ctx context.Context, runner Runner) error {
+	return runner.Run(ctx, kubectlCmd, "version")
 }
 
 // setNamespace sets namespace of current kubectl context and ensure it exists
@@ -754,7 +1396,7 @@ func setNamespace(c *cli.Context, project string, runner Runner) error {
 
 	context := strings.Join([]string{"gke", project, clusterLocation, c.String("cluster")}, "_")
 
-	if err := runner.Run(kubectlCmd, "config", "set-context", context, "--namespace", namespace); err != nil {
+	if err := runner.Run(c.Context, kubectlCmd, "config", "set-context", context, "--namespace", namespace); err != nil {
 		return fmt.Errorf("Error: %s\n", err)
 	}
 
@@ -773,144 +1415,75 @@ func setNamespace(c *cli.Context, project string, runner Runner) error {
 	log("Ensuring the %s namespace exists\n", namespace)
 
 	nsArgs := applyArgs(c.Bool("dry-run"), c.Bool("server-side"), nsPath)
-	if err := runner.Run(kubectlCmd, nsArgs...); err != nil {
+	if err := runner.Run(c.Context, kubectlCmd, nsArgs...); err != nil {
 		return fmt.Errorf("Error: %s\n", err)
 	}
 
 	return nil
 }
 
-// applyManifests applies manifests using kubectl apply
-func applyManifests(c *cli.Context, manifestPaths map[string]string, runner Runner, runnerSecret Runner) error {
-
-	manifests := manifestPaths[c.String("kube-template")]
-	manifestsSecret := manifestPaths[c.String("secret-template")]
+// applyManifests applies the rendered objects using kubectl apply, in phases so that objects are applied
+// after the objects they depend on. Pre-deploy hooks run before the workloads, post-deploy hooks are left out.
+func applyManifests(c *cli.Context, objects []*manifestObject, replaced map[*manifestObject]bool, client clusterClient, canary *canaryDeployment) error {
+	// Custom resources of new definitions are rejected until the definitions are applied
+	validated := withoutNewCustomResources(objects)
+
+	// The API server rejects changes to immutable fields of objects which are yet to be replaced
+	if c.Bool("server-side") {
+		filtered := []*manifestObject{}
+		for _, o := range validated {
+			if replaced[o] {
+				log("Skipping the dry-run of %s, it is replaced\n", o.location())
+				continue
+			}
+			filtered = append(filtered, o)
+		}
+		validated = filtered
+	}
 
 	// If it is not a dry run, do a dry run first to validate Kubernetes manifests.
+	startPhase("validate")
 	log("Validating Kubernetes manifests with a dry-run\n")
 
-	if !c.Bool("dry-run") {
-		args := applyArgs(true, c.Bool("server-side"), manifests)
-		if err := runner.Run(kubectlCmd, args...); err != nil {
-			return fmt.Errorf("Error: %s\n", err)
-		}
-
-		if len(manifestsSecret) > 0 {
-			argsSecret := applyArgs(true, c.Bool("server-side"), manifestsSecret)
-			if err := runnerSecret.Run(kubectlCmd, argsSecret...); err != nil {
-				return fmt.Errorf("Error: %s\n", err)
-			}
-		}
-
-		log("Applying Kubernetes manifests to the cluster\n")
+	manifests, err := writePhaseManifests(c, validated, "validate")
+	if err != nil {
+		return err
 	}
 
-	// Actually apply Kubernetes manifests.
-	args := applyArgs(c.Bool("dry-run"), c.Bool("server-side"), manifests)
-	if err := runner.Run(kubectlCmd, args...); err != nil {
-		return fmt.Errorf("Error: %s\n", err)
+	if err := applyPhaseManifests(manifests, true, nil, client); err != nil {
+		return err
 	}
 
-	// Apply Kubernetes secrets manifests
-	if len(manifestsSecret) > 0 {
-		argsSecret := applyArgs(c.Bool("dry-run"), c.Bool("server-side"), manifestsSecret)
-		if err := runnerSecret.Run(kubectlCmd, argsSecret...); err != nil {
-			return fmt.Errorf("Error: %s\n", err)
-		}
+	if c.Bool("dry-run") {
+		return nil
 	}
 
-	return nil
-}
-
-// waitForRollout executes kubectl to wait for rollout to complete before continuing
-func waitForRollout(c *cli.Context, runner Runner) error {
-	namespace := c.String("namespace")
-	waitSeconds := c.Int("wait-seconds")
-	specs := c.StringSlice("wait-deployments")
-	waitDeployments := []string{}
+	startPhase("apply")
+	log("Applying Kubernetes manifests to the cluster\n")
 
-	for _, spec := range specs {
-		// default type to "deployment" if not present
-		deployment := spec
-		if !strings.Contains(spec, "/") {
-			deployment = "deployment/" + deployment
-		}
-		waitDeployments = append(waitDeployments, deployment)
+	// Actually apply Kubernetes manifests.
+	manifests, err = writePhaseManifests(c, withoutHooks(objects), "apply")
+	if err != nil {
+		return err
 	}
 
-	waitDeploymentsCount := len(waitDeployments)
-	counterProgress := ""
-
-	for counter, deployment := range waitDeployments {
-		if waitDeploymentsCount > 1 {
-			counterProgress = fmt.Sprintf(" %d/%d", counter+1, waitDeploymentsCount)
-		}
-
-		log(fmt.Sprintf("Waiting until rollout completes for %s%s\n", deployment, counterProgress))
-
-		command := []string{"rollout", "status", deployment}
-
-		if namespace != "" {
-			command = append(command, "--namespace", namespace)
-		}
-
-		path := kubectlCmd
-
-		if waitSeconds != 0 {
-			command = append([]string{strconv.Itoa(waitSeconds), path}, command...)
-			path = timeoutCmd
-		}
-
-		if err := runner.Run(path, command...); err != nil {
-			return fmt.Errorf("Error: %s\n", err)
-		}
+	beforeWorkloads, workloads := splitPhaseManifests(manifests, workloadsPhase)
+	if err := applyPhaseManifests(beforeWorkloads, false, replaced, client); err != nil {
+		return err
 	}
 
-	return nil
-}
-
-// waitForJobs executes kubectl to wait for jobs to complete before continuing
-func waitForJobs(c *cli.Context, runner Runner) error {
-	namespace := c.String("namespace")
-	waitSeconds := c.Int("wait-jobs-seconds")
-	specs := c.StringSlice("wait-jobs")
-	waitJobs := []string{}
-	for _, spec := range specs {
-		job := spec
-		if !strings.HasPrefix(spec, "job/") {
-			job = "job/" + job
-		}
-		waitJobs = append(waitJobs, job)
+	if err := runHooks(c, hookObjects(objects, hookPreDeploy), client); err != nil {
+		return err
 	}
 
-	waitJobsCount := len(waitJobs)
-	counterProgress := ""
-
-	for counter, job := range waitJobs {
-		if waitJobsCount > 1 {
-			counterProgress = fmt.Sprintf(" %d/%d", counter+1, waitJobsCount)
-		}
-
-		log(fmt.Sprintf("Waiting until job completes for %s%s\n", job, counterProgress))
-
-		command := []string{"wait", "--for=condition=complete", job}
-
-		if waitSeconds != 0 {
-			command = append(command, fmt.Sprintf("--timeout=%ds", waitSeconds))
-		}
-
-		if namespace != "" {
-			command = append(command, "--namespace", namespace)
-		}
-
-		path := kubectlCmd
-
-		if err := runner.Run(path, command...); err != nil {
-			return fmt.Errorf("Error: %s\n", err)
+	// The canary depends on the objects applied before the workloads, as its Deployment
+	if canary != nil {
+		if err := canary.deploy(c, client); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	return applyPhaseManifests(workloads, false, replaced, client)
 }
 
 // applyArgs creates args slice for kubectl apply command
@@ -944,5 +1517,10 @@ func printTrimmedError(stderrbuf io.Reader, dest io.Writer) {
 }
 
 func log(format string, a ...interface{}) {
+	if logFormat == logFormatJSON {
+		message := strings.TrimSpace(fmt.Sprintf(format, a...))
+		emit(logEvent{Level: messageLevel(message), Message: message})
+		return
+	}
 	fmt.Printf("\n"+format, a...)
 }
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -19,7 +21,7 @@ type MockedRunner struct {
 	Runner
 }
 
-func (m *MockedRunner) Run(name string, arg ...string) error {
+func (m *MockedRunner) Run(ctx context.Context, name string, arg ...string) error {
 	// https://godoc.org/github.com/stretchr/testify/mock
 	// Arguments given in .On()
 	args := m.Called(append([]string{name}, arg...))
@@ -27,6 +29,17 @@ func (m *MockedRunner) Run(name string, arg ...string) error {
 	return args.Error(0)
 }
 
+func (m *MockedRunner) Output(ctx context.Context, name string, arg ...string) (*Result, error) {
+	args := m.Called(append([]string{name}, arg...))
+	// Returns stdout and error given in .Return()
+	result := &Result{Stdout: []byte(args.String(0))}
+	if err := args.Error(1); err != nil {
+		result.ExitCode = 1
+		return result, err
+	}
+	return result, nil
+}
+
 func TestCheckParams(t *testing.T) {
 	// Testing with cli.Context:
 	// https://github.com/urfave/cli/blob/master/context_test.go#L10
@@ -83,6 +96,32 @@ func TestCheckParams(t *testing.T) {
 	err = checkParams(c)
 	assert.NoError(t, err)
 	assert.Equal(t, "feature-1892-test-ns", c.String("namespace"))
+
+	// Render-only does not require credentials or a cluster
+	set = flag.NewFlagSet("render-only-set", 0)
+	c = cli.NewContext(nil, set, nil)
+	set.Bool("render-only", true, "")
+	set.String("output-dir", "rendered", "")
+	err = checkParams(c)
+	assert.NoError(t, err)
+
+	// Render-only requires an output directory
+	set = flag.NewFlagSet("render-only-no-output-dir", 0)
+	c = cli.NewContext(nil, set, nil)
+	set.Bool("render-only", true, "")
+	err = checkParams(c)
+	assert.Error(t, err)
+
+	// The lock expires after lock-steal-seconds
+	set = flag.NewFlagSet("lock-steal-zero", 0)
+	c = cli.NewContext(nil, set, nil)
+	set.String("token", "{}", "")
+	set.String("region", "us-west1", "")
+	set.String("cluster", "cluster-0", "")
+	set.Bool("lock", true, "")
+	set.Int("lock-steal-seconds", 0, "")
+	err = checkParams(c)
+	assert.EqualError(t, err, "Invalid param lock-steal-seconds: must be greater than 0")
 }
 
 func TestValidateKubectlVersion(t *testing.T) {
@@ -181,6 +220,33 @@ func TestParseSecrets(t *testing.T) {
 	// Not able to use os.Setenv() to set env vars without "=", or duplicate keys
 }
 
+func TestRenderOnlySecrets(t *testing.T) {
+	err := os.MkdirAll("/tmp/drone-gke-tests/", os.ModePerm)
+	assert.NoError(t, err)
+	secretTemplatePath := "/tmp/drone-gke-tests/.kube.sec.yml"
+	err = os.WriteFile(secretTemplatePath, []byte("{{.SECRET_TEST}}-{{ .SECRET_BASE64_CERT }}"), 0600)
+	assert.NoError(t, err)
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("secret-template", secretTemplatePath, "")
+	c := cli.NewContext(nil, set, nil)
+
+	// Provided and referenced secrets are replaced by placeholders
+	secrets, err := renderOnlySecrets(c, map[string]string{"SECRET_TEST": "dGVzdDA=", "SECRET_OTHER": "dGVzdDE="})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"SECRET_TEST":        secretPlaceholder,
+		"SECRET_OTHER":       secretPlaceholder,
+		"SECRET_BASE64_CERT": secretPlaceholder,
+	}, secrets)
+
+	// Missing secret template
+	os.Remove(secretTemplatePath)
+	secrets, err = renderOnlySecrets(c, map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, secrets)
+}
+
 func TestFetchCredentials(t *testing.T) {
 	// Set cli.Context
 	zonal := flag.NewFlagSet("zonal-set", 0)
@@ -402,6 +468,25 @@ func TestRenderTemplates(t *testing.T) {
 	assert.NoError(t, err)
 	_, err = renderTemplates(c, tmplData, secretsData)
 	assert.Error(t, err)
+
+	// Render-only writes to the output directory
+	outputDir := "/tmp/drone-gke-tests/rendered"
+	os.RemoveAll(outputDir)
+	tmplBuf = []byte("{{.COMMIT}}-{{.key0}}")
+	err = os.WriteFile(kubeTemplatePath, tmplBuf, 0600)
+	assert.NoError(t, err)
+	set.Bool("render-only", true, "")
+	set.String("output-dir", outputDir, "")
+	c = cli.NewContext(nil, set, nil)
+	manifestPaths, err = renderTemplates(c, tmplData, secretsData)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		kubeTemplatePath:   outputDir + "/.kube.yml",
+		secretTemplatePath: outputDir + "/.kube.sec.yml",
+	}, manifestPaths)
+	buf, err = os.ReadFile(outputDir + "/.kube.yml")
+	assert.NoError(t, err)
+	assert.Equal(t, "e0f21b90a-val0", string(buf))
 }
 
 func TestParseSkips(t *testing.T) {
@@ -451,7 +536,7 @@ func TestParseSkips(t *testing.T) {
 func TestPrintKubectlVersion(t *testing.T) {
 	testRunner := new(MockedRunner)
 	testRunner.On("Run", []string{"kubectl", "version"}).Return(nil)
-	err := printKubectlVersion(testRunner)
+	err := printKubectlVersion(context.Background(), testRunner)
 	testRunner.AssertExpectations(t)
 	assert.NoError(t, err)
 }
@@ -534,31 +619,68 @@ func TestApplyManifests(t *testing.T) {
 	set.Bool("dry-run", false, "")
 	c := cli.NewContext(nil, set, nil)
 
-	manifestPaths := map[string]string{
-		".kube.yml":     "/path/to/kube-tamplate",
-		".kube.sec.yml": "/path/to/secret-tamplate",
-	}
+	deployment := testObject(t, "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n")
+	secret := testObject(t, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app\n")
+	secret.file = ".kube.sec.yml"
+	objects := []*manifestObject{deployment, secret}
 
 	testRunner := new(MockedRunner)
-	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/path/to/kube-tamplate"}).Return(nil)
-	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/path/to/secret-tamplate"}).Return(nil)
-	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/path/to/kube-tamplate"}).Return(nil)
-	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/path/to/secret-tamplate"}).Return(nil)
-	err := applyManifests(c, manifestPaths, testRunner, testRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-6.yml"}).Return(nil)
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-6.yml"}).Return(nil)
+	testSecretRunner := new(MockedRunner)
+	testSecretRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-4.sec.yml"}).Return(nil)
+	testSecretRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-4.sec.yml"}).Return(nil)
+	err := applyManifests(c, objects, nil, &kubectlClient{runner: testRunner, runnerSecret: testSecretRunner}, nil)
 	testRunner.AssertExpectations(t)
+	testSecretRunner.AssertExpectations(t)
 	assert.NoError(t, err)
 
 	// No secrets manifest
-	manifestPaths = map[string]string{
-		".kube.yml": "/path/to/kube-tamplate",
-	}
+	testRunner = new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-6.yml"}).Return(nil)
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-6.yml"}).Return(nil)
+	err = applyManifests(c, []*manifestObject{deployment}, nil, &kubectlClient{runner: testRunner, runnerSecret: testRunner}, nil)
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+
+	// CustomResourceDefinitions are established before their custom resources are applied
+	crd := testObject(t, testCRD)
+	widget := testObject(t, "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\n")
+	objects = []*manifestObject{widget, deployment, crd, secret}
 
 	testRunner = new(MockedRunner)
-	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/path/to/kube-tamplate"}).Return(nil)
-	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/path/to/kube-tamplate"}).Return(nil)
-	err = applyManifests(c, manifestPaths, testRunner, testRunner)
+	testSecretRunner = new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-1.yml"}).Return(nil).Once()
+	testSecretRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-4.sec.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-6.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-1.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "wait", "--for=condition=Established", "--timeout=60s", "customresourcedefinition/widgets.example.com"}).Return(nil).Once()
+	testSecretRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-4.sec.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-6.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-7.yml"}).Return(nil).Once()
+	err = applyManifests(c, objects, nil, &kubectlClient{runner: testRunner, runnerSecret: testSecretRunner}, nil)
 	testRunner.AssertExpectations(t)
+	testSecretRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+
+	// Calls happen phase by phase
+	calls := []string{}
+	for _, call := range testRunner.Calls {
+		calls = append(calls, strings.Join(call.Arguments.Get(0).([]string), " "))
+	}
+	assert.Equal(t, []string{
+		"kubectl apply --dry-run=client --filename /tmp/validate-1.yml",
+		"kubectl apply --dry-run=client --filename /tmp/validate-6.yml",
+		"kubectl apply --filename /tmp/apply-1.yml",
+		"kubectl wait --for=condition=Established --timeout=60s customresourcedefinition/widgets.example.com",
+		"kubectl apply --filename /tmp/apply-6.yml",
+		"kubectl apply --filename /tmp/apply-7.yml",
+	}, calls)
+
+	// The custom resource is not validated
+	applied, err := parseManifest(".kube.yml", "/tmp/apply-7.yml")
 	assert.NoError(t, err)
+	assert.Equal(t, "Widget/w", applied[0].String())
 
 	// Dry-run
 	set = flag.NewFlagSet("test-set", 0)
@@ -567,16 +689,14 @@ func TestApplyManifests(t *testing.T) {
 	set.Bool("dry-run", true, "")
 	c = cli.NewContext(nil, set, nil)
 
-	manifestPaths = map[string]string{
-		".kube.yml":     "/path/to/kube-tamplate",
-		".kube.sec.yml": "/path/to/secret-tamplate",
-	}
-
 	testRunner = new(MockedRunner)
-	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/path/to/kube-tamplate"}).Return(nil)
-	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/path/to/secret-tamplate"}).Return(nil)
-	err = applyManifests(c, manifestPaths, testRunner, testRunner)
+	testSecretRunner = new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-1.yml"}).Return(nil)
+	testSecretRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-4.sec.yml"}).Return(nil)
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-6.yml"}).Return(nil)
+	err = applyManifests(c, objects, nil, &kubectlClient{runner: testRunner, runnerSecret: testSecretRunner}, nil)
 	testRunner.AssertExpectations(t)
+	testSecretRunner.AssertExpectations(t)
 	assert.NoError(t, err)
 }
 
@@ -596,9 +716,9 @@ func RunWaitForRollout(t *testing.T, specs []string, expectedValues []string) {
 	c := cli.NewContext(nil, set, nil)
 	testRunner := new(MockedRunner)
 	for _, s := range expectedValues {
-		testRunner.On("Run", []string{"timeout", "256", "kubectl", "rollout", "status", s, "--namespace", "test-ns"}).Return(nil)
+		testRunner.On("Run", []string{"kubectl", "rollout", "status", s, "--namespace", "test-ns"}).Return(nil)
 	}
-	err := waitForRollout(c, testRunner)
+	_, err := waitForResources(c, rolloutWaits(c), &kubectlClient{runner: testRunner})
 	testRunner.AssertExpectations(t)
 	assert.NoError(t, err)
 }
@@ -614,9 +734,9 @@ func TestWaitForRollout(t *testing.T) {
 		[]string{"deployment/d1", "deployment/d2"})
 }
 
-// runWaitForJobs is a helper function for testing WaitForJobs.  For each flag-value
-// in flagValues it will expect a corresponding call of the form:
-// "kubectl wait --for=condition=complete <expected-value> ..."
+// runWaitForJobs is a helper function for testing jobWaits.  For each flag-value
+// in flagValues it will expect a corresponding job to wait for, polled with a call of the form:
+// "kubectl get <expected-value> -o=json ..."
 func runWaitForJobs(t *testing.T, specs []string, expectedValues []string) {
 	set := flag.NewFlagSet("test-set", 0)
 	set.Int("wait-jobs-seconds", 256, "")
@@ -628,11 +748,17 @@ func runWaitForJobs(t *testing.T, specs []string, expectedValues []string) {
 	strSliceFlag := cli.StringSliceFlag{Name: "wait-jobs", Value: &strSlice}
 	strSliceFlag.Apply(set)
 	c := cli.NewContext(nil, set, nil)
+	expected := []resourceWait{}
+	for _, s := range expectedValues {
+		expected = append(expected, resourceWait{resource: s, namespace: "test-ns", job: true, timeout: 256 * time.Second})
+	}
+	assert.Equal(t, expected, jobWaits(c))
+
 	testRunner := new(MockedRunner)
 	for _, s := range expectedValues {
-		testRunner.On("Run", []string{"kubectl", "wait", "--for=condition=complete", s, "--timeout=256s", "--namespace", "test-ns"}).Return(nil)
+		testRunner.On("Output", []string{"kubectl", "get", s, "-o=json", "--namespace", "test-ns"}).Return(testJobComplete, nil)
 	}
-	err := waitForJobs(c, testRunner)
+	_, err := waitForResources(c, jobWaits(c), &kubectlClient{runner: testRunner})
 	testRunner.AssertExpectations(t)
 	assert.NoError(t, err)
 }
@@ -752,6 +878,12 @@ func TestTokenParamPrecedence(t *testing.T) {
 }
 
 func TestSetDryRunFlag(t *testing.T) {
+	// Restore the globals set by the tests
+	defer func() {
+		kubectlCmd = kubectlCmdName
+		dryRunFlag = clientSideDryRunFlagDefault
+	}()
+
 	tests := []struct {
 		name                 string
 		versionCommandOutput string
@@ -926,16 +1058,15 @@ func TestSetDryRunFlag(t *testing.T) {
 						kubectlCmd = fmt.Sprintf("%s.%s", kubectlCmdName, kubectlVersion)
 					}
 
-					buf := bytes.NewBufferString(test.versionCommandOutput)
 					testRunner := new(MockedRunner)
 					if test.explicitVersion != "" {
-						testRunner.On("Run", []string{fmt.Sprintf("kubectl.%s", test.explicitVersion), "version", "--client", "-o=json"}).Return(nil)
+						testRunner.On("Output", []string{fmt.Sprintf("kubectl.%s", test.explicitVersion), "version", "--client", "-o=json"}).Return(test.versionCommandOutput, nil)
 					} else {
-						testRunner.On("Run", []string{"kubectl", "version", "--client", "-o=json"}).Return(nil)
+						testRunner.On("Output", []string{"kubectl", "version", "--client", "-o=json"}).Return(test.versionCommandOutput, nil)
 					}
 
 					// Run
-					err := setDryRunFlag(testRunner, buf, ctx)
+					err := setDryRunFlag(testRunner, ctx)
 					assert.NoError(t, err)
 
 					// Check
@@ -952,6 +1083,14 @@ func TestSetDryRunFlag(t *testing.T) {
 	}
 }
 
+func Test_getMinorVersionFailed(t *testing.T) {
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "version", "--client", "-o=json"}).Return("", fmt.Errorf("exit status 1"))
+	_, err := getMinorVersion(context.Background(), testRunner)
+	assert.EqualError(t, err, "Error getting kubectl version: exit status 1")
+	testRunner.AssertExpectations(t)
+}
+
 func Test_decodeToken(t *testing.T) {
 	serviceAccountKey := `{
   "type": "service_account",
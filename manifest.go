@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// annotationPrefix namespaces the annotations read or written by the plugin
+const annotationPrefix = "drone-gke.nytimes.com/"
+
+// manifestObject is a Kubernetes object parsed from a rendered manifest
+type manifestObject struct {
+	// template the object was rendered from
+	file string
+	// position of the YAML document within the manifest, starting at 1
+	index  int
+	object map[string]interface{}
+}
+
+// parseManifests parses the objects of the rendered manifests, kube-template objects first
+func parseManifests(c *cli.Context, manifestPaths map[string]string) ([]*manifestObject, error) {
+	objects := []*manifestObject{}
+
+	for _, t := range []string{c.String("kube-template"), c.String("secret-template")} {
+		manifestPath, ok := manifestPaths[t]
+		if !ok {
+			continue
+		}
+
+		parsed, err := parseManifest(t, manifestPath)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, parsed...)
+	}
+
+	return objects, nil
+}
+
+// writeManifests writes the objects back to the rendered manifests they were parsed from
+func writeManifests(c *cli.Context, manifestPaths map[string]string, objects []*manifestObject) error {
+	for _, t := range []string{c.String("kube-template"), c.String("secret-template")} {
+		manifestPath, ok := manifestPaths[t]
+		if !ok {
+			continue
+		}
+
+		templateObjects := []*manifestObject{}
+		for _, o := range objects {
+			if o.file == t {
+				templateObjects = append(templateObjects, o)
+			}
+		}
+
+		blob, err := encodeObjects(templateObjects)
+		if err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(manifestPath, blob, 0600); err != nil {
+			return fmt.Errorf("Error writing manifest: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// encodeObjects encodes objects as a multi-document YAML manifest
+func encodeObjects(objects []*manifestObject) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+
+	for _, o := range objects {
+		if err := encoder.Encode(o.object); err != nil {
+			return nil, fmt.Errorf("Error encoding %s: %s\n", o.location(), err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("Error encoding manifest: %s\n", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// parseManifest parses the objects of a multi-document YAML file, skipping empty documents
+func parseManifest(file, manifestPath string) ([]*manifestObject, error) {
+	blob, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading manifest: %s\n", err)
+	}
+
+	objects := []*manifestObject{}
+	decoder := yaml.NewDecoder(bytes.NewReader(blob))
+
+	for index := 1; ; index++ {
+		var object map[string]interface{}
+
+		err := decoder.Decode(&object)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing %s (document %d): %s\n", file, index, err)
+		}
+
+		if len(object) == 0 {
+			continue
+		}
+
+		objects = append(objects, &manifestObject{
+			file:   file,
+			index:  index,
+			object: object,
+		})
+	}
+
+	return objects, nil
+}
+
+func (o *manifestObject) apiVersion() string {
+	return nestedString(o.object, "apiVersion")
+}
+
+// group returns the API group of the object, empty for the core group
+func (o *manifestObject) group() string {
+	if i := strings.Index(o.apiVersion(), "/"); i >= 0 {
+		return o.apiVersion()[:i]
+	}
+	return ""
+}
+
+func (o *manifestObject) kind() string {
+	return nestedString(o.object, "kind")
+}
+
+func (o *manifestObject) name() string {
+	return nestedString(o.object, "metadata", "name")
+}
+
+func (o *manifestObject) namespace() string {
+	return nestedString(o.object, "metadata", "namespace")
+}
+
+// String identifies the object as kubectl does, e.g. Deployment/app
+func (o *manifestObject) String() string {
+	return fmt.Sprintf("%s/%s", o.kind(), o.name())
+}
+
+// location identifies the object and the document it was rendered to
+func (o *manifestObject) location() string {
+	return fmt.Sprintf("%s (document %d) %s", o.file, o.index, o)
+}
+
+// podTemplateFields returns the field path of the pod template of workload kinds
+func podTemplateFields(kind string) ([]string, bool) {
+	switch kind {
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		return []string{"spec", "template"}, true
+	case "CronJob":
+		return []string{"spec", "jobTemplate", "spec", "template"}, true
+	}
+	return nil, false
+}
+
+// podSpec returns the pod spec of pods and workloads
+func (o *manifestObject) podSpec() (map[string]interface{}, bool) {
+	fields := []string{"spec"}
+	if template, ok := podTemplateFields(o.kind()); ok {
+		fields = append(template, "spec")
+	} else if o.kind() != "Pod" {
+		return nil, false
+	}
+
+	value, _ := nestedField(o.object, fields...)
+	spec, ok := value.(map[string]interface{})
+	return spec, ok
+}
+
+// containers returns the init containers and containers of pods and workloads
+func (o *manifestObject) containers() []map[string]interface{} {
+	containers := []map[string]interface{}{}
+
+	spec, ok := o.podSpec()
+	if !ok {
+		return containers
+	}
+
+	for _, field := range []string{"initContainers", "containers"} {
+		list, _ := spec[field].([]interface{})
+		for _, item := range list {
+			if container, ok := item.(map[string]interface{}); ok {
+				containers = append(containers, container)
+			}
+		}
+	}
+
+	return containers
+}
+
+// nestedField returns the value found by following fields through nested maps
+func nestedField(object map[string]interface{}, fields ...string) (interface{}, bool) {
+	var value interface{} = object
+
+	for _, field := range fields {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		value, ok = m[field]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// ensureNestedMap returns the map found by following fields through nested maps, creating missing maps.
+// It fails if any field is set to something else than a map.
+func ensureNestedMap(object map[string]interface{}, fields ...string) (map[string]interface{}, bool) {
+	m := object
+
+	for _, field := range fields {
+		value, ok := m[field]
+		if !ok || value == nil {
+			value = make(map[string]interface{})
+			m[field] = value
+		}
+
+		m, ok = value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return m, true
+}
+
+// nestedString returns the string found by following fields through nested maps, or an empty string
+func nestedString(object map[string]interface{}, fields ...string) string {
+	value, _ := nestedField(object, fields...)
+	s, _ := value.(string)
+	return s
+}
+
+// nestedInt returns the number found by following fields through nested maps, as decoded from YAML or JSON
+func nestedInt(object map[string]interface{}, fields ...string) (int64, bool) {
+	value, _ := nestedField(object, fields...)
+	switch n := value.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case float64:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseManifest(t *testing.T) {
+	err := os.MkdirAll("/tmp/drone-gke-tests/", os.ModePerm)
+	assert.NoError(t, err)
+	manifestPath := "/tmp/drone-gke-tests/manifest.yml"
+
+	manifest := `
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: test-ns
+---
+# empty document
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+`
+	err = os.WriteFile(manifestPath, []byte(manifest), 0600)
+	assert.NoError(t, err)
+
+	objects, err := parseManifest(".kube.yml", manifestPath)
+	assert.NoError(t, err)
+	if assert.Len(t, objects, 2) {
+		assert.Equal(t, "apps/v1", objects[0].apiVersion())
+		assert.Equal(t, "Deployment", objects[0].kind())
+		assert.Equal(t, "app", objects[0].name())
+		assert.Equal(t, "test-ns", objects[0].namespace())
+		assert.Equal(t, "Deployment/app", objects[0].String())
+		assert.Equal(t, ".kube.yml (document 1) Deployment/app", objects[0].location())
+		assert.Equal(t, ".kube.yml (document 3) Service/app", objects[1].location())
+		assert.Equal(t, "", objects[1].namespace())
+	}
+
+	// Invalid YAML
+	err = os.WriteFile(manifestPath, []byte("kind: Service\n---\nkind: [\n"), 0600)
+	assert.NoError(t, err)
+	_, err = parseManifest(".kube.yml", manifestPath)
+	assert.ErrorContains(t, err, ".kube.yml (document 2)")
+
+	// Missing file
+	_, err = parseManifest(".kube.yml", "/tmp/drone-gke-tests/missing.yml")
+	assert.Error(t, err)
+}
+
+func TestParseManifests(t *testing.T) {
+	err := os.MkdirAll("/tmp/drone-gke-tests/", os.ModePerm)
+	assert.NoError(t, err)
+	err = os.WriteFile("/tmp/drone-gke-tests/rendered.yml", []byte("kind: Deployment\n"), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile("/tmp/drone-gke-tests/rendered.sec.yml", []byte("kind: Secret\n"), 0600)
+	assert.NoError(t, err)
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("kube-template", ".kube.yml", "")
+	set.String("secret-template", ".kube.sec.yml", "")
+	c := cli.NewContext(nil, set, nil)
+
+	objects, err := parseManifests(c, map[string]string{
+		".kube.sec.yml": "/tmp/drone-gke-tests/rendered.sec.yml",
+		".kube.yml":     "/tmp/drone-gke-tests/rendered.yml",
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, objects, 2) {
+		assert.Equal(t, "Deployment", objects[0].kind())
+		assert.Equal(t, ".kube.yml", objects[0].file)
+		assert.Equal(t, "Secret", objects[1].kind())
+		assert.Equal(t, ".kube.sec.yml", objects[1].file)
+	}
+
+	// Skipped secret template
+	objects, err = parseManifests(c, map[string]string{".kube.yml": "/tmp/drone-gke-tests/rendered.yml"})
+	assert.NoError(t, err)
+	assert.Len(t, objects, 1)
+}
+
+func TestWriteManifests(t *testing.T) {
+	err := os.MkdirAll("/tmp/drone-gke-tests/", os.ModePerm)
+	assert.NoError(t, err)
+	kubePath := "/tmp/drone-gke-tests/rendered.yml"
+	secretPath := "/tmp/drone-gke-tests/rendered.sec.yml"
+	err = os.WriteFile(kubePath, []byte("---\nkind: Deployment\nmetadata:\n  name: app\n---\nkind: Service\n"), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(secretPath, []byte("kind: Secret\ndata:\n  key: dGVzdDA=\n"), 0600)
+	assert.NoError(t, err)
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("kube-template", ".kube.yml", "")
+	set.String("secret-template", ".kube.sec.yml", "")
+	c := cli.NewContext(nil, set, nil)
+	manifestPaths := map[string]string{".kube.yml": kubePath, ".kube.sec.yml": secretPath}
+
+	objects, err := parseManifests(c, manifestPaths)
+	assert.NoError(t, err)
+	objects[0].object["metadata"].(map[string]interface{})["namespace"] = "test-ns"
+
+	err = writeManifests(c, manifestPaths, objects)
+	assert.NoError(t, err)
+
+	buf, err := os.ReadFile(kubePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "kind: Deployment\nmetadata:\n  name: app\n  namespace: test-ns\n---\nkind: Service\n", string(buf))
+
+	buf, err = os.ReadFile(secretPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "data:\n  key: dGVzdDA=\nkind: Secret\n", string(buf))
+}
+
+func TestEnsureNestedMap(t *testing.T) {
+	object := map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app", "labels": nil},
+	}
+
+	labels, ok := ensureNestedMap(object, "metadata", "labels")
+	assert.True(t, ok)
+	labels["app"] = "echo"
+
+	annotations, ok := ensureNestedMap(object, "spec", "template", "metadata", "annotations")
+	assert.True(t, ok)
+	annotations["build"] = "2"
+
+	assert.Equal(t, map[string]interface{}{
+		"metadata": map[string]interface{}{"name": "app", "labels": map[string]interface{}{"app": "echo"}},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"annotations": map[string]interface{}{"build": "2"}},
+			},
+		},
+	}, object)
+
+	_, ok = ensureNestedMap(object, "metadata", "name")
+	assert.False(t, ok)
+}
+
+func TestNestedField(t *testing.T) {
+	object := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"name":   "app",
+			"labels": map[string]interface{}{"app": "echo"},
+		},
+		"spec": []interface{}{},
+	}
+
+	value, ok := nestedField(object, "metadata", "labels", "app")
+	assert.True(t, ok)
+	assert.Equal(t, "echo", value)
+
+	_, ok = nestedField(object, "metadata", "annotations")
+	assert.False(t, ok)
+
+	_, ok = nestedField(object, "spec", "replicas")
+	assert.False(t, ok)
+
+	assert.Equal(t, "app", nestedString(object, "metadata", "name"))
+	assert.Equal(t, "", nestedString(object, "metadata", "labels"))
+}
+
+func TestContainers(t *testing.T) {
+	// Workloads
+	o := testObject(t, testPolicyDeployment)
+	containers := o.containers()
+	if assert.Len(t, containers, 3) {
+		assert.Equal(t, "migrate", containers[0]["name"])
+		assert.Equal(t, "app", containers[1]["name"])
+		assert.Equal(t, "proxy", containers[2]["name"])
+	}
+
+	// CronJobs
+	o = testObject(t, `
+apiVersion: batch/v1
+kind: CronJob
+metadata:
+  name: cron
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: job
+              image: busybox
+`)
+	containers = o.containers()
+	if assert.Len(t, containers, 1) {
+		assert.Equal(t, "job", containers[0]["name"])
+	}
+
+	// Pods
+	o = testObject(t, "apiVersion: v1\nkind: Pod\nmetadata:\n  name: pod\nspec:\n  containers:\n    - name: app\n")
+	assert.Len(t, o.containers(), 1)
+
+	// Other kinds
+	o = testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\nspec:\n  containers:\n    - name: app\n")
+	_, ok := o.podSpec()
+	assert.False(t, ok)
+	assert.Empty(t, o.containers())
+}
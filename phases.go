@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// applyPhase groups kinds of objects applied together, before the objects of the next phases
+type applyPhase struct {
+	name string
+	// nil for every kind not listed by another phase
+	kinds []string
+}
+
+// applyPhases orders objects so that they are applied after the objects they depend on
+var applyPhases = []applyPhase{
+	{"CustomResourceDefinitions", []string{"CustomResourceDefinition"}},
+	{"Namespaces", []string{"Namespace"}},
+	{"RBAC", []string{"ServiceAccount", "Role", "ClusterRole", "RoleBinding", "ClusterRoleBinding"}},
+	{"ConfigMaps and Secrets", []string{"ConfigMap", "Secret"}},
+	{"Services", []string{"Service"}},
+	{"workloads", []string{"Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job", "CronJob", "Pod"}},
+	{"other objects", nil},
+}
+
+// workloadsPhase is the index of the workloads phase, pre-deploy hooks run before it
+const workloadsPhase = 5
+
+// phaseManifest is a manifest of the objects of a phase rendered from the same template
+type phaseManifest struct {
+	phase int
+	// rendered from the secret template, kubectl output must be redacted
+	secret  bool
+	path    string
+	objects []*manifestObject
+}
+
+// objectPhase returns the index of the phase an object is applied in
+func objectPhase(o *manifestObject) int {
+	for i, phase := range applyPhases {
+		if phase.kinds == nil || slices.Contains(phase.kinds, o.kind()) {
+			return i
+		}
+	}
+	return len(applyPhases) - 1
+}
+
+// writePhaseManifests writes a manifest for every phase and template with objects, in apply order.
+// Manifests are named after prefix, e.g. apply-1.yml, apply-4.sec.yml.
+func writePhaseManifests(c *cli.Context, objects []*manifestObject, prefix string) ([]phaseManifest, error) {
+	manifests := []phaseManifest{}
+
+	for phase := range applyPhases {
+		for _, secret := range []bool{false, true} {
+			m := phaseManifest{phase: phase, secret: secret}
+
+			for _, o := range objects {
+				if objectPhase(o) == phase && (o.file == c.String("secret-template")) == secret {
+					m.objects = append(m.objects, o)
+				}
+			}
+
+			if len(m.objects) == 0 {
+				continue
+			}
+
+			extension := ".yml"
+			if secret {
+				extension = ".sec.yml"
+			}
+			m.path = path.Join(templateBasePath, fmt.Sprintf("%s-%d%s", prefix, phase+1, extension))
+
+			blob, err := encodeObjects(m.objects)
+			if err != nil {
+				return nil, err
+			}
+
+			if err := ioutil.WriteFile(m.path, blob, 0600); err != nil {
+				return nil, fmt.Errorf("Error writing manifest: %s\n", err)
+			}
+
+			manifests = append(manifests, m)
+		}
+	}
+
+	return manifests, nil
+}
+
+// applyPhaseManifests applies manifests in order, waiting for CustomResourceDefinitions to be established.
+// The live objects of replaced objects are deleted right before their manifest is applied.
+func applyPhaseManifests(manifests []phaseManifest, dryRun bool, replaced map[*manifestObject]bool, client clusterClient) error {
+	for i, m := range manifests {
+		if i == 0 || manifests[i-1].phase != m.phase {
+			log("Applying %s (phase %d/%d)\n", applyPhases[m.phase].name, m.phase+1, len(applyPhases))
+		}
+
+		if !dryRun {
+			if err := deleteReplacedObjects(m.objects, replaced, client); err != nil {
+				return err
+			}
+		}
+
+		if err := client.apply(m, dryRun); err != nil {
+			return fmt.Errorf("Error: %s\n", err)
+		}
+
+		if dryRun || m.phase != 0 {
+			continue
+		}
+
+		// Custom resources can only be applied once their definition is served
+		crds := []string{}
+		for _, o := range m.objects {
+			crds = append(crds, o.name())
+		}
+
+		log("Waiting until CustomResourceDefinitions %s are established\n", strings.Join(crds, ", "))
+
+		if err := client.waitForCRDs(m.objects); err != nil {
+			return fmt.Errorf("Error: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// splitPhaseManifests splits manifests in apply order into the manifests of the phases before and from a phase
+func splitPhaseManifests(manifests []phaseManifest, phase int) ([]phaseManifest, []phaseManifest) {
+	for i, m := range manifests {
+		if m.phase >= phase {
+			return manifests[:i], manifests[i:]
+		}
+	}
+	return manifests, []phaseManifest{}
+}
+
+// withoutNewCustomResources filters out custom resources of CustomResourceDefinitions in objects,
+// which cannot be validated before their definition is applied
+func withoutNewCustomResources(objects []*manifestObject) []*manifestObject {
+	definitions := make(map[string]bool)
+	for _, o := range objects {
+		if o.kind() == "CustomResourceDefinition" {
+			definitions[nestedString(o.object, "spec", "group")+"/"+nestedString(o.object, "spec", "names", "kind")] = true
+		}
+	}
+
+	filtered := []*manifestObject{}
+	for _, o := range objects {
+		if definitions[o.group()+"/"+o.kind()] {
+			log("Skipping the dry-run of %s, its CustomResourceDefinition is not applied yet\n", o.location())
+			continue
+		}
+		filtered = append(filtered, o)
+	}
+
+	return filtered
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestObjectPhase(t *testing.T) {
+	for kind, expected := range map[string]string{
+		"CustomResourceDefinition": "CustomResourceDefinitions",
+		"Namespace":                "Namespaces",
+		"ServiceAccount":           "RBAC",
+		"ClusterRoleBinding":       "RBAC",
+		"ConfigMap":                "ConfigMaps and Secrets",
+		"Secret":                   "ConfigMaps and Secrets",
+		"Service":                  "Services",
+		"Deployment":               "workloads",
+		"CronJob":                  "workloads",
+		"Ingress":                  "other objects",
+		"Widget":                   "other objects",
+	} {
+		o := testObject(t, "apiVersion: v1\nkind: "+kind+"\nmetadata:\n  name: test\n")
+		assert.Equal(t, expected, applyPhases[objectPhase(o)].name, kind)
+	}
+}
+
+func TestWithoutNewCustomResources(t *testing.T) {
+	crd := testObject(t, testCRD)
+	widget := testObject(t, "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\n")
+	gadget := testObject(t, "apiVersion: example.com/v1\nkind: Gadget\nmetadata:\n  name: g\n")
+	otherWidget := testObject(t, "apiVersion: other.example.com/v1\nkind: Widget\nmetadata:\n  name: w\n")
+
+	filtered := withoutNewCustomResources([]*manifestObject{crd, widget, gadget, otherWidget})
+	assert.Equal(t, []*manifestObject{crd, gadget, otherWidget}, filtered)
+}
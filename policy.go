@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	policyNoLatestTag       = "no-latest-tag"
+	policyRequireResources  = "require-resources"
+	policyNoPrivileged      = "no-privileged"
+	policyAllowedRegistries = "allowed-registries"
+)
+
+// policyCheck returns a message for every violation of a rule by an object
+type policyCheck func(o *manifestObject) []string
+
+// policy is a named rule evaluated against every rendered object
+type policy struct {
+	name  string
+	check policyCheck
+}
+
+// policyRule is a rule of a policy file, checking the values of a field path, e.g.
+//
+//	rules:
+//	  - name: require-team-label
+//	    kinds: [Deployment]
+//	    field: metadata.labels.team
+//	    exists: true
+type policyRule struct {
+	Name       string        `yaml:"name"`
+	Message    string        `yaml:"message"`
+	Kinds      []string      `yaml:"kinds"`
+	Field      string        `yaml:"field"`
+	Exists     *bool         `yaml:"exists"`
+	Equals     interface{}   `yaml:"equals"`
+	NotEquals  interface{}   `yaml:"notEquals"`
+	Matches    string        `yaml:"matches"`
+	NotMatches string        `yaml:"notMatches"`
+	OneOf      []interface{} `yaml:"oneOf"`
+}
+
+// fieldValue is a value found, or not, at a concrete field path
+type fieldValue struct {
+	path  string
+	value interface{}
+	found bool
+}
+
+// policiesEnabled tells whether any built-in policy or policy file is configured
+func policiesEnabled(c *cli.Context) bool {
+	return len(c.StringSlice("policies")) > 0 || len(c.StringSlice("policy-files")) > 0
+}
+
+// checkPolicies evaluates the configured policies against objects and fails on any violation
+func checkPolicies(c *cli.Context, objects []*manifestObject) error {
+	policies, err := loadPolicies(c)
+	if err != nil {
+		return err
+	}
+
+	log("Checking the Kubernetes manifests against %d policies\n", len(policies))
+
+	violations := 0
+	for _, o := range objects {
+		for _, p := range policies {
+			for _, message := range p.check(o) {
+				fmt.Fprintf(logStdout(), "%s: [%s] %s\n", o.location(), p.name, message)
+				violations++
+			}
+		}
+	}
+
+	if violations > 0 {
+		return fmt.Errorf("Error: %d policy violation(s) found in the rendered manifests\n", violations)
+	}
+
+	return nil
+}
+
+// loadPolicies builds the enabled built-in policies and the rules of every policy file
+func loadPolicies(c *cli.Context) ([]policy, error) {
+	policies := []policy{}
+
+	for _, name := range c.StringSlice("policies") {
+		check, err := builtinPolicy(c, name)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy{name: name, check: check})
+	}
+
+	for _, policyFile := range c.StringSlice("policy-files") {
+		blob, err := ioutil.ReadFile(policyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading policy file: %s\n", err)
+		}
+
+		var parsed struct {
+			Rules []policyRule `yaml:"rules"`
+		}
+		if err := yaml.Unmarshal(blob, &parsed); err != nil {
+			return nil, fmt.Errorf("Error parsing policy file %s: %s\n", policyFile, err)
+		}
+
+		for _, rule := range parsed.Rules {
+			check, err := rule.compile()
+			if err != nil {
+				return nil, fmt.Errorf("Error in policy file %s: %s\n", policyFile, err)
+			}
+			policies = append(policies, policy{name: rule.Name, check: check})
+		}
+	}
+
+	return policies, nil
+}
+
+// builtinPolicy returns the check of a built-in policy
+func builtinPolicy(c *cli.Context, name string) (policyCheck, error) {
+	switch name {
+	case policyNoLatestTag:
+		return func(o *manifestObject) []string {
+			messages := []string{}
+			for _, container := range o.containers() {
+				image := nestedString(container, "image")
+				if imageUsesLatestTag(image) {
+					messages = append(messages, fmt.Sprintf("container %s uses the mutable latest tag (%s)", nestedString(container, "name"), image))
+				}
+			}
+			return messages
+		}, nil
+
+	case policyRequireResources:
+		return func(o *manifestObject) []string {
+			messages := []string{}
+			for _, container := range o.containers() {
+				for _, field := range []string{"requests", "limits"} {
+					value, _ := nestedField(container, "resources", field)
+					if m, ok := value.(map[string]interface{}); !ok || len(m) == 0 {
+						messages = append(messages, fmt.Sprintf("container %s does not set resource %s", nestedString(container, "name"), field))
+					}
+				}
+			}
+			return messages
+		}, nil
+
+	case policyNoPrivileged:
+		return func(o *manifestObject) []string {
+			messages := []string{}
+			for _, container := range o.containers() {
+				if privileged, _ := nestedField(container, "securityContext", "privileged"); privileged == true {
+					messages = append(messages, fmt.Sprintf("container %s is privileged", nestedString(container, "name")))
+				}
+			}
+			return messages
+		}, nil
+
+	case policyAllowedRegistries:
+		registries := c.StringSlice("allowed-registries")
+		if len(registries) == 0 {
+			return nil, fmt.Errorf("Missing required param: allowed-registries must be set to use the %s policy", policyAllowedRegistries)
+		}
+
+		return func(o *manifestObject) []string {
+			messages := []string{}
+			for _, container := range o.containers() {
+				image := nestedString(container, "image")
+				allowed := false
+				for _, registry := range registries {
+					if imageFromRegistry(image, registry) {
+						allowed = true
+						break
+					}
+				}
+				if !allowed {
+					messages = append(messages, fmt.Sprintf("container %s uses an image from a registry which is not allowed (%s)", nestedString(container, "name"), image))
+				}
+			}
+			return messages
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid param policies: %s must be one of %s", name, strings.Join([]string{policyNoLatestTag, policyRequireResources, policyNoPrivileged, policyAllowedRegistries}, ", "))
+}
+
+// imageFromRegistry tells whether an image is the registry, a tag or digest of it, or a repository of the registry,
+// e.g. gcr.io/nyt/app and gcr.io/nyt/app:1.0 are from gcr.io/nyt/app but gcr.io/nyt/app-evil is not
+func imageFromRegistry(image, registry string) bool {
+	registry = strings.TrimSuffix(registry, "/")
+	if image == registry {
+		return true
+	}
+	for _, boundary := range []string{"/", ":", "@"} {
+		if strings.HasPrefix(image, registry+boundary) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageUsesLatestTag tells whether an image reference is neither pinned to a digest nor to a tag other than latest
+func imageUsesLatestTag(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+
+	// The tag follows the last colon after the last slash, a colon before it separates the registry port
+	name := image[strings.LastIndex(image, "/")+1:]
+	i := strings.LastIndex(name, ":")
+	return i < 0 || name[i+1:] == "latest"
+}
+
+// compile validates a policy file rule and returns its check
+func (r policyRule) compile() (policyCheck, error) {
+	if r.Name == "" {
+		return nil, fmt.Errorf("rule is missing a name")
+	}
+
+	if r.Field == "" {
+		return nil, fmt.Errorf("rule %s is missing a field", r.Name)
+	}
+
+	operators := 0
+	for _, set := range []bool{r.Exists != nil, r.Equals != nil, r.NotEquals != nil, r.Matches != "", r.NotMatches != "", r.OneOf != nil} {
+		if set {
+			operators++
+		}
+	}
+	if operators != 1 {
+		return nil, fmt.Errorf("rule %s must set exactly one of exists, equals, notEquals, matches, notMatches, oneOf", r.Name)
+	}
+
+	var pattern *regexp.Regexp
+	if r.Matches != "" || r.NotMatches != "" {
+		var err error
+		if pattern, err = regexp.Compile(r.Matches + r.NotMatches); err != nil {
+			return nil, fmt.Errorf("rule %s has an invalid pattern: %s", r.Name, err)
+		}
+	}
+
+	return func(o *manifestObject) []string {
+		if len(r.Kinds) > 0 && !slices.Contains(r.Kinds, o.kind()) {
+			return nil
+		}
+
+		messages := []string{}
+		for _, fv := range fieldValues(o.object, r.Field) {
+			var violated bool
+			var description string
+
+			switch {
+			case r.Exists != nil:
+				violated = fv.found != *r.Exists
+				description = map[bool]string{true: "must be set", false: "must not be set"}[*r.Exists]
+			case !fv.found:
+				continue
+			case r.Equals != nil:
+				violated = !containsValue([]interface{}{r.Equals}, fv.value)
+				description = fmt.Sprintf("must equal %v", r.Equals)
+			case r.NotEquals != nil:
+				violated = containsValue([]interface{}{r.NotEquals}, fv.value)
+				description = fmt.Sprintf("must not equal %v", r.NotEquals)
+			case r.Matches != "":
+				violated = !pattern.MatchString(fmt.Sprint(fv.value))
+				description = fmt.Sprintf("must match %s", r.Matches)
+			case r.NotMatches != "":
+				violated = pattern.MatchString(fmt.Sprint(fv.value))
+				description = fmt.Sprintf("must not match %s", r.NotMatches)
+			case r.OneOf != nil:
+				violated = !containsValue(r.OneOf, fv.value)
+				description = "must be one of the allowed values"
+			}
+
+			if !violated {
+				continue
+			}
+
+			if r.Message != "" {
+				messages = append(messages, fmt.Sprintf("%s: %s", fv.path, r.Message))
+			} else {
+				messages = append(messages, fmt.Sprintf("%s %s", fv.path, description))
+			}
+		}
+		return messages
+	}, nil
+}
+
+// fieldValues resolves a field path, where [*] matches every item of a list, e.g.
+// spec.template.spec.containers[*].image
+func fieldValues(object map[string]interface{}, fieldPath string) []fieldValue {
+	values := []fieldValue{{path: "", value: object, found: true}}
+
+	for _, segment := range strings.Split(strings.ReplaceAll(fieldPath, "[", ".["), ".") {
+		if segment == "" {
+			continue
+		}
+
+		next := []fieldValue{}
+		for _, fv := range values {
+			if !fv.found {
+				next = append(next, fieldValue{path: appendFieldPath(fv.path, segment)})
+				continue
+			}
+
+			if segment == "[*]" {
+				items, _ := fv.value.([]interface{})
+				for i, item := range items {
+					next = append(next, fieldValue{path: fmt.Sprintf("%s[%d]", fv.path, i), value: item, found: true})
+				}
+				continue
+			}
+
+			if strings.HasPrefix(segment, "[") {
+				items, _ := fv.value.([]interface{})
+				i, err := strconv.Atoi(strings.Trim(segment, "[]"))
+				if err != nil || i < 0 || i >= len(items) {
+					next = append(next, fieldValue{path: fv.path + segment})
+				} else {
+					next = append(next, fieldValue{path: fv.path + segment, value: items[i], found: true})
+				}
+				continue
+			}
+
+			m, _ := fv.value.(map[string]interface{})
+			value, ok := m[segment]
+			next = append(next, fieldValue{path: joinFieldPath(fv.path, segment), value: value, found: ok})
+		}
+		values = next
+	}
+
+	return values
+}
+
+// appendFieldPath appends a field or a list index to a field path
+func appendFieldPath(fieldPath, segment string) string {
+	if strings.HasPrefix(segment, "[") {
+		return fieldPath + segment
+	}
+	return joinFieldPath(fieldPath, segment)
+}
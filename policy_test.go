@@ -0,0 +1,219 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+const testPolicyDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    team: news
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: migrate
+          image: us.gcr.io/my-project/migrate:1.0
+          resources:
+            requests:
+              cpu: 100m
+            limits:
+              memory: 64Mi
+      containers:
+        - name: app
+          image: nginx
+          securityContext:
+            privileged: true
+        - name: proxy
+          image: us.gcr.io/my-project/proxy@sha256:3e2f
+          resources:
+            requests:
+              cpu: 100m
+`
+
+func TestImageUsesLatestTag(t *testing.T) {
+	assert.True(t, imageUsesLatestTag("nginx"))
+	assert.True(t, imageUsesLatestTag("nginx:latest"))
+	assert.True(t, imageUsesLatestTag("localhost:5000/nginx"))
+	assert.False(t, imageUsesLatestTag("localhost:5000/nginx:1.25"))
+	assert.False(t, imageUsesLatestTag("us.gcr.io/my-project/app:e0f21b90a"))
+	assert.False(t, imageUsesLatestTag("us.gcr.io/my-project/app@sha256:3e2f"))
+}
+
+func TestImageFromRegistry(t *testing.T) {
+	assert.True(t, imageFromRegistry("gcr.io/nyt/app:1.0", "gcr.io/nyt"))
+	assert.True(t, imageFromRegistry("gcr.io/nyt/app:1.0", "gcr.io/nyt/"))
+	assert.True(t, imageFromRegistry("gcr.io/nyt/app", "gcr.io/nyt/app"))
+	assert.True(t, imageFromRegistry("gcr.io/nyt/app:1.0", "gcr.io/nyt/app"))
+	assert.True(t, imageFromRegistry("gcr.io/nyt/app@sha256:3e2f", "gcr.io/nyt/app"))
+	assert.False(t, imageFromRegistry("gcr.io/nyt/app-evil:1.0", "gcr.io/nyt/app"))
+	assert.False(t, imageFromRegistry("gcr.io/nyt-evil/app:1.0", "gcr.io/nyt"))
+	assert.False(t, imageFromRegistry("gcr.io.attacker.com/app", "gcr.io"))
+	assert.False(t, imageFromRegistry("nginx", "gcr.io"))
+}
+
+func TestBuiltinPolicies(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	allowedRegistries := cli.NewStringSlice("us.gcr.io/my-project/")
+	allowedRegistriesFlag := cli.StringSliceFlag{Name: "allowed-registries", Value: allowedRegistries}
+	allowedRegistriesFlag.Apply(set)
+	c := cli.NewContext(nil, set, nil)
+
+	o := testObject(t, testPolicyDeployment)
+
+	for _, test := range []struct {
+		name     string
+		expected []string
+	}{
+		{policyNoLatestTag, []string{"container app uses the mutable latest tag (nginx)"}},
+		{policyRequireResources, []string{
+			"container app does not set resource requests",
+			"container app does not set resource limits",
+			"container proxy does not set resource limits",
+		}},
+		{policyNoPrivileged, []string{"container app is privileged"}},
+		{policyAllowedRegistries, []string{"container app uses an image from a registry which is not allowed (nginx)"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			check, err := builtinPolicy(c, test.name)
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, check(o))
+
+			// Objects without pods
+			assert.Empty(t, check(testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n")))
+		})
+	}
+
+	// Unknown policy
+	_, err := builtinPolicy(c, "no-root")
+	assert.Error(t, err)
+
+	// Allowed registries are required
+	c = cli.NewContext(nil, flag.NewFlagSet("test-set", 0), nil)
+	_, err = builtinPolicy(c, policyAllowedRegistries)
+	assert.Error(t, err)
+}
+
+func TestPolicyRules(t *testing.T) {
+	exists := true
+	o := testObject(t, testPolicyDeployment)
+
+	for _, test := range []struct {
+		name     string
+		rule     policyRule
+		expected []string
+	}{
+		{
+			name:     "exists",
+			rule:     policyRule{Name: "owner", Field: "metadata.labels.owner", Exists: &exists},
+			expected: []string{"metadata.labels.owner must be set"},
+		},
+		{
+			name:     "exists-wildcard",
+			rule:     policyRule{Name: "memory", Field: "spec.template.spec.containers[*].resources.limits.memory", Exists: &exists, Message: "memory limits are required"},
+			expected: []string{"spec.template.spec.containers[0].resources.limits.memory: memory limits are required", "spec.template.spec.containers[1].resources.limits.memory: memory limits are required"},
+		},
+		{
+			name:     "equals",
+			rule:     policyRule{Name: "team", Field: "metadata.labels.team", Equals: "sports"},
+			expected: []string{"metadata.labels.team must equal sports"},
+		},
+		{
+			name:     "not-equals-index",
+			rule:     policyRule{Name: "privileged", Field: "spec.template.spec.containers[0].securityContext.privileged", NotEquals: true},
+			expected: []string{"spec.template.spec.containers[0].securityContext.privileged must not equal true"},
+		},
+		{
+			name:     "matches",
+			rule:     policyRule{Name: "registry", Field: "spec.template.spec.initContainers[*].image", Matches: "^us\\.gcr\\.io/"},
+			expected: []string{},
+		},
+		{
+			name:     "not-matches",
+			rule:     policyRule{Name: "digest", Field: "spec.template.spec.containers[*].image", NotMatches: "@sha256:"},
+			expected: []string{"spec.template.spec.containers[1].image must not match @sha256:"},
+		},
+		{
+			name:     "one-of",
+			rule:     policyRule{Name: "team", Field: "metadata.labels.team", OneOf: []interface{}{"news", "sports"}},
+			expected: []string{},
+		},
+		{
+			name:     "other-kinds",
+			rule:     policyRule{Name: "owner", Field: "metadata.labels.owner", Exists: &exists, Kinds: []string{"Service"}},
+			expected: nil,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			check, err := test.rule.compile()
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, check(o))
+		})
+	}
+
+	// Invalid rules
+	_, err := policyRule{Field: "metadata.name", Exists: &exists}.compile()
+	assert.Error(t, err)
+	_, err = policyRule{Name: "no-field", Exists: &exists}.compile()
+	assert.Error(t, err)
+	_, err = policyRule{Name: "no-operator", Field: "metadata.name"}.compile()
+	assert.Error(t, err)
+	_, err = policyRule{Name: "two-operators", Field: "metadata.name", Exists: &exists, Matches: "app"}.compile()
+	assert.Error(t, err)
+	_, err = policyRule{Name: "invalid-pattern", Field: "metadata.name", Matches: "("}.compile()
+	assert.Error(t, err)
+}
+
+func TestCheckPolicies(t *testing.T) {
+	err := os.MkdirAll("/tmp/drone-gke-tests/", os.ModePerm)
+	assert.NoError(t, err)
+	policyPath := "/tmp/drone-gke-tests/policy.yml"
+	err = os.WriteFile(policyPath, []byte(`
+rules:
+  - name: require-team-label
+    field: metadata.labels.team
+    exists: true
+`), 0600)
+	assert.NoError(t, err)
+
+	set := flag.NewFlagSet("test-set", 0)
+	policies := cli.NewStringSlice(policyNoPrivileged)
+	policiesFlag := cli.StringSliceFlag{Name: "policies", Value: policies}
+	policiesFlag.Apply(set)
+	policyFiles := cli.NewStringSlice(policyPath)
+	policyFilesFlag := cli.StringSliceFlag{Name: "policy-files", Value: policyFiles}
+	policyFilesFlag.Apply(set)
+	c := cli.NewContext(nil, set, nil)
+	assert.True(t, policiesEnabled(c))
+
+	// Compliant
+	err = checkPolicies(c, []*manifestObject{
+		testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n  labels:\n    team: news\n"),
+	})
+	assert.NoError(t, err)
+
+	// Violations
+	err = checkPolicies(c, []*manifestObject{
+		testObject(t, testPolicyDeployment),
+		testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n"),
+	})
+	assert.EqualError(t, err, "Error: 2 policy violation(s) found in the rendered manifests\n")
+
+	// Invalid policy file
+	err = os.WriteFile(policyPath, []byte("rules:\n  - name: no-field\n    exists: true\n"), 0600)
+	assert.NoError(t, err)
+	err = checkPolicies(c, []*manifestObject{})
+	assert.Error(t, err)
+
+	// Nothing configured
+	c = cli.NewContext(nil, flag.NewFlagSet("test-set", 0), nil)
+	assert.False(t, policiesEnabled(c))
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	dockerHubRegistry        = "registry-1.docker.io"
+	originalImagesAnnotation = annotationPrefix + "original-images"
+
+	registryTimeout = 30 * time.Second
+)
+
+// manifestMediaTypes are accepted when resolving digests, image indexes first to keep multi-arch images
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// imageReference is a parsed container image reference, e.g. us.gcr.io/project/app:1.0
+type imageReference struct {
+	// name as written in the reference, without tag or digest
+	name       string
+	registry   string
+	repository string
+	tag        string
+	digest     string
+}
+
+// registryClient resolves image tags to digests using the Docker Registry HTTP API V2
+type registryClient struct {
+	client *http.Client
+	// credentials returns the username and password used to pull from a registry, if any
+	credentials func(registry string) (string, string)
+	// registries accessed over plain HTTP
+	insecure map[string]bool
+	// resolved digests by image reference
+	cache map[string]string
+}
+
+// newRegistryClient creates a registry client authenticating to Google registries with the service account token
+func newRegistryClient(token string, insecureRegistries []string) *registryClient {
+	insecure := make(map[string]bool)
+	for _, registry := range insecureRegistries {
+		insecure[registry] = true
+	}
+
+	return &registryClient{
+		client: &http.Client{Timeout: registryTimeout},
+		credentials: func(registry string) (string, string) {
+			if token != "" && isGoogleRegistry(registry) {
+				return "_json_key", token
+			}
+			return "", ""
+		},
+		insecure: insecure,
+		cache:    make(map[string]string),
+	}
+}
+
+// pinImageDigests rewrites the images of every container to the digest their tag currently points to.
+// The original images are recorded in an annotation of the object, by container name.
+func pinImageDigests(objects []*manifestObject, registry *registryClient) error {
+	for _, o := range objects {
+		originals := make(map[string]string)
+
+		for _, container := range o.containers() {
+			image := nestedString(container, "image")
+			ref, err := parseImageReference(image)
+			if err != nil {
+				return fmt.Errorf("Error pinning images of %s: %s\n", o.location(), err)
+			}
+
+			// Already immutable
+			if ref.digest != "" {
+				continue
+			}
+
+			digest, err := registry.resolveDigest(ref)
+			if err != nil {
+				return fmt.Errorf("Error pinning images of %s: %s\n", o.location(), err)
+			}
+
+			container["image"] = ref.name + "@" + digest
+			originals[nestedString(container, "name")] = image
+			log("Pinned %s to %s\n", image, digest)
+		}
+
+		if len(originals) == 0 {
+			continue
+		}
+
+		annotations, ok := ensureNestedMap(o.object, "metadata", "annotations")
+		if !ok {
+			return fmt.Errorf("Error pinning images of %s: metadata.annotations is not a map\n", o.location())
+		}
+
+		blob, err := json.Marshal(originals)
+		if err != nil {
+			return fmt.Errorf("Error pinning images of %s: %s\n", o.location(), err)
+		}
+		annotations[originalImagesAnnotation] = string(blob)
+	}
+
+	return nil
+}
+
+// parseImageReference parses an image reference as Docker does, defaulting to Docker Hub and the latest tag
+func parseImageReference(image string) (imageReference, error) {
+	if image == "" {
+		return imageReference{}, fmt.Errorf("missing image")
+	}
+
+	ref := imageReference{name: image}
+
+	if i := strings.Index(image, "@"); i >= 0 {
+		ref.name, ref.digest = image[:i], image[i+1:]
+	}
+
+	// The tag follows the last colon after the last slash, a colon before it separates the registry port
+	if i := strings.LastIndex(ref.name, ":"); i > strings.LastIndex(ref.name, "/") {
+		ref.name, ref.tag = ref.name[:i], ref.name[i+1:]
+	}
+	if ref.tag == "" {
+		ref.tag = "latest"
+	}
+
+	// The first component is a registry if it looks like a host name
+	parts := strings.SplitN(ref.name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.registry, ref.repository = parts[0], parts[1]
+	} else {
+		ref.registry, ref.repository = dockerHubRegistry, ref.name
+		if len(parts) == 1 {
+			ref.repository = "library/" + ref.name
+		}
+	}
+
+	if ref.registry == "docker.io" || ref.registry == "index.docker.io" {
+		ref.registry = dockerHubRegistry
+	}
+
+	return ref, nil
+}
+
+func isGoogleRegistry(registry string) bool {
+	return registry == "gcr.io" || strings.HasSuffix(registry, ".gcr.io") || strings.HasSuffix(registry, "-docker.pkg.dev")
+}
+
+// resolveDigest returns the digest the tag of an image reference points to
+func (r *registryClient) resolveDigest(ref imageReference) (string, error) {
+	key := fmt.Sprintf("%s/%s:%s", ref.registry, ref.repository, ref.tag)
+	if digest, ok := r.cache[key]; ok {
+		return digest, nil
+	}
+
+	scheme := "https"
+	if r.insecure[ref.registry] || isLocalRegistry(ref.registry) {
+		scheme = "http"
+	}
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, ref.registry, ref.repository, ref.tag)
+
+	resp, err := r.requestManifest(http.MethodHead, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	authorization := ""
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err = r.authorize(ref, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", err
+		}
+
+		resp, err = r.requestManifest(http.MethodHead, manifestURL, authorization)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolving %s: registry responded with %s", key, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+
+	// Registries are not required to return the digest, compute it from the manifest instead
+	if digest == "" {
+		resp, err = r.requestManifest(http.MethodGet, manifestURL, authorization)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("resolving %s: registry responded with %s", key, resp.Status)
+		}
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, resp.Body); err != nil {
+			return "", fmt.Errorf("resolving %s: %s", key, err)
+		}
+		digest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+	}
+
+	r.cache[key] = digest
+	return digest, nil
+}
+
+func (r *registryClient) requestManifest(method, manifestURL, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(method, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %s", manifestURL, err)
+	}
+
+	return resp, nil
+}
+
+// authorize answers a registry's authentication challenge, returning the Authorization header to retry with
+func (r *registryClient) authorize(ref imageReference, challenge string) (string, error) {
+	username, password := r.credentials(ref.registry)
+
+	scheme := strings.ToLower(strings.SplitN(challenge, " ", 2)[0])
+	if scheme == "basic" {
+		if username == "" {
+			return "", fmt.Errorf("registry %s requires credentials", ref.registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+
+	if scheme != "bearer" {
+		return "", fmt.Errorf("registry %s requested unsupported authentication: %q", ref.registry, challenge)
+	}
+
+	params := make(map[string]string)
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	if params["realm"] == "" {
+		return "", fmt.Errorf("registry %s returned an authentication challenge without realm", ref.registry)
+	}
+
+	if params["scope"] == "" {
+		params["scope"] = fmt.Sprintf("repository:%s:pull", ref.repository)
+	}
+
+	query := url.Values{}
+	for _, param := range []string{"service", "scope"} {
+		if params[param] != "" {
+			query.Set(param, params[param])
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("requesting a token from %s: %s", params["realm"], err)
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("requesting a token from %s: %s", params["realm"], err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting a token from %s: %s", params["realm"], resp.Status)
+	}
+
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading the token from %s: %s", params["realm"], err)
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(blob, &tokenResponse); err != nil {
+		return "", fmt.Errorf("reading the token from %s: %s", params["realm"], err)
+	}
+
+	token := tokenResponse.Token
+	if token == "" {
+		token = tokenResponse.AccessToken
+	}
+
+	return "Bearer " + token, nil
+}
+
+// isLocalRegistry tells whether a registry runs on the local host, which Docker accesses over plain HTTP
+func isLocalRegistry(registry string) bool {
+	host := registry
+	if i := strings.LastIndex(registry, ":"); i >= 0 {
+		host = registry[:i]
+	}
+	return host == "localhost" || host == "127.0.0.1" || host == "[::1]"
+}
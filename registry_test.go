@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDigest = "sha256:4c4e1b2a1a1b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5"
+
+// newTestRegistry starts a registry serving the manifest of app:1.0, requiring a bearer token
+func newTestRegistry(t *testing.T, sendDigest bool) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			username, password, _ := r.BasicAuth()
+			assert.Equal(t, "", username+password)
+			assert.Regexp(t, `^repository:team/\w+:pull$`, r.URL.Query().Get("scope"))
+			fmt.Fprint(w, `{"token": "test-token"}`)
+		case r.Header.Get("Authorization") != "Bearer test-token":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/v2/team/app/manifests/1.0":
+			assert.Contains(t, r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json")
+			if sendDigest {
+				w.Header().Set("Docker-Content-Digest", testDigest)
+			}
+			fmt.Fprint(w, `{"schemaVersion": 2}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server
+}
+
+func TestParseImageReference(t *testing.T) {
+	for _, test := range []struct {
+		image    string
+		expected imageReference
+	}{
+		{"nginx", imageReference{name: "nginx", registry: "registry-1.docker.io", repository: "library/nginx", tag: "latest"}},
+		{"bitnami/redis:7.2", imageReference{name: "bitnami/redis", registry: "registry-1.docker.io", repository: "bitnami/redis", tag: "7.2"}},
+		{"docker.io/bitnami/redis:7.2", imageReference{name: "docker.io/bitnami/redis", registry: "registry-1.docker.io", repository: "bitnami/redis", tag: "7.2"}},
+		{"us.gcr.io/project/app:e0f21b90a", imageReference{name: "us.gcr.io/project/app", registry: "us.gcr.io", repository: "project/app", tag: "e0f21b90a"}},
+		{"localhost:5000/app", imageReference{name: "localhost:5000/app", registry: "localhost:5000", repository: "app", tag: "latest"}},
+		{"gcr.io/project/app:1.0@" + testDigest, imageReference{name: "gcr.io/project/app", registry: "gcr.io", repository: "project/app", tag: "1.0", digest: testDigest}},
+	} {
+		ref, err := parseImageReference(test.image)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, ref, test.image)
+	}
+
+	_, err := parseImageReference("")
+	assert.Error(t, err)
+}
+
+func TestIsGoogleRegistry(t *testing.T) {
+	assert.True(t, isGoogleRegistry("gcr.io"))
+	assert.True(t, isGoogleRegistry("us.gcr.io"))
+	assert.True(t, isGoogleRegistry("us-east1-docker.pkg.dev"))
+	assert.False(t, isGoogleRegistry("registry-1.docker.io"))
+	assert.False(t, isGoogleRegistry("ghcr.io"))
+}
+
+func TestRegistryClientCredentials(t *testing.T) {
+	registry := newRegistryClient(`{"type": "service_account"}`, nil)
+	username, password := registry.credentials("us.gcr.io")
+	assert.Equal(t, "_json_key", username)
+	assert.Equal(t, `{"type": "service_account"}`, password)
+
+	username, password = registry.credentials("registry-1.docker.io")
+	assert.Equal(t, "", username+password)
+
+	// No token in render-only mode
+	registry = newRegistryClient("", nil)
+	username, _ = registry.credentials("us.gcr.io")
+	assert.Equal(t, "", username)
+}
+
+func TestResolveDigest(t *testing.T) {
+	for _, sendDigest := range []bool{true, false} {
+		server := newTestRegistry(t, sendDigest)
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		registry := newRegistryClient("", nil)
+		digest, err := registry.resolveDigest(imageReference{registry: host, repository: "team/app", tag: "1.0"})
+		assert.NoError(t, err)
+		if sendDigest {
+			assert.Equal(t, testDigest, digest)
+		} else {
+			// sha256 of the manifest
+			assert.Equal(t, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(`{"schemaVersion": 2}`))), digest)
+		}
+
+		// Unknown tag
+		_, err = registry.resolveDigest(imageReference{registry: host, repository: "team/app", tag: "2.0"})
+		assert.Error(t, err)
+
+		server.Close()
+	}
+}
+
+func TestPinImageDigests(t *testing.T) {
+	server := newTestRegistry(t, true)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	o := testObject(t, fmt.Sprintf(`
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: %[1]s/team/app:1.0
+        - name: pinned
+          image: %[1]s/team/proxy@%[2]s
+`, host, testDigest))
+	service := testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\n")
+
+	err := pinImageDigests([]*manifestObject{o, service}, newRegistryClient("", nil))
+	assert.NoError(t, err)
+
+	containers := o.containers()
+	assert.Equal(t, host+"/team/app@"+testDigest, containers[0]["image"])
+	assert.Equal(t, host+"/team/proxy@"+testDigest, containers[1]["image"])
+	assert.Equal(t, fmt.Sprintf(`{"app":"%s/team/app:1.0"}`, host), nestedString(o.object, "metadata", "annotations", originalImagesAnnotation))
+	_, ok := nestedField(service.object, "metadata", "annotations")
+	assert.False(t, ok)
+
+	// Unresolvable image
+	o = testObject(t, fmt.Sprintf("apiVersion: v1\nkind: Pod\nmetadata:\n  name: pod\nspec:\n  containers:\n    - name: app\n      image: %s/team/missing:1.0\n", host))
+	err = pinImageDigests([]*manifestObject{o}, newRegistryClient("", nil))
+	assert.Error(t, err)
+}
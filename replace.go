@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	applyStrategyAnnotation = annotationPrefix + "apply-strategy"
+	specHashAnnotation      = annotationPrefix + "spec-hash"
+
+	applyStrategyApply   = "apply"
+	applyStrategyReplace = "replace"
+)
+
+// validateApplyStrategies checks the apply strategy annotations of objects
+func validateApplyStrategies(objects []*manifestObject) error {
+	for _, o := range objects {
+		switch nestedString(o.object, "metadata", "annotations", applyStrategyAnnotation) {
+		case "", applyStrategyApply:
+		case applyStrategyReplace:
+			if o.hook() != "" {
+				return fmt.Errorf("Error: %s: hooks cannot be replaced, use %s instead\n", o.location(), hookDeletePolicyAnnotation)
+			}
+		default:
+			return fmt.Errorf("Error: %s: %s must be one of %s, %s\n", o.location(), applyStrategyAnnotation, applyStrategyApply, applyStrategyReplace)
+		}
+	}
+
+	return nil
+}
+
+// usesReplaceStrategy tells whether an object is deleted and recreated when its rendered spec changes
+func usesReplaceStrategy(c *cli.Context, o *manifestObject) bool {
+	switch nestedString(o.object, "metadata", "annotations", applyStrategyAnnotation) {
+	case applyStrategyReplace:
+		return true
+	case applyStrategyApply:
+		return false
+	}
+	return c.Bool("replace-jobs") && o.kind() == "Job" && o.hook() == ""
+}
+
+// replacedObjects annotates the objects using the replace strategy with the hash of their rendered spec,
+// and returns those whose live object was applied from a different spec
+func replacedObjects(c *cli.Context, objects []*manifestObject, client clusterClient) (map[*manifestObject]bool, error) {
+	replaced := make(map[*manifestObject]bool)
+
+	for _, o := range objects {
+		if !usesReplaceStrategy(c, o) {
+			continue
+		}
+
+		blob, err := encodeObjects([]*manifestObject{o})
+		if err != nil {
+			return nil, err
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(blob))
+
+		annotations, ok := ensureNestedMap(o.object, "metadata", "annotations")
+		if !ok {
+			return nil, fmt.Errorf("Error: %s: metadata.annotations is not a map\n", o.location())
+		}
+		annotations[specHashAnnotation] = hash
+
+		live, found, err := client.get(o)
+		if err != nil {
+			return nil, fmt.Errorf("Error fetching %s: %s\n", o, err)
+		}
+
+		if found && nestedString(live, "metadata", "annotations", specHashAnnotation) != hash {
+			log("%s changed since it was applied, it will be replaced\n", o)
+			replaced[o] = true
+		}
+	}
+
+	return replaced, nil
+}
+
+// deleteReplacedObjects deletes the live objects of the replaced objects among objects
+func deleteReplacedObjects(objects []*manifestObject, replaced map[*manifestObject]bool, client clusterClient) error {
+	for _, o := range objects {
+		if !replaced[o] {
+			continue
+		}
+
+		log("Deleting %s to replace it\n", o)
+
+		if err := client.delete(o); err != nil {
+			return fmt.Errorf("Error: %s\n", err)
+		}
+	}
+
+	return nil
+}
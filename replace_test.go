@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+const testJob = `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: seed
+spec:
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+        - name: seed
+          image: gcr.io/project/app:1.0
+`
+
+func TestValidateApplyStrategies(t *testing.T) {
+	o := testObject(t, "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: j\n  annotations:\n    drone-gke.nytimes.com/apply-strategy: replace\n")
+	assert.NoError(t, validateApplyStrategies([]*manifestObject{o, testObject(t, testJob)}))
+
+	o = testObject(t, "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: j\n  annotations:\n    drone-gke.nytimes.com/apply-strategy: recreate\n")
+	assert.Error(t, validateApplyStrategies([]*manifestObject{o}))
+
+	// Hooks have their own delete policy
+	o = testObject(t, "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: j\n  annotations:\n    drone-gke.nytimes.com/apply-strategy: replace\n    drone-gke.nytimes.com/hook: pre-deploy\n")
+	assert.Error(t, validateApplyStrategies([]*manifestObject{o}))
+}
+
+func TestUsesReplaceStrategy(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.Bool("replace-jobs", false, "")
+	c := cli.NewContext(nil, set, nil)
+
+	job := testObject(t, testJob)
+	annotated := testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: s\n  annotations:\n    drone-gke.nytimes.com/apply-strategy: replace\n")
+	optedOut := testObject(t, "apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: j\n  annotations:\n    drone-gke.nytimes.com/apply-strategy: apply\n")
+
+	assert.False(t, usesReplaceStrategy(c, job))
+	assert.True(t, usesReplaceStrategy(c, annotated))
+	assert.False(t, usesReplaceStrategy(c, optedOut))
+
+	set.Set("replace-jobs", "true")
+	assert.True(t, usesReplaceStrategy(c, job))
+	assert.True(t, usesReplaceStrategy(c, annotated))
+	assert.False(t, usesReplaceStrategy(c, optedOut))
+	assert.False(t, usesReplaceStrategy(c, testObject(t, testHookJob)))
+	assert.False(t, usesReplaceStrategy(c, testObject(t, testDeployment)))
+}
+
+func TestReplacedObjects(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.Bool("replace-jobs", true, "")
+	c := cli.NewContext(nil, set, nil)
+
+	job := testObject(t, testJob)
+
+	// Not applied yet
+	testRunner := new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "job/seed", "--ignore-not-found", "-o=json"}).Return("", nil).Once()
+	replaced, err := replacedObjects(c, []*manifestObject{job, testObject(t, testDeployment)}, &kubectlClient{runner: testRunner})
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+	assert.Empty(t, replaced)
+
+	hash := nestedString(job.object, "metadata", "annotations", specHashAnnotation)
+	assert.Len(t, hash, 64)
+
+	// Unchanged
+	job = testObject(t, testJob)
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "job/seed", "--ignore-not-found", "-o=json"}).Return(`{"metadata": {"annotations": {"drone-gke.nytimes.com/spec-hash": "`+hash+`"}}}`, nil).Once()
+	replaced, err = replacedObjects(c, []*manifestObject{job}, &kubectlClient{runner: testRunner})
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+	assert.Empty(t, replaced)
+
+	// Changed, or applied without the replace strategy
+	for _, live := range []string{`{"metadata": {"annotations": {"drone-gke.nytimes.com/spec-hash": "0123"}}}`, `{"metadata": {"name": "seed"}}`} {
+		job = testObject(t, testJob)
+		testRunner = new(MockedRunner)
+		testRunner.On("Output", []string{"kubectl", "get", "job/seed", "--ignore-not-found", "-o=json"}).Return(live, nil).Once()
+		replaced, err = replacedObjects(c, []*manifestObject{job}, &kubectlClient{runner: testRunner})
+		testRunner.AssertExpectations(t)
+		assert.NoError(t, err)
+		assert.Equal(t, map[*manifestObject]bool{job: true}, replaced)
+	}
+}
+
+func TestApplyManifestsReplace(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("kube-template", ".kube.yml", "")
+	set.String("secret-template", ".kube.sec.yml", "")
+	set.Bool("dry-run", false, "")
+	set.Int("wait-jobs-seconds", 60, "")
+	c := cli.NewContext(nil, set, nil)
+
+	job := testObject(t, testJob)
+	replaced := map[*manifestObject]bool{job: true}
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "apply", "--dry-run=client", "--filename", "/tmp/validate-6.yml"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "delete", "job/seed", "--ignore-not-found", "--wait=true"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "apply", "--filename", "/tmp/apply-6.yml"}).Return(nil).Once()
+	err := applyManifests(c, []*manifestObject{job}, replaced, &kubectlClient{runner: testRunner, runnerSecret: testRunner}, nil)
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+
+	testRunner = new(MockedRunner)
+	testRunner.On("Output", []string{"kubectl", "get", "job/seed", "-o=json"}).Return(testJobComplete, nil).Once()
+	_, err = waitForResources(c, replacedJobWaits(c, []*manifestObject{job, testObject(t, testDeployment)}, replaced), &kubectlClient{runner: testRunner})
+	testRunner.AssertExpectations(t)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// maxRetryBackoff caps the delay between the attempts of a command
+const maxRetryBackoff = 30 * time.Second
+
+// retryableErrors matches the error output of the gcloud and kubectl commands which failed for a transient reason,
+// e.g. the API server was unavailable or a token could not be refreshed
+var retryableErrors = regexp.MustCompile(`(?i)` +
+	`TLS handshake timeout|i/o timeout|connection refused|connection reset by peer|unexpected EOF|http2: server sent GOAWAY|` +
+	`Unable to connect to the server|the server is currently unable to handle the request|` +
+	`the server was unable to return a response in the time allotted|etcdserver: request timed out|` +
+	`Error from server \((InternalError|ServiceUnavailable|ServerTimeout|Timeout|TooManyRequests)\)|` +
+	`code=(429|500|502|503|504)|` +
+	`There was a problem refreshing your current auth tokens|oauth2: cannot fetch token|Error fetching access token`)
+
+// RetryRunner executes programs with a BasicRunner, retrying those which failed with a retryable error output
+// with an exponential backoff
+type RetryRunner struct {
+	runner   *BasicRunner
+	attempts int
+	backoff  time.Duration
+	sleep    func(ctx context.Context, d time.Duration) error
+}
+
+// NewRetryRunner returns a runner attempting the programs up to attempts times, first retrying after backoff
+func NewRetryRunner(runner *BasicRunner, attempts int, backoff time.Duration) *RetryRunner {
+	return &RetryRunner{
+		runner:   runner,
+		attempts: attempts,
+		backoff:  backoff,
+		sleep:    sleepContext,
+	}
+}
+
+// newRetryRunner returns a runner retrying the programs as configured by the retry-attempts and retry-backoff-seconds params
+func newRetryRunner(c *cli.Context, runner *BasicRunner) Runner {
+	return NewRetryRunner(runner, c.Int("retry-attempts"), time.Duration(c.Int("retry-backoff-seconds"))*time.Second)
+}
+
+// WithOutput returns a copy of the runner writing the output of the programs to stdout and stderr.
+func (r *RetryRunner) WithOutput(stdout, stderr io.Writer) Runner {
+	retry := *r
+	retry.runner = r.runner.withWriters(stdout, stderr)
+	return &retry
+}
+
+// Quiet returns a copy of the runner which does not print or log the programs it runs.
+func (r *RetryRunner) Quiet() Runner {
+	runner := *r.runner
+	runner.quiet = true
+	retry := *r
+	retry.runner = &runner
+	return &retry
+}
+
+// Run executes the given program, retrying it while it fails with a retryable error and ctx is not done.
+func (r *RetryRunner) Run(ctx context.Context, name string, arg ...string) error {
+	return r.retry(ctx, name, arg, func(runner *BasicRunner) error {
+		return runner.Run(ctx, name, arg...)
+	})
+}
+
+// Output executes the given program like Run, returning the output of its last attempt.
+func (r *RetryRunner) Output(ctx context.Context, name string, arg ...string) (*Result, error) {
+	var result *Result
+	err := r.retry(ctx, name, arg, func(runner *BasicRunner) (err error) {
+		result, err = runner.Output(ctx, name, arg...)
+		return err
+	})
+	return result, err
+}
+
+// retry calls attempt with the runner until it succeeds, fails with an error which is not retryable,
+// or the attempts are exhausted. Programs run with arg which are not idempotent are attempted once.
+func (r *RetryRunner) retry(ctx context.Context, name string, arg []string, attempt func(runner *BasicRunner) error) error {
+	delay := r.backoff
+
+	for n := 1; ; n++ {
+		// Capture the error output to classify the failure, still writing it where the runner does
+		var stderr bytes.Buffer
+		var w io.Writer = &stderr
+		if r.runner.stderr != nil {
+			w = io.MultiWriter(r.runner.stderr, &stderr)
+		}
+
+		err := attempt(r.runner.withWriters(r.runner.stdout, w))
+		if err == nil || n >= r.attempts || ctx.Err() != nil || !idempotent(arg) {
+			return err
+		}
+
+		// Only the matched error is logged, the output of the secret commands may hold secrets
+		cause := retryableErrors.FindString(stderr.String())
+		if cause == "" {
+			return err
+		}
+
+		log("Retrying %s in %s (attempt %d of %d), it failed with %q\n", name, delay, n+1, r.attempts, cause)
+		if sleepErr := r.sleep(ctx, delay); sleepErr != nil {
+			return err
+		}
+
+		delay *= 2
+		if delay > maxRetryBackoff {
+			delay = maxRetryBackoff
+		}
+	}
+}
+
+// idempotentCommands lists the gcloud and kubectl commands which can be attempted again: those reading objects
+// or local config, and kubectl apply. Others, e.g. kubectl create, replace, patch, delete or rollout undo, may have
+// changed the objects in an attempt failing for a transient reason, the next attempt would fail or change them again.
+var idempotentCommands = [][]string{
+	{"get"}, {"describe"}, {"logs"}, {"version"}, {"wait"}, {"rollout", "status"}, {"rollout", "history"},
+	{"config"}, {"apply"},
+	{"auth", "activate-service-account"}, {"container", "clusters", "get-credentials"},
+}
+
+// idempotent tells whether a program run with arg can be attempted again
+func idempotent(arg []string) bool {
+	for _, command := range idempotentCommands {
+		if len(arg) >= len(command) && slices.Equal(arg[:len(command)], command) {
+			return true
+		}
+	}
+	return false
+}
+
+// sleepContext waits for d, failing once ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
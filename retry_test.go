@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRetryRunner returns a runner whose sleeps are recorded in delays
+func testRetryRunner(attempts int, stdout, stderr *bytes.Buffer, delays *[]time.Duration) *RetryRunner {
+	r := NewRetryRunner(NewBasicRunner("", []string{}, stdout, stderr), attempts, time.Second)
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return nil
+	}
+	return r
+}
+
+// failingScript writes a program failing the first failures times it is run, printing message to stderr,
+// and returns its path
+func failingScript(t *testing.T, failures int, message string) (string, func()) {
+	dir, err := ioutil.TempDir("", "retry")
+	if err != nil {
+		t.Fatalf("creating the temp dir: %s", err)
+	}
+
+	count := filepath.Join(dir, "count")
+	script := `#!/bin/sh
+n=$(cat ` + count + ` 2>/dev/null || echo 0); echo $((n+1)) > ` + count + `;
+if [ "$n" -lt ` + strconv.Itoa(failures) + ` ]; then echo "` + message + `" >&2; exit 1; fi; echo done
+`
+	program := filepath.Join(dir, "kubectl")
+	if err := ioutil.WriteFile(program, []byte(script), 0755); err != nil {
+		t.Fatalf("writing the script: %s", err)
+	}
+	return program, func() { os.RemoveAll(dir) }
+}
+
+// scriptRuns returns how many times the program written by failingScript was run
+func scriptRuns(t *testing.T, program string) string {
+	count, err := ioutil.ReadFile(filepath.Join(filepath.Dir(program), "count"))
+	if err != nil {
+		t.Fatalf("reading the count: %s", err)
+	}
+	return strings.TrimSpace(string(count))
+}
+
+func TestRetryRunner(t *testing.T) {
+	// Retried until it succeeded
+	var stdout, stderr bytes.Buffer
+	var delays []time.Duration
+	script, cleanup := failingScript(t, 3, "Unable to connect to the server: net/http: TLS handshake timeout")
+	defer cleanup()
+	assert.NoError(t, testRetryRunner(4, &stdout, &stderr, &delays).Run(context.Background(), script, "get", "deployment/app"))
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, delays)
+	assert.Equal(t, 4, strings.Count(stdout.String(), "$ "+script+" get deployment/app\n"))
+	assert.True(t, strings.HasSuffix(stdout.String(), "\ndone\n"), stdout.String())
+	assert.Contains(t, stderr.String(), "TLS handshake timeout")
+
+	// Out of attempts
+	delays = nil
+	script, cleanup = failingScript(t, 3, "Error from server (InternalError): Internal error occurred: etcd cluster is unavailable")
+	defer cleanup()
+	assert.EqualError(t, testRetryRunner(2, &stdout, &stderr, &delays).Run(context.Background(), script, "apply", "--filename", "/tmp/.kube-gke.yml"), "exit status 1")
+	assert.Equal(t, []time.Duration{time.Second}, delays)
+
+	// Not retryable
+	delays = nil
+	script, cleanup = failingScript(t, 1, "Error from server (NotFound): deployments.apps app not found")
+	defer cleanup()
+	assert.EqualError(t, testRetryRunner(3, &stdout, &stderr, &delays).Run(context.Background(), script, "rollout", "status", "deployment/app"), "exit status 1")
+	assert.Empty(t, delays)
+
+	// Not idempotent
+	for _, arg := range [][]string{
+		{"create", "--filename", "/tmp/lease-drone-gke-lock.yml"},
+		{"rollout", "undo", "deployment/app"},
+		{"replace", "--filename", "/tmp/lease-drone-gke-lock.yml"},
+		{"patch", "service/app", "--type=merge", "--patch={}"},
+		{"delete", "job/migrate", "--ignore-not-found", "--wait=true"},
+	} {
+		delays = nil
+		script, cleanup = failingScript(t, 1, "Unable to connect to the server: net/http: TLS handshake timeout")
+		defer cleanup()
+		assert.EqualError(t, testRetryRunner(3, &stdout, &stderr, &delays).Run(context.Background(), script, arg...), "exit status 1", arg)
+		assert.Empty(t, delays, arg)
+		assert.Equal(t, "1", scriptRuns(t, script), arg)
+	}
+
+	// Output of the attempt which succeeded
+	delays = nil
+	script, cleanup = failingScript(t, 1, "dial tcp 35.1.2.3:443: connect: connection refused")
+	defer cleanup()
+	result, err := testRetryRunner(3, &stdout, &stderr, &delays).Output(context.Background(), script, "version", "-o=json")
+	assert.NoError(t, err)
+	assert.Equal(t, "done\n", string(result.Stdout))
+	assert.Equal(t, []time.Duration{time.Second}, delays)
+	assert.Equal(t, "2", scriptRuns(t, script))
+}
+
+func TestIdempotent(t *testing.T) {
+	for _, arg := range [][]string{
+		{"get", "deployment/app", "-o=json"},
+		{"apply", "--filename", "/tmp/.kube-gke.yml"},
+		{"rollout", "status", "deployment/app"},
+		{"config", "set-context", "gke", "--namespace", "app"},
+		{"auth", "activate-service-account", "--key-file", "/tmp/gcloud.json"},
+		{"container", "clusters", "get-credentials", "cluster"},
+	} {
+		assert.True(t, idempotent(arg), arg)
+	}
+
+	for _, arg := range [][]string{
+		{},
+		{"rollout", "undo", "deployment/app"},
+		{"rollout"},
+		{"container", "clusters", "delete", "cluster"},
+	} {
+		assert.False(t, idempotent(arg), arg)
+	}
+}
+
+func TestRetryableErrors(t *testing.T) {
+	for _, output := range []string{
+		"Unable to connect to the server: dial tcp 35.1.2.3:443: i/o timeout",
+		"Error from server (ServiceUnavailable): the server is currently unable to handle the request",
+		"ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=503, message=Service Unavailable",
+		"ERROR: (gcloud.auth.activate-service-account) There was a problem refreshing your current auth tokens",
+	} {
+		assert.True(t, retryableErrors.MatchString(output), output)
+	}
+
+	for _, output := range []string{
+		`Error from server (Forbidden): deployments.apps "app" is forbidden`,
+		"error: deployment \"app\" exceeded its progress deadline",
+		"ERROR: (gcloud.container.clusters.get-credentials) ResponseError: code=404, message=Not found",
+	} {
+		assert.False(t, retryableErrors.MatchString(output), output)
+	}
+}
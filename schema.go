@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Kubernetes OpenAPI definitions, generated by bin/update-schemas
+//
+//go:embed schemas
+var bundledSchemas embed.FS
+
+const schemasDir = "schemas"
+
+// schema is the subset of an OpenAPI schema used to validate manifests.
+// Both the bundled Kubernetes definitions and CustomResourceDefinition schemas are read into it.
+type schema struct {
+	Ref                   string                `json:"$ref"`
+	Type                  string                `json:"type"`
+	Format                string                `json:"format"`
+	Required              []string              `json:"required"`
+	Enum                  []interface{}         `json:"enum"`
+	Properties            map[string]*schema    `json:"properties"`
+	Items                 *schema               `json:"items"`
+	AdditionalProperties  *additionalProperties `json:"additionalProperties"`
+	IntOrString           bool                  `json:"x-kubernetes-int-or-string"`
+	PreserveUnknownFields bool                  `json:"x-kubernetes-preserve-unknown-fields"`
+	GroupVersionKinds     []struct {
+		Group   string `json:"group"`
+		Version string `json:"version"`
+		Kind    string `json:"kind"`
+	} `json:"x-kubernetes-group-version-kind"`
+}
+
+// additionalProperties is either a boolean or a schema for fields not listed in properties
+type additionalProperties struct {
+	allowed bool
+	schema  *schema
+}
+
+func (a *additionalProperties) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &a.allowed); err == nil {
+		return nil
+	}
+
+	a.allowed = true
+	return json.Unmarshal(data, &a.schema)
+}
+
+// schemaSet holds schemas by apiVersion and kind
+type schemaSet struct {
+	definitions map[string]*schema
+	kinds       map[string]*schema
+	// kinds defined by CustomResourceDefinitions, where apiVersion, kind and metadata are implicit
+	customKinds map[string]bool
+}
+
+// schemaError describes a field which does not match its schema, without including its value
+type schemaError struct {
+	path    string
+	message string
+}
+
+func (e schemaError) Error() string {
+	if e.path == "" {
+		return e.message
+	}
+	return fmt.Sprintf("%s: %s", e.path, e.message)
+}
+
+// validateSchemas validates objects against the bundled Kubernetes schemas for the target version,
+// and custom resources against the schemas of CustomResourceDefinitions
+func validateSchemas(c *cli.Context, objects []*manifestObject) error {
+	version, err := bundledSchemaVersion(c.String("kubernetes-version"))
+	if err != nil {
+		return err
+	}
+
+	log("Validating Kubernetes manifests against the Kubernetes %s schemas\n", version)
+
+	schemas, err := loadBundledSchemas(version)
+	if err != nil {
+		return err
+	}
+
+	// CRDs provided as schemas and CRDs applied along with their custom resources
+	crds := []*manifestObject{}
+	for _, crdPath := range c.StringSlice("crd-schemas") {
+		parsed, err := parseManifest(crdPath, crdPath)
+		if err != nil {
+			return err
+		}
+		crds = append(crds, parsed...)
+	}
+	crds = append(crds, objects...)
+
+	if err := schemas.addCRDs(crds); err != nil {
+		return err
+	}
+
+	errorCount := 0
+	for _, o := range objects {
+		s, ok := schemas.lookup(o.apiVersion(), o.kind())
+		if !ok {
+			log("Warning: skipping validation of %s, no schema found for %s %s\n", o.location(), o.apiVersion(), o.kind())
+			continue
+		}
+
+		for _, e := range schemas.validate(s, o) {
+			fmt.Fprintf(logStdout(), "%s: %s\n", o.location(), e)
+			errorCount++
+		}
+	}
+
+	if errorCount > 0 {
+		return fmt.Errorf("Error: %d schema validation error(s) found in the rendered manifests\n", errorCount)
+	}
+
+	return nil
+}
+
+// bundledSchemaVersion returns the bundled schema version closest to the target Kubernetes version,
+// defaulting to the latest bundled version
+func bundledSchemaVersion(target string) (string, error) {
+	entries, err := bundledSchemas.ReadDir(schemasDir)
+	if err != nil {
+		return "", fmt.Errorf("Error reading bundled schemas: %s\n", err)
+	}
+
+	versions := []int64{}
+	for _, entry := range entries {
+		minor, err := parseMinorVersion(strings.TrimSuffix(entry.Name(), ".json.gz"))
+		if err != nil {
+			return "", fmt.Errorf("Error reading bundled schemas: %s\n", err)
+		}
+		versions = append(versions, minor)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	version := versions[len(versions)-1]
+
+	if target != "" {
+		targetMinor, err := parseMinorVersion(target)
+		if err != nil {
+			return "", fmt.Errorf("Invalid param kubernetes-version: %s\n", err)
+		}
+
+		// Use the newest version which is not newer than the target
+		version = versions[0]
+		for _, v := range versions {
+			if v <= targetMinor {
+				version = v
+			}
+		}
+
+		if version != targetMinor {
+			log("Warning: no schemas bundled for Kubernetes %s, using 1.%d\n", target, version)
+		}
+	}
+
+	return fmt.Sprintf("1.%d", version), nil
+}
+
+// parseMinorVersion parses the minor version of a Kubernetes version, e.g. 1.34, v1.34 or v1.34.2
+func parseMinorVersion(version string) (int64, error) {
+	parts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(parts) < 2 || parts[0] != "1" {
+		return 0, fmt.Errorf("%q is not a Kubernetes 1.x version", version)
+	}
+
+	minor, err := strconv.ParseInt(strings.TrimSuffix(parts[1], "+"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a Kubernetes 1.x version", version)
+	}
+
+	return minor, nil
+}
+
+// loadBundledSchemas reads the bundled definitions of a Kubernetes version, e.g. 1.34
+func loadBundledSchemas(version string) (*schemaSet, error) {
+	compressed, err := bundledSchemas.ReadFile(path.Join(schemasDir, fmt.Sprintf("v%s.json.gz", version)))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading bundled schemas: %s\n", err)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading bundled schemas: %s\n", err)
+	}
+
+	blob, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading bundled schemas: %s\n", err)
+	}
+
+	var spec struct {
+		Definitions map[string]*schema `json:"definitions"`
+	}
+
+	if err := json.Unmarshal(blob, &spec); err != nil {
+		return nil, fmt.Errorf("Error parsing bundled schemas: %s\n", err)
+	}
+
+	schemas := &schemaSet{
+		definitions: spec.Definitions,
+		kinds:       make(map[string]*schema),
+		customKinds: make(map[string]bool),
+	}
+
+	for _, s := range spec.Definitions {
+		for _, gvk := range s.GroupVersionKinds {
+			schemas.kinds[schemaKey(groupVersion(gvk.Group, gvk.Version), gvk.Kind)] = s
+		}
+	}
+
+	return schemas, nil
+}
+
+// addCRDs adds the schemas of every version of the CustomResourceDefinitions among objects
+func (s *schemaSet) addCRDs(objects []*manifestObject) error {
+	for _, o := range objects {
+		if o.apiVersion() != "apiextensions.k8s.io/v1" || o.kind() != "CustomResourceDefinition" {
+			continue
+		}
+
+		group := nestedString(o.object, "spec", "group")
+		kind := nestedString(o.object, "spec", "names", "kind")
+		versions, _ := nestedField(o.object, "spec", "versions")
+		versionList, _ := versions.([]interface{})
+
+		for _, v := range versionList {
+			version, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			openAPIV3Schema, ok := nestedField(version, "schema", "openAPIV3Schema")
+			if !ok {
+				continue
+			}
+
+			// The schema was parsed from YAML, convert it through JSON
+			blob, err := json.Marshal(openAPIV3Schema)
+			if err != nil {
+				return fmt.Errorf("Error reading schema of %s: %s\n", o.location(), err)
+			}
+
+			var crdSchema schema
+			if err := json.Unmarshal(blob, &crdSchema); err != nil {
+				return fmt.Errorf("Error reading schema of %s: %s\n", o.location(), err)
+			}
+
+			key := schemaKey(groupVersion(group, nestedString(version, "name")), kind)
+			s.kinds[key] = &crdSchema
+			s.customKinds[key] = true
+		}
+	}
+
+	return nil
+}
+
+// lookup returns the schema of objects of the given apiVersion and kind
+func (s *schemaSet) lookup(apiVersion, kind string) (*schema, bool) {
+	found, ok := s.kinds[schemaKey(apiVersion, kind)]
+	return found, ok
+}
+
+// validate validates an object against its schema
+func (s *schemaSet) validate(objectSchema *schema, o *manifestObject) []schemaError {
+	object := o.object
+
+	// CRD schemas usually leave out the fields common to every object
+	if s.customKinds[schemaKey(o.apiVersion(), o.kind())] {
+		object = make(map[string]interface{})
+		for k, v := range o.object {
+			if k != "apiVersion" && k != "kind" && k != "metadata" {
+				object[k] = v
+			}
+		}
+	}
+
+	errs := []schemaError{}
+	s.validateValue(objectSchema, object, "", &errs)
+	return errs
+}
+
+func (s *schemaSet) validateValue(valueSchema *schema, value interface{}, fieldPath string, errs *[]schemaError) {
+	valueSchema = s.resolve(valueSchema)
+	if valueSchema == nil || value == nil {
+		return
+	}
+
+	fail := func(format string, a ...interface{}) {
+		*errs = append(*errs, schemaError{path: fieldPath, message: fmt.Sprintf(format, a...)})
+	}
+
+	actual := jsonType(value)
+
+	if valueSchema.IntOrString || valueSchema.Format == "int-or-string" {
+		if actual != "integer" && actual != "string" {
+			fail("expected integer or string, got %s", actual)
+		}
+		return
+	}
+
+	if valueSchema.Format == "quantity" {
+		if actual != "integer" && actual != "number" && actual != "string" {
+			fail("expected quantity, got %s", actual)
+		}
+		return
+	}
+
+	switch valueSchema.Type {
+	case "object":
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			fail("expected object, got %s", actual)
+			return
+		}
+		s.validateObject(valueSchema, m, fieldPath, errs)
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			fail("expected array, got %s", actual)
+			return
+		}
+		for i, item := range items {
+			s.validateValue(valueSchema.Items, item, fmt.Sprintf("%s[%d]", fieldPath, i), errs)
+		}
+	case "number":
+		if actual != "integer" && actual != "number" {
+			fail("expected number, got %s", actual)
+		}
+	case "integer", "string", "boolean":
+		if actual != valueSchema.Type {
+			fail("expected %s, got %s", valueSchema.Type, actual)
+		}
+	case "":
+		if m, ok := value.(map[string]interface{}); ok && valueSchema.Properties != nil {
+			s.validateObject(valueSchema, m, fieldPath, errs)
+		}
+	}
+
+	if len(valueSchema.Enum) > 0 && !containsValue(valueSchema.Enum, value) {
+		allowed := []string{}
+		for _, e := range valueSchema.Enum {
+			allowed = append(allowed, fmt.Sprint(e))
+		}
+		fail("must be one of: %s", strings.Join(allowed, ", "))
+	}
+}
+
+func (s *schemaSet) validateObject(objectSchema *schema, object map[string]interface{}, fieldPath string, errs *[]schemaError) {
+	for _, field := range objectSchema.Required {
+		if _, ok := object[field]; !ok {
+			*errs = append(*errs, schemaError{path: joinFieldPath(fieldPath, field), message: "missing required field"})
+		}
+	}
+
+	// Report errors in a stable order
+	fields := make([]string, 0, len(object))
+	for field := range object {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		childPath := joinFieldPath(fieldPath, field)
+
+		if fieldSchema, ok := objectSchema.Properties[field]; ok {
+			s.validateValue(fieldSchema, object[field], childPath, errs)
+			continue
+		}
+
+		if objectSchema.AdditionalProperties != nil {
+			if objectSchema.AdditionalProperties.schema != nil {
+				s.validateValue(objectSchema.AdditionalProperties.schema, object[field], childPath, errs)
+			}
+			if objectSchema.AdditionalProperties.allowed {
+				continue
+			}
+		}
+
+		// Objects without any properties accept arbitrary fields, as does the API server
+		if len(objectSchema.Properties) > 0 && !objectSchema.PreserveUnknownFields {
+			*errs = append(*errs, schemaError{path: childPath, message: "unknown field"})
+		}
+	}
+}
+
+// resolve follows references to definitions
+func (s *schemaSet) resolve(valueSchema *schema) *schema {
+	for valueSchema != nil && valueSchema.Ref != "" {
+		valueSchema = s.definitions[strings.TrimPrefix(valueSchema.Ref, "#/definitions/")]
+	}
+	return valueSchema
+}
+
+func schemaKey(apiVersion, kind string) string {
+	return apiVersion + " " + kind
+}
+
+// groupVersion builds an apiVersion, the core group is empty
+func groupVersion(group, version string) string {
+	if group == "" {
+		return version
+	}
+	return group + "/" + version
+}
+
+func joinFieldPath(fieldPath, field string) string {
+	if fieldPath == "" {
+		return field
+	}
+	return fieldPath + "." + field
+}
+
+// jsonType returns the JSON type of a value parsed from YAML
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string, time.Time:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int64, uint64:
+		return "integer"
+	case float64:
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if fmt.Sprint(v) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
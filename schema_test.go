@@ -0,0 +1,209 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// testObject parses a single manifest object from YAML
+func testObject(t *testing.T, manifest string) *manifestObject {
+	object := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(manifest), &object); err != nil {
+		t.Fatalf("invalid test manifest: %s", err)
+	}
+	return &manifestObject{file: ".kube.yml", index: 1, object: object}
+}
+
+const testDeployment = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 3
+  selector:
+    matchLabels:
+      app: echo
+  template:
+    metadata:
+      labels:
+        app: echo
+    spec:
+      containers:
+        - name: app
+          image: gcr.io/google_containers/echoserver:1.4
+          ports:
+            - containerPort: 8080
+          resources:
+            requests:
+              cpu: 0.5
+              memory: 128Mi
+            limits:
+              cpu: 1
+`
+
+const testCRD = `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+    - name: v1
+      served: true
+      storage: true
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [size]
+              properties:
+                size:
+                  type: integer
+                color:
+                  type: string
+                  enum: [red, blue]
+`
+
+func TestParseMinorVersion(t *testing.T) {
+	for _, version := range []string{"1.34", "v1.34", "v1.34.2", "1.34+"} {
+		minor, err := parseMinorVersion(version)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(34), minor)
+	}
+
+	_, err := parseMinorVersion("2.1")
+	assert.Error(t, err)
+	_, err = parseMinorVersion("latest")
+	assert.Error(t, err)
+}
+
+func TestBundledSchemaVersion(t *testing.T) {
+	// Latest bundled version by default
+	version, err := bundledSchemaVersion("")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.36", version)
+
+	version, err = bundledSchemaVersion("1.34.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.34", version)
+
+	// Closest version
+	version, err = bundledSchemaVersion("1.40")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.36", version)
+
+	version, err = bundledSchemaVersion("1.20")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.33", version)
+
+	_, err = bundledSchemaVersion("invalid")
+	assert.Error(t, err)
+}
+
+func TestSchemaSetValidate(t *testing.T) {
+	schemas, err := loadBundledSchemas("1.34")
+	assert.NoError(t, err)
+
+	// Valid
+	o := testObject(t, testDeployment)
+	s, ok := schemas.lookup(o.apiVersion(), o.kind())
+	if assert.True(t, ok) {
+		assert.Empty(t, schemas.validate(s, o))
+	}
+
+	// Wrong types, unknown and missing fields
+	o = testObject(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: 1
+spec:
+  replicas: "3"
+  selector:
+    matchLabels:
+      app: echo
+  template:
+    spec:
+      contianers: []
+      containers:
+        - image: echo
+          ports:
+            - containerPort: http
+`)
+	s, _ = schemas.lookup(o.apiVersion(), o.kind())
+	assert.Equal(t, []schemaError{
+		{path: "metadata.labels.app", message: "expected string, got integer"},
+		{path: "spec.replicas", message: "expected integer, got string"},
+		{path: "spec.template.spec.containers[0].name", message: "missing required field"},
+		{path: "spec.template.spec.containers[0].ports[0].containerPort", message: "expected integer, got string"},
+		{path: "spec.template.spec.contianers", message: "unknown field"},
+	}, schemas.validate(s, o))
+
+	// Removed API
+	_, ok = schemas.lookup("extensions/v1beta1", "Deployment")
+	assert.False(t, ok)
+
+	// Custom resources
+	err = schemas.addCRDs([]*manifestObject{testObject(t, testCRD)})
+	assert.NoError(t, err)
+	o = testObject(t, `
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: widget
+spec:
+  color: green
+`)
+	s, ok = schemas.lookup(o.apiVersion(), o.kind())
+	if assert.True(t, ok) {
+		assert.Equal(t, []schemaError{
+			{path: "spec.size", message: "missing required field"},
+			{path: "spec.color", message: "must be one of: red, blue"},
+		}, schemas.validate(s, o))
+	}
+}
+
+func TestValidateSchemas(t *testing.T) {
+	err := os.MkdirAll("/tmp/drone-gke-tests/", os.ModePerm)
+	assert.NoError(t, err)
+	crdPath := "/tmp/drone-gke-tests/crd.yml"
+	err = os.WriteFile(crdPath, []byte(testCRD), 0600)
+	assert.NoError(t, err)
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("kubernetes-version", "1.34", "")
+	crdSchemas := cli.NewStringSlice(crdPath)
+	crdSchemasFlag := cli.StringSliceFlag{Name: "crd-schemas", Value: crdSchemas}
+	crdSchemasFlag.Apply(set)
+	c := cli.NewContext(nil, set, nil)
+
+	// Valid, objects without a schema are skipped
+	err = validateSchemas(c, []*manifestObject{
+		testObject(t, testDeployment),
+		testObject(t, "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\nspec:\n  size: 1\n"),
+		testObject(t, "apiVersion: example.com/v1\nkind: Gadget\nmetadata:\n  name: g\n"),
+	})
+	assert.NoError(t, err)
+
+	// Invalid
+	err = validateSchemas(c, []*manifestObject{
+		testObject(t, "apiVersion: v1\nkind: Service\nmetadata:\n  name: app\nspec:\n  ports:\n    - port: http\n"),
+		testObject(t, "apiVersion: example.com/v1\nkind: Widget\nmetadata:\n  name: w\nspec:\n  size: large\n"),
+	})
+	assert.EqualError(t, err, "Error: 2 schema validation error(s) found in the rendered manifests\n")
+}
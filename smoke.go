@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	defaultSmokeTestInterval = 5 * time.Second
+	defaultSmokeTestTimeout  = 10 * time.Second
+
+	// smokeTestBodyLimit bounds the response body matched
+	smokeTestBodyLimit = 1 << 20
+)
+
+// smokeTest is an entry of the smoke-tests or canary-smoke-tests param
+type smokeTest struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// Status lists the expected status codes, 200 if empty
+	Status []int `json:"status"`
+	// Body is a regular expression the response body must match
+	Body string `json:"body"`
+	// Retries is the number of attempts after the first one failed
+	Retries int `json:"retries"`
+	// Interval between attempts and Timeout of each request, e.g. 5s
+	Interval string `json:"interval"`
+	Timeout  string `json:"timeout"`
+
+	body     *regexp.Regexp
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// parseSmokeTests parses the smoke-tests or canary-smoke-tests param (in JSON)
+func parseSmokeTests(c *cli.Context, name string) ([]*smokeTest, error) {
+	tests := []*smokeTest{}
+
+	smokeTestsJSON := c.String(name)
+	if smokeTestsJSON == "" {
+		return tests, nil
+	}
+
+	if err := json.Unmarshal([]byte(smokeTestsJSON), &tests); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s\n", name, err)
+	}
+
+	for i, test := range tests {
+		if test.Name == "" {
+			test.Name = fmt.Sprintf("smoke test %d", i+1)
+		}
+
+		if test.URL == "" {
+			return nil, fmt.Errorf("Error parsing %s: %s: url is required\n", name, test.Name)
+		}
+
+		if test.Method == "" {
+			test.Method = http.MethodGet
+		}
+
+		if len(test.Status) == 0 {
+			test.Status = []int{http.StatusOK}
+		}
+
+		if test.Retries < 0 {
+			return nil, fmt.Errorf("Error parsing %s: %s: retries must not be negative\n", name, test.Name)
+		}
+
+		if test.Body != "" {
+			body, err := regexp.Compile(test.Body)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing %s: %s: invalid body: %s\n", name, test.Name, err)
+			}
+			test.body = body
+		}
+
+		var err error
+		if test.interval, err = parseSmokeTestDuration(test.Interval, defaultSmokeTestInterval); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s: invalid interval: %s\n", name, test.Name, err)
+		}
+		if test.timeout, err = parseSmokeTestDuration(test.Timeout, defaultSmokeTestTimeout); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s: invalid timeout: %s\n", name, test.Name, err)
+		}
+	}
+
+	return tests, nil
+}
+
+func parseSmokeTestDuration(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// smokeTestData returns templateData with the load balancer addresses, as addresses.<name>
+func smokeTestData(templateData map[string]interface{}, results []waitResult) map[string]interface{} {
+	data := make(map[string]interface{}, len(templateData)+1)
+	for k, v := range templateData {
+		data[k] = v
+	}
+
+	addresses := make(map[string]string)
+	for name, a := range addressOutputs(results) {
+		if len(a) > 0 {
+			addresses[name] = a[0]
+		}
+	}
+	data["addresses"] = addresses
+
+	return data
+}
+
+// render renders a smoke test param as a template with data
+func (s *smokeTest) render(name, value string, data map[string]interface{}) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing %s of %s: %s\n", name, s.Name, err)
+	}
+
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("Error rendering %s of %s: %s\n", name, s.Name, err)
+	}
+
+	return rendered.String(), nil
+}
+
+// runSmokeTests runs the smoke tests one after the other, retrying each until it passes or ctx is done
+func runSmokeTests(ctx context.Context, tests []*smokeTest, data map[string]interface{}) error {
+	for counter, test := range tests {
+		url, err := test.render("url", test.URL, data)
+		if err != nil {
+			return err
+		}
+
+		headers := make(map[string]string)
+		for k, v := range test.Headers {
+			if headers[k], err = test.render("header "+k, v, data); err != nil {
+				return err
+			}
+		}
+
+		log("Running %s %d/%d: %s %s\n", test.Name, counter+1, len(tests), test.Method, url)
+
+		client := &http.Client{Timeout: test.timeout}
+		for attempt := 0; ; attempt++ {
+			err = test.check(ctx, client, url, headers)
+			if err == nil {
+				fmt.Fprintf(logStdout(), "%s passed\n", test.Name)
+				break
+			}
+
+			if attempt >= test.Retries {
+				return fmt.Errorf("Error: %s failed: %s\n", test.Name, err)
+			}
+
+			fmt.Fprintf(logStdout(), "%s failed (attempt %d/%d): %s\n", test.Name, attempt+1, test.Retries+1, err)
+			if sleepErr := sleepContext(ctx, test.interval); sleepErr != nil {
+				return fmt.Errorf("Error: %s failed: %s\n", test.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// check sends the request of a smoke test and checks its response
+func (s *smokeTest) check(ctx context.Context, client *http.Client, url string, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, s.Method, url, nil)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, smokeTestBodyLimit))
+	if err != nil {
+		return err
+	}
+
+	if !containsStatus(s.Status, resp.StatusCode) {
+		return fmt.Errorf("status %d, expected one of %v", resp.StatusCode, s.Status)
+	}
+
+	if s.body != nil && !s.body.Match(body) {
+		return fmt.Errorf("body does not match %q", s.Body)
+	}
+
+	return nil
+}
+
+func containsStatus(statuses []int, status int) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// rollback rolls back the rollouts listed in wait-deployments and waits for them
+func rollback(c *cli.Context, client clusterClient) error {
+	waits := rolloutWaits(c)
+	if len(waits) == 0 {
+		log("Nothing to roll back, wait-deployments is not set\n")
+		return nil
+	}
+
+	for _, w := range waits {
+		log("Rolling back %s\n", w.resource)
+
+		if err := client.rollback(w.resource, w.namespace); err != nil {
+			return fmt.Errorf("Error rolling back %s: %s\n", w.resource, err)
+		}
+	}
+
+	if _, err := waitForResources(c, waits, client); err != nil {
+		return fmt.Errorf("Error: rollback: %s\n", err)
+	}
+
+	return nil
+}
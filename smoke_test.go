@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseSmokeTests(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("smoke-tests", `[
+		{"url": "http://app/healthz"},
+		{"name": "home", "url": "http://app/", "method": "HEAD", "status": [200, 301], "body": "^ok$", "retries": 3, "interval": "1s", "timeout": "2s"}
+	]`, "")
+	c := cli.NewContext(nil, set, nil)
+
+	tests, err := parseSmokeTests(c, "smoke-tests")
+	assert.NoError(t, err)
+	assert.Len(t, tests, 2)
+
+	assert.Equal(t, "smoke test 1", tests[0].Name)
+	assert.Equal(t, http.MethodGet, tests[0].Method)
+	assert.Equal(t, []int{200}, tests[0].Status)
+	assert.Nil(t, tests[0].body)
+	assert.Equal(t, defaultSmokeTestInterval, tests[0].interval)
+	assert.Equal(t, defaultSmokeTestTimeout, tests[0].timeout)
+
+	assert.Equal(t, "home", tests[1].Name)
+	assert.Equal(t, []int{200, 301}, tests[1].Status)
+	assert.NotNil(t, tests[1].body)
+	assert.Equal(t, time.Second, tests[1].interval)
+	assert.Equal(t, 2*time.Second, tests[1].timeout)
+
+	for _, invalid := range []string{
+		`{"url": "http://app/"}`,
+		`[{"method": "GET"}]`,
+		`[{"url": "http://app/", "body": "("}]`,
+		`[{"url": "http://app/", "timeout": "10"}]`,
+		`[{"url": "http://app/", "retries": -1}]`,
+	} {
+		set.Set("smoke-tests", invalid)
+		_, err := parseSmokeTests(c, "smoke-tests")
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestRunSmokeTests(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			// Fails twice before responding
+			if atomic.AddInt32(&requests, 1) <= 2 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"status": "ok"}`))
+		case "/version":
+			assert.Equal(t, "Bearer abc", r.Header.Get("Authorization"))
+			assert.Equal(t, "app.example.com", r.Host)
+			w.Write([]byte(`{"commit": "` + r.URL.Query().Get("commit") + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	address := strings.TrimPrefix(server.URL, "http://")
+	data := smokeTestData(map[string]interface{}{"COMMIT": "abc123", "TOKEN": "abc"}, []waitResult{
+		{wait: resourceWait{resource: "service/app", address: true}, addresses: []string{address}},
+	})
+
+	parse := func(smokeTests string) []*smokeTest {
+		set := flag.NewFlagSet("test-set", 0)
+		set.String("smoke-tests", smokeTests, "")
+		tests, err := parseSmokeTests(cli.NewContext(nil, set, nil), "smoke-tests")
+		assert.NoError(t, err)
+		return tests
+	}
+
+	// Passes once retried
+	assert.NoError(t, runSmokeTests(context.Background(), parse(`[
+		{"url": "http://{{ .addresses.app }}/flaky", "body": "\"ok\"", "retries": 2, "interval": "1ms"},
+		{"url": "http://{{ .addresses.app }}/version?commit={{ .COMMIT }}", "headers": {"Authorization": "Bearer {{ .TOKEN }}", "Host": "app.example.com"}, "body": "abc123"}
+	]`), data))
+	assert.Equal(t, int32(3), requests)
+
+	// Fails once out of retries
+	atomic.StoreInt32(&requests, 0)
+	err := runSmokeTests(context.Background(), parse(`[{"name": "flaky", "url": "http://{{ .addresses.app }}/flaky", "retries": 1, "interval": "1ms"}]`), data)
+	assert.EqualError(t, err, "Error: flaky failed: status 503, expected one of [200]\n")
+
+	// Unexpected status or body
+	err = runSmokeTests(context.Background(), parse(`[{"url": "http://{{ .addresses.app }}/missing", "status": [200, 204]}]`), data)
+	assert.EqualError(t, err, "Error: smoke test 1 failed: status 404, expected one of [200 204]\n")
+	err = runSmokeTests(context.Background(), parse(`[{"url": "http://{{ .addresses.app }}/version", "headers": {"Authorization": "Bearer {{ .TOKEN }}", "Host": "app.example.com"}, "body": "^ok$"}]`), data)
+	assert.EqualError(t, err, "Error: smoke test 1 failed: body does not match \"^ok$\"\n")
+
+	// Unknown address
+	err = runSmokeTests(context.Background(), parse(`[{"url": "http://{{ .addresses.web }}/"}]`), data)
+	assert.Error(t, err)
+
+	// Stops retrying once cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = runSmokeTests(ctx, parse(`[{"name": "flaky", "url": "http://{{ .addresses.app }}/missing", "retries": 5, "interval": "1h"}]`), data)
+	assert.EqualError(t, err, "Error: flaky failed: status 404, expected one of [200]\n")
+	assert.Less(t, time.Since(start), time.Minute)
+}
+
+func TestRollback(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("namespace", "test-ns", "")
+	set.Int("wait-seconds", 60, "")
+	(&cli.StringSliceFlag{Name: "wait-deployments", Value: cli.NewStringSlice("app", "statefulset/db")}).Apply(set)
+	c := cli.NewContext(nil, set, nil)
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "rollout", "undo", "deployment/app", "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "rollout", "undo", "statefulset/db", "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "rollout", "status", "deployment/app", "--namespace", "test-ns"}).Return(nil).Once()
+	testRunner.On("Run", []string{"kubectl", "rollout", "status", "statefulset/db", "--namespace", "test-ns"}).Return(nil).Once()
+	assert.NoError(t, rollback(c, &kubectlClient{runner: testRunner}))
+	testRunner.AssertExpectations(t)
+}
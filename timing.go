@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	phasePassed  = "passed"
+	phaseFailed  = "FAILED"
+	phaseRunning = "running"
+)
+
+// phaseTiming is the duration and outcome of a phase of the run, or of a wait
+type phaseTiming struct {
+	name string
+	// resource waited for, for the waits of the wait phase
+	resource string
+	start    time.Time
+	duration time.Duration
+	err      error
+	ended    bool
+}
+
+// status is the outcome of the phase
+func (p *phaseTiming) status() string {
+	switch {
+	case !p.ended:
+		return phaseRunning
+	case p.err != nil:
+		return phaseFailed
+	}
+	return phasePassed
+}
+
+var (
+	// phases are the phases of the run so far, one after the other, and its waits
+	phases   []*phaseTiming
+	phasesMu sync.Mutex
+)
+
+// startPhase ends the running phase, if any, and starts the next phase of the run, e.g. apply
+func startPhase(name string) {
+	phasesMu.Lock()
+	now := time.Now()
+	endRunningPhase(nil, now)
+	phases = append(phases, &phaseTiming{name: name, start: now})
+	phasesMu.Unlock()
+
+	setLogPhase(name)
+	tracePhase(name)
+}
+
+// endPhase ends the running phase, which failed if err is set
+func endPhase(err error) {
+	phasesMu.Lock()
+	endRunningPhase(err, time.Now())
+	phasesMu.Unlock()
+
+	traceEndPhase(err)
+}
+
+func endRunningPhase(err error, now time.Time) {
+	for _, p := range phases {
+		if !p.ended {
+			p.duration = now.Sub(p.start)
+			p.err = err
+			p.ended = true
+		}
+	}
+}
+
+// recordWaits records the waits of the wait phase, e.g. wait deployment/app
+func recordWaits(results []waitResult) {
+	phasesMu.Lock()
+	defer phasesMu.Unlock()
+
+	for _, result := range results {
+		phases = append(phases, &phaseTiming{
+			name:     "wait",
+			resource: result.wait.resource,
+			duration: result.duration,
+			err:      result.err,
+			ended:    true,
+		})
+	}
+}
+
+// resetPhases forgets the phases of a previous run
+func resetPhases() {
+	phasesMu.Lock()
+	defer phasesMu.Unlock()
+	phases = nil
+}
+
+// printPhases prints the summary of the phases of the run, as events in the json log-format
+func printPhases() {
+	phasesMu.Lock()
+	timings := append([]*phaseTiming{}, phases...)
+	phasesMu.Unlock()
+
+	if len(timings) == 0 {
+		return
+	}
+
+	if logFormat == logFormatJSON {
+		logPhases(timings)
+		return
+	}
+
+	log("Phase summary\n")
+	printPhaseSummary(logStdout(), timings)
+}
+
+// logPhases logs the duration and outcome of each phase as an event of the json log-format,
+// the waits were logged once they completed
+func logPhases(timings []*phaseTiming) {
+	for _, p := range timings {
+		if p.resource != "" {
+			continue
+		}
+
+		seconds := p.duration.Seconds()
+		e := logEvent{Phase: p.name, Duration: &seconds, Message: "phase " + strings.ToLower(p.status())}
+		if p.err != nil {
+			e.Level, e.Error = levelError, strings.TrimSpace(p.err.Error())
+		}
+		emit(e)
+	}
+}
+
+func printPhaseSummary(w io.Writer, timings []*phaseTiming) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "PHASE\tRESULT\tDURATION\tDETAILS")
+
+	for _, p := range timings {
+		details := ""
+		if p.err != nil {
+			// The first line, errors of the deploy end with a newline
+			details = strings.SplitN(strings.TrimSpace(p.err.Error()), "\n", 2)[0]
+		}
+
+		name := p.name
+		if p.resource != "" {
+			name += " " + p.resource
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", name, p.status(), p.duration.Round(100*time.Millisecond), details)
+	}
+
+	table.Flush()
+}
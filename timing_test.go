@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhases(t *testing.T) {
+	resetPhases()
+	defer resetPhases()
+	defer setLogPhase("")
+
+	startPhase("render")
+	startPhase("apply")
+	assert.Equal(t, "apply", logPhase)
+
+	startPhase("wait")
+	recordWaits([]waitResult{
+		{wait: resourceWait{resource: "deployment/app"}, duration: 12 * time.Second},
+		{wait: resourceWait{resource: "job/migrate"}, err: errors.New("timed out waiting for job/migrate")},
+	})
+	endPhase(errors.New("Error: 1 of 2 waits failed\n"))
+
+	names, results := []string{}, []string{}
+	for _, p := range phases {
+		names, results = append(names, strings.TrimSpace(p.name+" "+p.resource)), append(results, p.status())
+	}
+	assert.Equal(t, []string{"render", "apply", "wait", "wait deployment/app", "wait job/migrate"}, names)
+	assert.Equal(t, []string{"passed", "passed", "FAILED", "passed", "FAILED"}, results)
+	assert.Equal(t, 12*time.Second, phases[3].duration)
+}
+
+func TestPrintPhaseSummary(t *testing.T) {
+	var output bytes.Buffer
+	printPhaseSummary(&output, []*phaseTiming{
+		{name: "credentials", duration: 4200 * time.Millisecond, ended: true},
+		{name: "apply", duration: 1540 * time.Millisecond, ended: true},
+		{name: "wait", duration: 90 * time.Second, err: errors.New("Error: 1 of 1 waits failed\n"), ended: true},
+		{name: "wait", resource: "deployment/app", duration: 90 * time.Second, err: errors.New("timed out waiting for deployment/app\nkubectl timed out"), ended: true},
+	})
+
+	assert.Equal(t, strings.Join([]string{
+		"PHASE                RESULT  DURATION  DETAILS",
+		"credentials          passed  4.2s      ",
+		"apply                passed  1.5s      ",
+		"wait                 FAILED  1m30s     Error: 1 of 1 waits failed",
+		"wait deployment/app  FAILED  1m30s     timed out waiting for deployment/app",
+		"",
+	}, "\n"), output.String())
+}
+
+func TestLogPhases(t *testing.T) {
+	events, restore := captureEvents(t)
+	defer restore()
+
+	logPhases([]*phaseTiming{
+		{name: "apply", duration: 1500 * time.Millisecond, ended: true},
+		{name: "wait", duration: 90 * time.Second, err: errors.New("Error: 1 of 1 waits failed\n"), ended: true},
+		{name: "wait", resource: "deployment/app", duration: 90 * time.Second, err: errors.New("timed out waiting for deployment/app"), ended: true},
+	})
+	assert.Equal(t, []map[string]interface{}{
+		{"level": "info", "phase": "apply", "duration": 1.5, "message": "phase passed"},
+		{"level": "error", "phase": "wait", "duration": float64(90), "message": "phase failed", "error": "Error: 1 of 1 waits failed"},
+	}, events())
+}
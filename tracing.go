@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// otlpTracesPath is the path of the OTLP/HTTP endpoint of the collector receiving the traces
+	otlpTracesPath = "/v1/traces"
+	// otlpExportTimeout bounds the export of the trace, which does not fail the deploy
+	otlpExportTimeout = 10 * time.Second
+
+	spanKindInternal = 1
+	spanKindClient   = 3
+	spanStatusError  = 2
+)
+
+// traceparentRegex matches a W3C trace context, capturing the trace ID and the ID of the parent span
+var traceparentRegex = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// tracing records the trace of the run, nil unless the otlp-endpoint param is set. The commands and
+// API requests of concurrent waits record their spans through it.
+var tracing atomic.Pointer[tracer]
+
+// tracer records the spans of a run, exported to an OTLP collector once the run completed
+type tracer struct {
+	endpoint string
+	client   *http.Client
+	traceID  string
+
+	mu    sync.Mutex
+	root  *otlpSpan
+	phase *otlpSpan
+	spans []*otlpSpan
+}
+
+// The OTLP/HTTP JSON encoding of a trace, see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	// IntValue is a 64-bit integer, encoded as a string
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int) otlpAttribute {
+	s := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// startTracing starts the trace of the run if the otlp-endpoint param is set,
+// as a child of the span of the traceparent param if set
+func startTracing(c *cli.Context) error {
+	tracing.Store(nil)
+
+	endpoint := c.String("otlp-endpoint")
+	if endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid param otlp-endpoint: must be an http or https URL, e.g. http://otel-collector:4318")
+	}
+	if !strings.HasSuffix(u.Path, otlpTracesPath) {
+		u.Path = strings.TrimSuffix(u.Path, "/") + otlpTracesPath
+	}
+
+	traceID, parentID := randomID(16), ""
+	if traceparent := c.String("traceparent"); traceparent != "" {
+		m := traceparentRegex.FindStringSubmatch(traceparent)
+		if m != nil && strings.Trim(m[1], "0") != "" && strings.Trim(m[2], "0") != "" {
+			traceID, parentID = m[1], m[2]
+		} else {
+			log("Warning: ignoring the invalid traceparent %q, starting a new trace\n", traceparent)
+		}
+	}
+
+	t := &tracer{
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: otlpExportTimeout},
+		traceID:  traceID,
+	}
+	t.root = t.start("deploy", parentID, spanKindInternal, time.Now())
+	tracing.Store(t)
+
+	return nil
+}
+
+// traceAttributes returns the attributes of the resource of the trace, e.g. the cluster deployed to,
+// once checkParams sanitized the params
+func traceAttributes(c *cli.Context) []otlpAttribute {
+	attributes := []otlpAttribute{stringAttribute("service.name", "drone-gke")}
+	for _, attribute := range [][2]string{
+		{"k8s.cluster.name", "cluster"},
+		{"k8s.namespace.name", "namespace"},
+		{"vcs.ref.head.revision", "drone-commit"},
+		{"cicd.pipeline.run.id", "drone-build-number"},
+	} {
+		if value := c.String(attribute[1]); value != "" {
+			attributes = append(attributes, stringAttribute(attribute[0], value))
+		}
+	}
+	return attributes
+}
+
+// start starts a span of the trace, the child of the span parentID
+func (t *tracer) start(name, parentID string, kind int, start time.Time) *otlpSpan {
+	span := &otlpSpan{
+		TraceID:           t.traceID,
+		SpanID:            randomID(8),
+		ParentSpanID:      parentID,
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: unixNano(start),
+	}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+// end ends a span, which failed if err is set
+func (t *tracer) end(span *otlpSpan, err error, end time.Time) {
+	span.EndTimeUnixNano = unixNano(end)
+	if err != nil {
+		span.Status = otlpStatus{Code: spanStatusError, Message: strings.TrimSpace(err.Error())}
+	}
+}
+
+// endPhase ends the span of the running phase, if any
+func (t *tracer) endPhase(err error) {
+	if t.phase != nil {
+		t.end(t.phase, err, time.Now())
+		t.phase = nil
+	}
+}
+
+// tracePhase ends the span of the running phase, if any, and starts the span of the next phase of the run
+func tracePhase(name string) {
+	t := tracing.Load()
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.endPhase(nil)
+	t.phase = t.start(name, t.root.SpanID, spanKindInternal, time.Now())
+}
+
+// traceEndPhase ends the span of the running phase, which failed if err is set
+func traceEndPhase(err error) {
+	t := tracing.Load()
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.endPhase(err)
+}
+
+// traceClient records the span of a call to another program or service from start until it returned,
+// a child of the running phase
+func traceClient(name string, attributes []otlpAttribute, start time.Time, err error) {
+	t := tracing.Load()
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	parent := t.root
+	if t.phase != nil {
+		parent = t.phase
+	}
+
+	span := t.start(name, parent.SpanID, spanKindClient, start)
+	span.Attributes = attributes
+	t.end(span, err, time.Now())
+}
+
+// traceCommand records the span of a program run by a runner from start until it exited
+func traceCommand(args []string, start time.Time, err error) {
+	if tracing.Load() == nil {
+		return
+	}
+
+	traceClient(filepath.Base(args[0]), []otlpAttribute{
+		stringAttribute("process.command_line", strings.Join(redactArgs(args), " ")),
+		intAttribute("process.exit.code", exitCode(err)),
+	}, start, err)
+}
+
+// tracedTransport records the span of each request to the Kubernetes API
+type tracedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tracing.Load() == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	attributes := []otlpAttribute{
+		stringAttribute("http.request.method", req.Method),
+		stringAttribute("server.address", req.URL.Hostname()),
+		stringAttribute("url.path", req.URL.Path),
+	}
+	spanErr := err
+	if resp != nil {
+		attributes = append(attributes, intAttribute("http.response.status_code", resp.StatusCode))
+		if spanErr == nil && resp.StatusCode >= 400 {
+			spanErr = fmt.Errorf("%s", resp.Status)
+		}
+	}
+	traceClient(req.Method+" "+req.URL.Path, attributes, start, spanErr)
+
+	return resp, err
+}
+
+// finishTracing ends the trace of the run, which failed if err is set, and exports it to the collector
+func finishTracing(c *cli.Context, err error) {
+	t := tracing.Swap(nil)
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.endPhase(err)
+	t.end(t.root, err, time.Now())
+	t.mu.Unlock()
+
+	// The deploy completed, failing to export its trace does not fail it
+	if err := t.export(traceAttributes(c)); err != nil {
+		log("Warning: exporting the trace to %s: %s\n", t.endpoint, err)
+	}
+}
+
+// export sends the spans of the trace to the collector, with the attributes of its resource
+func (t *tracer) export(attributes []otlpAttribute) error {
+	spans := make([]otlpSpan, len(t.spans))
+	for i, span := range t.spans {
+		spans[i] = *span
+	}
+
+	blob, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: attributes},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "drone-gke"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the collector responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+// collector is a stand-in of an OTLP/HTTP collector, receiving the exported traces
+func collector(t *testing.T, status int) (*httptest.Server, func() []otlpTraces) {
+	received := []otlpTraces{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			t.Errorf("decoding the traces: %s", err)
+		}
+		received = append(received, traces)
+		w.WriteHeader(status)
+	}))
+	return server, func() []otlpTraces { return received }
+}
+
+func tracingContext(endpoint, traceparent string) *cli.Context {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("otlp-endpoint", endpoint, "")
+	set.String("traceparent", traceparent, "")
+	set.String("cluster", "cluster-0", "")
+	set.String("namespace", "test-ns", "")
+	set.String("drone-commit", "e3b0c44", "")
+	set.String("drone-build-number", "42", "")
+	return cli.NewContext(nil, set, nil)
+}
+
+func TestTracing(t *testing.T) {
+	server, received := collector(t, http.StatusOK)
+	defer server.Close()
+	defer resetPhases()
+	defer setLogPhase("")
+
+	c := tracingContext(server.URL, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	assert.NoError(t, startTracing(c))
+
+	e := NewBasicRunner("/tmp", []string{}, nil, nil)
+	startPhase("apply")
+	assert.NoError(t, e.Run(context.Background(), "/bin/true"))
+	startPhase("wait")
+	assert.Error(t, e.Run(context.Background(), "/bin/sh", "-c", "exit 3", "--token=abc"))
+	err := errors.New("Error: 1 of 1 waits failed\n")
+	endPhase(err)
+	finishTracing(c, err)
+	assert.Nil(t, tracing.Load())
+
+	traces := received()
+	assert.Len(t, traces, 1)
+	resource := traces[0].ResourceSpans[0]
+	assert.Equal(t, []otlpAttribute{
+		stringAttribute("service.name", "drone-gke"),
+		stringAttribute("k8s.cluster.name", "cluster-0"),
+		stringAttribute("k8s.namespace.name", "test-ns"),
+		stringAttribute("vcs.ref.head.revision", "e3b0c44"),
+		stringAttribute("cicd.pipeline.run.id", "42"),
+	}, resource.Resource.Attributes)
+
+	spans := resource.ScopeSpans[0].Spans
+	names := []string{}
+	for _, span := range spans {
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.TraceID)
+		assert.Len(t, span.SpanID, 16)
+		assert.NotEmpty(t, span.EndTimeUnixNano)
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"deploy", "apply", "true", "wait", "sh"}, names)
+
+	deploy, apply, trueCmd, wait, sh := spans[0], spans[1], spans[2], spans[3], spans[4]
+	assert.Equal(t, "b7ad6b7169203331", deploy.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: spanStatusError, Message: "Error: 1 of 1 waits failed"}, deploy.Status)
+	assert.Equal(t, deploy.SpanID, apply.ParentSpanID)
+	assert.Equal(t, otlpStatus{}, apply.Status)
+	assert.Equal(t, apply.SpanID, trueCmd.ParentSpanID)
+	assert.Equal(t, deploy.SpanID, wait.ParentSpanID)
+	assert.Equal(t, spanStatusError, wait.Status.Code)
+	assert.Equal(t, wait.SpanID, sh.ParentSpanID)
+	assert.Equal(t, []otlpAttribute{
+		stringAttribute("process.command_line", "/bin/sh -c exit 3 --token=REDACTED"),
+		intAttribute("process.exit.code", 3),
+	}, sh.Attributes)
+	assert.Equal(t, otlpStatus{Code: spanStatusError, Message: "exit status 3"}, sh.Status)
+}
+
+func TestStartTracing(t *testing.T) {
+	defer tracing.Store(nil)
+
+	// Disabled
+	assert.NoError(t, startTracing(tracingContext("", "")))
+	assert.Nil(t, tracing.Load())
+
+	// A new trace, if the traceparent is invalid
+	assert.NoError(t, startTracing(tracingContext("https://collector.example.com/otlp/", "00-00000000000000000000000000000000-b7ad6b7169203331-01")))
+	tracer := tracing.Load()
+	assert.Equal(t, "https://collector.example.com/otlp/v1/traces", tracer.endpoint)
+	assert.Len(t, tracer.traceID, 32)
+	assert.NotEqual(t, "00000000000000000000000000000000", tracer.traceID)
+	assert.Empty(t, tracer.root.ParentSpanID)
+
+	assert.EqualError(t, startTracing(tracingContext("collector:4318", "")), "Invalid param otlp-endpoint: must be an http or https URL, e.g. http://otel-collector:4318")
+}
+
+func TestFinishTracingExportError(t *testing.T) {
+	server, received := collector(t, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	// The deploy does not fail if its trace is not exported
+	c := tracingContext(server.URL+"/v1/traces", "")
+	assert.NoError(t, startTracing(c))
+	finishTracing(c, nil)
+	assert.Len(t, received(), 1)
+	assert.Nil(t, tracing.Load())
+}
+
+func TestTracingNativeClient(t *testing.T) {
+	server, received := collector(t, http.StatusOK)
+	defer server.Close()
+	defer resetPhases()
+	defer setLogPhase("")
+
+	f := newFakeAPIServer(t)
+	defer f.Close()
+	client := newTestNativeClient(t, f)
+	f.set(t, "/api/v1/namespaces/test-ns/services/app", `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "app", "namespace": "test-ns"}}`)
+
+	c := tracingContext(server.URL, "")
+	assert.NoError(t, startTracing(c))
+	startPhase("prepare")
+	_, found, err := client.get(objectReference("v1", "Service", "app", "test-ns"))
+	assert.NoError(t, err)
+	assert.True(t, found)
+	_, found, err = client.get(objectReference("v1", "Service", "web", "test-ns"))
+	assert.NoError(t, err)
+	assert.False(t, found)
+	endPhase(nil)
+	finishTracing(c, nil)
+
+	spans := received()[0].ResourceSpans[0].ScopeSpans[0].Spans
+	prepare := spans[1]
+	assert.Equal(t, "prepare", prepare.Name)
+
+	requests := map[string]otlpSpan{}
+	for _, span := range spans[2:] {
+		assert.Equal(t, prepare.SpanID, span.ParentSpanID)
+		assert.Equal(t, spanKindClient, span.Kind)
+		requests[span.Name] = span
+	}
+
+	app := requests["GET /api/v1/namespaces/test-ns/services/app"]
+	assert.Contains(t, app.Attributes, stringAttribute("http.request.method", "GET"))
+	assert.Contains(t, app.Attributes, intAttribute("http.response.status_code", http.StatusOK))
+	assert.Equal(t, otlpStatus{}, app.Status)
+
+	web := requests["GET /api/v1/namespaces/test-ns/services/web"]
+	assert.Contains(t, web.Attributes, intAttribute("http.response.status_code", http.StatusNotFound))
+	assert.Equal(t, spanStatusError, web.Status.Code)
+}
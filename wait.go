@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// resourceWait is a resource to wait for after applying the manifests
+type resourceWait struct {
+	// resource as given to kubectl, e.g. deployment/app
+	resource  string
+	namespace string
+	// job waits for the job to complete instead of the rollout of the resource
+	job bool
+	// condition waits for the condition instead of the rollout of the resource
+	condition *waitCondition
+	// address waits for the load balancer address of the resource instead of its rollout
+	address bool
+	timeout time.Duration
+}
+
+const (
+	waitConditionExists    = "exists"
+	waitConditionDeleted   = "deleted"
+	waitConditionCondition = "condition"
+	waitConditionJSONPath  = "jsonpath"
+)
+
+// waitCondition is a condition to wait for, as the --for flag of kubectl wait
+type waitCondition struct {
+	// kind is one of waitConditionExists, waitConditionDeleted, waitConditionCondition, waitConditionJSONPath
+	kind string
+	// expression is the condition type, e.g. Ready, or the JSONPath expression, e.g. {.status.phase}
+	expression string
+	// value is the expected status of the condition, True if not set,
+	// or the expected value of the JSONPath expression, any non-empty value if not set
+	value string
+}
+
+// waitForSpec is an entry of the wait-for param
+type waitForSpec struct {
+	Resource  string `json:"resource"`
+	For       string `json:"for"`
+	Namespace string `json:"namespace"`
+	Timeout   int    `json:"timeout"`
+}
+
+// parseWaitCondition parses a condition as given to kubectl wait --for, e.g. condition=Ready,
+// jsonpath={.status.phase}=Running, exists, deleted, or just the condition type
+func parseWaitCondition(s string) (waitCondition, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "--for=")
+
+	switch s {
+	case "":
+		return waitCondition{}, fmt.Errorf("the condition is empty")
+	case waitConditionExists, "create":
+		return waitCondition{kind: waitConditionExists}, nil
+	case waitConditionDeleted, "delete":
+		return waitCondition{kind: waitConditionDeleted}, nil
+	}
+
+	if strings.HasPrefix(s, waitConditionJSONPath+"=") {
+		s = strings.TrimPrefix(s, waitConditionJSONPath+"=")
+		s = strings.Replace(s, "'", "", 2)
+
+		// The expression ends with its last closing brace, the expected value follows it
+		end := strings.LastIndex(s, "}")
+		if !strings.HasPrefix(s, "{") || end < 0 {
+			return waitCondition{}, fmt.Errorf("invalid JSONPath expression %q, it must be enclosed in braces", s)
+		}
+
+		condition := waitCondition{kind: waitConditionJSONPath, expression: s[:end+1]}
+		if rest := s[end+1:]; rest != "" {
+			if !strings.HasPrefix(rest, "=") {
+				return waitCondition{}, fmt.Errorf("invalid JSONPath condition %q, expected {expression}=value", s)
+			}
+			condition.value = strings.TrimPrefix(rest, "=")
+		}
+		return condition, nil
+	}
+
+	s = strings.TrimPrefix(s, waitConditionCondition+"=")
+	parts := strings.SplitN(s, "=", 2)
+	if parts[0] == "" || strings.ContainsAny(parts[0], "{}") {
+		return waitCondition{}, fmt.Errorf("invalid condition %q", s)
+	}
+
+	condition := waitCondition{kind: waitConditionCondition, expression: parts[0]}
+	if len(parts) == 2 {
+		condition.value = parts[1]
+	}
+	return condition, nil
+}
+
+// kubectlArg returns the condition as the value of the --for flag of kubectl wait
+func (w waitCondition) kubectlArg() string {
+	switch w.kind {
+	case waitConditionExists:
+		return "create"
+	case waitConditionDeleted:
+		return "delete"
+	}
+
+	arg := w.kind + "=" + w.expression
+	if w.value != "" {
+		arg += "=" + w.value
+	}
+	return arg
+}
+
+func (w waitCondition) String() string {
+	switch w.kind {
+	case waitConditionExists, waitConditionDeleted:
+		return w.kind
+	}
+	return w.kubectlArg()
+}
+
+// waitResult is the outcome of a resourceWait
+type waitResult struct {
+	wait     resourceWait
+	err      error
+	duration time.Duration
+	// addresses of the load balancer, for address waits
+	addresses []string
+}
+
+// rolloutWaits returns the rollouts listed in wait-deployments
+func rolloutWaits(c *cli.Context) []resourceWait {
+	waits := []resourceWait{}
+
+	for _, spec := range c.StringSlice("wait-deployments") {
+		// default type to "deployment" if not present
+		deployment := spec
+		if !strings.Contains(spec, "/") {
+			deployment = "deployment/" + deployment
+		}
+
+		waits = append(waits, resourceWait{
+			resource:  deployment,
+			namespace: c.String("namespace"),
+			timeout:   time.Duration(c.Int("wait-seconds")) * time.Second,
+		})
+	}
+
+	return waits
+}
+
+// jobWaits returns the jobs listed in wait-jobs
+func jobWaits(c *cli.Context) []resourceWait {
+	waits := []resourceWait{}
+
+	for _, spec := range c.StringSlice("wait-jobs") {
+		job := spec
+		if !strings.HasPrefix(spec, "job/") {
+			job = "job/" + job
+		}
+
+		waits = append(waits, resourceWait{
+			resource:  job,
+			namespace: c.String("namespace"),
+			job:       true,
+			timeout:   time.Duration(c.Int("wait-jobs-seconds")) * time.Second,
+		})
+	}
+
+	return waits
+}
+
+// conditionWaits returns the conditions listed in wait-for (in JSON)
+func conditionWaits(c *cli.Context) ([]resourceWait, error) {
+	waits := []resourceWait{}
+
+	waitForJSON := c.String("wait-for")
+	if waitForJSON == "" {
+		return waits, nil
+	}
+
+	specs := []waitForSpec{}
+	if err := json.Unmarshal([]byte(waitForJSON), &specs); err != nil {
+		return nil, fmt.Errorf("Error parsing wait-for: %s\n", err)
+	}
+
+	for i, spec := range specs {
+		if !strings.Contains(spec.Resource, "/") {
+			return nil, fmt.Errorf("Error parsing wait-for: entry %d: resource must be <kind>/<name>, got %q\n", i+1, spec.Resource)
+		}
+
+		condition, err := parseWaitCondition(spec.For)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing wait-for: entry %d (%s): %s\n", i+1, spec.Resource, err)
+		}
+
+		namespace := spec.Namespace
+		if namespace == "" {
+			namespace = c.String("namespace")
+		}
+
+		waits = append(waits, resourceWait{
+			resource:  spec.Resource,
+			namespace: namespace,
+			condition: &condition,
+			timeout:   time.Duration(spec.Timeout) * time.Second,
+		})
+	}
+
+	return waits, nil
+}
+
+// addressWaits returns the Services and Ingresses listed in wait-addresses
+func addressWaits(c *cli.Context) []resourceWait {
+	waits := []resourceWait{}
+
+	for _, spec := range c.StringSlice("wait-addresses") {
+		// default type to "service" if not present
+		resource := spec
+		if !strings.Contains(spec, "/") {
+			resource = "service/" + resource
+		}
+
+		waits = append(waits, resourceWait{
+			resource:  resource,
+			namespace: c.String("namespace"),
+			address:   true,
+			timeout:   time.Duration(c.Int("wait-addresses-seconds")) * time.Second,
+		})
+	}
+
+	return waits
+}
+
+// replacedJobWaits returns the replaced Jobs, waited for as the jobs listed in wait-jobs
+func replacedJobWaits(c *cli.Context, objects []*manifestObject, replaced map[*manifestObject]bool) []resourceWait {
+	waits := []resourceWait{}
+
+	for _, o := range objects {
+		if !replaced[o] || o.kind() != "Job" {
+			continue
+		}
+
+		waits = append(waits, resourceWait{
+			resource:  objectRef(o),
+			namespace: o.namespace(),
+			job:       true,
+			timeout:   time.Duration(c.Int("wait-jobs-seconds")) * time.Second,
+		})
+	}
+
+	return waits
+}
+
+// waitForResources waits for all resources concurrently, for at most wait-deadline-seconds if set,
+// then prints a summary of the waits and returns their results
+func waitForResources(c *cli.Context, waits []resourceWait, client clusterClient) ([]waitResult, error) {
+	if len(waits) == 0 {
+		return nil, nil
+	}
+
+	deadline := time.Duration(c.Int("wait-deadline-seconds")) * time.Second
+	if deadline != 0 {
+		log("Waiting for %d resources, for at most %s\n", len(waits), deadline)
+	} else {
+		log("Waiting for %d resources\n", len(waits))
+	}
+
+	// Lines of the concurrent waits are written whole, prefixed by their resource
+	var mu sync.Mutex
+	results := make([]waitResult, len(waits))
+	var wg sync.WaitGroup
+
+	for i, w := range waits {
+		// All the waits start now, bounding each by the deadline bounds them all
+		if deadline != 0 && (w.timeout == 0 || w.timeout > deadline) {
+			w.timeout = deadline
+		}
+
+		wg.Add(1)
+		go func(i int, w resourceWait) {
+			defer wg.Done()
+
+			out := newWaitWriter(&mu, w.resource)
+			defer out.Flush()
+
+			results[i] = runWait(w, client.withOutput(out), out)
+		}(i, w)
+	}
+
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+		}
+	}
+
+	if logFormat == logFormatJSON {
+		logWaitResults(results)
+	} else {
+		log("Wait summary\n")
+		printWaitSummary(logStdout(), results)
+	}
+
+	if failed > 0 {
+		return results, fmt.Errorf("%d of %d waits failed", failed, len(results))
+	}
+
+	return results, nil
+}
+
+// runWait waits for a single resource
+func runWait(w resourceWait, client clusterClient, out io.Writer) waitResult {
+	start := time.Now()
+
+	var err error
+	var addresses []string
+	if w.address {
+		fmt.Fprintln(out, "Waiting until the load balancer has an address")
+		addresses, err = client.waitForAddress(w.resource, w.namespace, w.timeout)
+	} else if w.condition != nil {
+		fmt.Fprintf(out, "Waiting for %s\n", w.condition)
+		err = client.waitForCondition(w.resource, w.namespace, *w.condition, w.timeout)
+	} else if w.job {
+		fmt.Fprintln(out, "Waiting until job completes")
+		err = client.waitForJob(w.resource, w.namespace, w.timeout)
+	} else {
+		fmt.Fprintln(out, "Waiting until rollout completes")
+		err = client.waitForRollout(w.resource, w.namespace, w.timeout)
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "Failed: %s\n", err)
+	}
+
+	return waitResult{wait: w, err: err, duration: time.Since(start), addresses: addresses}
+}
+
+// logWaitResults logs the result of each wait as an event of the json log-format
+func logWaitResults(results []waitResult) {
+	for _, result := range results {
+		seconds := result.duration.Seconds()
+		e := logEvent{Resource: result.wait.resource, Duration: &seconds, Message: "passed"}
+		if len(result.addresses) > 0 {
+			e.Message += ", addresses " + strings.Join(result.addresses, ", ")
+		}
+		if result.err != nil {
+			e.Level, e.Message, e.Error = levelError, "failed", strings.TrimSpace(result.err.Error())
+		}
+		emit(e)
+	}
+}
+
+// printWaitSummary prints a table of the outcome of each wait
+func printWaitSummary(w io.Writer, results []waitResult) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "RESOURCE\tNAMESPACE\tRESULT\tDURATION\tDETAILS")
+
+	for _, result := range results {
+		status, message := "passed", strings.Join(result.addresses, ", ")
+		if result.err != nil {
+			status, message = "FAILED", strings.TrimSpace(result.err.Error())
+		}
+
+		namespace := result.wait.namespace
+		if namespace == "" {
+			namespace = "-"
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", result.wait.resource, namespace, status, result.duration.Round(time.Second), message)
+	}
+
+	table.Flush()
+}
+
+// addressOutputs returns the addresses of the load balancers by object name
+func addressOutputs(results []waitResult) map[string][]string {
+	outputs := make(map[string][]string)
+	for _, result := range results {
+		if result.wait.address && result.err == nil {
+			_, name := splitResource(result.wait.resource)
+			outputs[name] = result.addresses
+		}
+	}
+	return outputs
+}
+
+// writeOutputs writes the addresses of the load balancers to outputs-file (in JSON), if set
+func writeOutputs(c *cli.Context, results []waitResult) error {
+	path := c.String("outputs-file")
+	if path == "" {
+		return nil
+	}
+
+	blob, err := json.MarshalIndent(addressOutputs(results), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	log("Writing the load balancer addresses to %s\n", path)
+
+	if err := ioutil.WriteFile(path, append(blob, '\n'), 0644); err != nil {
+		return fmt.Errorf("Error writing outputs: %s\n", err)
+	}
+
+	return nil
+}
+
+// prefixWriter prefixes each line written with a prefix, writing whole lines to an io.Writer shared
+// with other prefixWriters under a common lock
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	line   bytes.Buffer
+}
+
+// lineWriter is a writer buffering lines, until flushed
+type lineWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// newWaitWriter returns the writer of the progress of the wait of a resource, its lines prefixed by the resource,
+// or written as events in the json log-format
+func newWaitWriter(mu *sync.Mutex, resource string) lineWriter {
+	if logFormat == logFormatJSON {
+		return newEventWriter(logEvent{Level: levelInfo, Resource: resource})
+	}
+	return newPrefixWriter(os.Stdout, mu, fmt.Sprintf("[%s] ", resource))
+}
+
+func newPrefixWriter(w io.Writer, mu *sync.Mutex, prefix string) *prefixWriter {
+	return &prefixWriter{w: w, mu: mu, prefix: prefix}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	for _, b := range data {
+		p.line.WriteByte(b)
+		if b == '\n' {
+			if err := p.writeLine(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(data), nil
+}
+
+// Flush writes the last line, if not terminated by a newline
+func (p *prefixWriter) Flush() error {
+	if p.line.Len() == 0 {
+		return nil
+	}
+	p.line.WriteByte('\n')
+	return p.writeLine()
+}
+
+func (p *prefixWriter) writeLine() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.line.Bytes())
+	p.line.Reset()
+	return err
+}
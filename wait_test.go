@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/urfave/cli/v2"
+)
+
+func TestWaitForResourcesConcurrently(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.Int("wait-seconds", 256, "")
+	set.Int("wait-deadline-seconds", 60, "")
+	set.String("namespace", "test-ns", "")
+	deployments := cli.NewStringSlice("app", "statefulset/db")
+	(&cli.StringSliceFlag{Name: "wait-deployments", Value: deployments}).Apply(set)
+	jobs := cli.NewStringSlice("migrate")
+	(&cli.StringSliceFlag{Name: "wait-jobs", Value: jobs}).Apply(set)
+	c := cli.NewContext(nil, set, nil)
+
+	// Each wait only returns once all of them started
+	var started sync.WaitGroup
+	started.Add(3)
+	barrier := func(mock.Arguments) {
+		started.Done()
+		started.Wait()
+	}
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "rollout", "status", "deployment/app", "--namespace", "test-ns"}).Run(barrier).Return(nil)
+	testRunner.On("Run", []string{"kubectl", "rollout", "status", "statefulset/db", "--namespace", "test-ns"}).Run(barrier).Return(errors.New("kubectl timed out"))
+	testRunner.On("Output", []string{"kubectl", "get", "job/migrate", "-o=json", "--namespace", "test-ns"}).Run(barrier).Return(testJobComplete, nil)
+
+	done := make(chan error)
+	go func() {
+		_, err := waitForResources(c, append(rolloutWaits(c), jobWaits(c)...), &kubectlClient{runner: testRunner})
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		assert.EqualError(t, err, "1 of 3 waits failed")
+	case <-time.After(10 * time.Second):
+		t.Fatal("the waits did not run concurrently")
+	}
+	testRunner.AssertExpectations(t)
+}
+
+func TestPrintWaitSummary(t *testing.T) {
+	var output bytes.Buffer
+	printWaitSummary(&output, []waitResult{
+		{wait: resourceWait{resource: "deployment/app", namespace: "test-ns"}, duration: 12 * time.Second},
+		{wait: resourceWait{resource: "job/migrate", job: true}, err: errors.New("timed out waiting for job/migrate"), duration: 1500 * time.Millisecond},
+		{wait: resourceWait{resource: "service/app", namespace: "test-ns", address: true}, addresses: []string{"34.1.2.3", "app.example.com"}},
+	})
+
+	assert.Equal(t, strings.Join([]string{
+		"RESOURCE        NAMESPACE  RESULT  DURATION  DETAILS",
+		"deployment/app  test-ns    passed  12s       ",
+		"job/migrate     -          FAILED  2s        timed out waiting for job/migrate",
+		"service/app     test-ns    passed  0s        34.1.2.3, app.example.com",
+		"",
+	}, "\n"), output.String())
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var output bytes.Buffer
+	var mu sync.Mutex
+	app := newPrefixWriter(&output, &mu, "[deployment/app] ")
+	db := newPrefixWriter(&output, &mu, "[statefulset/db] ")
+
+	app.Write([]byte("Waiting for deployment "))
+	db.Write([]byte("partitioned roll out complete\nWaiting"))
+	app.Write([]byte("\"app\" rollout to finish\n"))
+	db.Flush()
+	app.Flush()
+
+	assert.Equal(t, strings.Join([]string{
+		"[statefulset/db] partitioned roll out complete",
+		"[deployment/app] Waiting for deployment \"app\" rollout to finish",
+		"[statefulset/db] Waiting",
+		"",
+	}, "\n"), output.String())
+}
+
+func TestWaitCommandPrefixed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wait")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	script := "#!/bin/sh\necho 'deployment \"app\" successfully rolled out'\n"
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kubectl"), []byte(script), 0755))
+	defer func(cmd string) { kubectlCmd = cmd }(kubectlCmd)
+	kubectlCmd = filepath.Join(dir, "kubectl")
+
+	// The command is printed with the output of the wait, prefixed by its resource
+	var output bytes.Buffer
+	var mu sync.Mutex
+	out := newPrefixWriter(&output, &mu, "[deployment/app] ")
+	client := &kubectlClient{runner: NewBasicRunner("", os.Environ(), os.Stdout, os.Stderr)}
+	assert.NoError(t, client.withOutput(out).waitForRollout("deployment/app", "test-ns", 0))
+	out.Flush()
+
+	assert.Equal(t, strings.Join([]string{
+		"[deployment/app] ",
+		"[deployment/app] $ " + kubectlCmd + " rollout status deployment/app --namespace test-ns",
+		"[deployment/app] deployment \"app\" successfully rolled out",
+		"",
+	}, "\n"), output.String())
+}
+
+func TestParseWaitCondition(t *testing.T) {
+	for _, test := range []struct {
+		input     string
+		condition waitCondition
+		arg       string
+	}{
+		{"exists", waitCondition{kind: waitConditionExists}, "create"},
+		{"create", waitCondition{kind: waitConditionExists}, "create"},
+		{"deleted", waitCondition{kind: waitConditionDeleted}, "delete"},
+		{"Ready", waitCondition{kind: waitConditionCondition, expression: "Ready"}, "condition=Ready"},
+		{"condition=Available", waitCondition{kind: waitConditionCondition, expression: "Available"}, "condition=Available"},
+		{"--for=condition=Degraded=false", waitCondition{kind: waitConditionCondition, expression: "Degraded", value: "false"}, "condition=Degraded=false"},
+		{"jsonpath={.status.phase}=Running", waitCondition{kind: waitConditionJSONPath, expression: "{.status.phase}", value: "Running"}, "jsonpath={.status.phase}=Running"},
+		{"jsonpath='{.status.loadBalancer.ingress}'", waitCondition{kind: waitConditionJSONPath, expression: "{.status.loadBalancer.ingress}"}, "jsonpath={.status.loadBalancer.ingress}"},
+		{"jsonpath={.status.conditions[?(@.type==\"Ready\")].status}=True", waitCondition{kind: waitConditionJSONPath, expression: "{.status.conditions[?(@.type==\"Ready\")].status}", value: "True"}, "jsonpath={.status.conditions[?(@.type==\"Ready\")].status}=True"},
+	} {
+		condition, err := parseWaitCondition(test.input)
+		assert.NoError(t, err, test.input)
+		assert.Equal(t, test.condition, condition, test.input)
+		assert.Equal(t, test.arg, condition.kubectlArg(), test.input)
+	}
+
+	for _, input := range []string{"", "condition=", "jsonpath=.status.phase", "jsonpath={.status.phase}Running", "{.status.phase}"} {
+		_, err := parseWaitCondition(input)
+		assert.Error(t, err, input)
+	}
+}
+
+func TestConditionWaits(t *testing.T) {
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("namespace", "test-ns", "")
+	set.String("wait-for", `[
+		{"resource": "certificate/app", "for": "condition=Ready", "timeout": 300},
+		{"resource": "managedcertificate/app", "for": "jsonpath={.status.certificateStatus}=Active", "namespace": "other-ns"},
+		{"resource": "job/old-migrate", "for": "deleted"}
+	]`, "")
+	c := cli.NewContext(nil, set, nil)
+
+	waits, err := conditionWaits(c)
+	assert.NoError(t, err)
+	assert.Len(t, waits, 3)
+
+	testRunner := new(MockedRunner)
+	testRunner.On("Run", []string{"kubectl", "wait", "--for=condition=Ready", "certificate/app", "--timeout=300s", "--namespace", "test-ns"}).Return(nil)
+	testRunner.On("Run", []string{"kubectl", "wait", "--for=jsonpath={.status.certificateStatus}=Active", "managedcertificate/app", "--namespace", "other-ns"}).Return(nil)
+	testRunner.On("Run", []string{"kubectl", "wait", "--for=delete", "job/old-migrate", "--namespace", "test-ns"}).Return(nil)
+	_, err = waitForResources(c, waits, &kubectlClient{runner: testRunner})
+	assert.NoError(t, err)
+	testRunner.AssertExpectations(t)
+
+	for _, invalid := range []string{
+		`{"resource": "certificate/app"}`,
+		`[{"resource": "app", "for": "condition=Ready"}]`,
+		`[{"resource": "certificate/app", "for": ""}]`,
+	} {
+		set.Set("wait-for", invalid)
+		_, err := conditionWaits(c)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestWaitForAddresses(t *testing.T) {
+	outputs, err := ioutil.TempFile("", "outputs")
+	if err != nil {
+		t.Fatalf("creating the outputs file: %s", err)
+	}
+	defer os.Remove(outputs.Name())
+
+	set := flag.NewFlagSet("test-set", 0)
+	set.String("namespace", "test-ns", "")
+	set.Int("wait-addresses-seconds", 600, "")
+	set.String("outputs-file", outputs.Name(), "")
+	(&cli.StringSliceFlag{Name: "wait-addresses", Value: cli.NewStringSlice("app", "ingress/web")}).Apply(set)
+	c := cli.NewContext(nil, set, nil)
+
+	waits := addressWaits(c)
+	assert.Equal(t, []resourceWait{
+		{resource: "service/app", namespace: "test-ns", address: true, timeout: 600 * time.Second},
+		{resource: "ingress/web", namespace: "test-ns", address: true, timeout: 600 * time.Second},
+	}, waits)
+
+	results := []waitResult{
+		{wait: waits[0], addresses: []string{"34.1.2.3"}},
+		{wait: waits[1], addresses: []string{"web.example.com", "34.4.5.6"}},
+		{wait: resourceWait{resource: "deployment/app"}},
+	}
+	assert.NoError(t, writeOutputs(c, results))
+
+	blob, err := ioutil.ReadFile(outputs.Name())
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"app": ["34.1.2.3"], "web": ["web.example.com", "34.4.5.6"]}`, string(blob))
+}